@@ -4,12 +4,19 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"text/template"
+	"time"
+
+	"github.com/airnandez/cluefs/fs"
+	"github.com/airnandez/cluefs/inject"
+	"github.com/airnandez/cluefs/trace"
 )
 
 type HelpType uint32
@@ -66,17 +73,53 @@ func ParseArguments() (*Config, error) {
 	var (
 		mount    string
 		shadow   string
-		outFile  string
+		outs     listFlag
 		readOnly bool
 		json     bool
 		csv      bool
+		format   string
+		buffer   int
+		overflow string
+		paths    string
+		maxSize  string
+		maxAge   time.Duration
+		keep     int
+		compress string
+		stats    bool
+		interval time.Duration
+		statsOut string
+		metrics  string
+		rules    string
+		crash    string
 	)
 	flag.StringVar(&mount, "mount", "", "")
 	flag.StringVar(&shadow, "shadow", "", "")
-	flag.StringVar(&outFile, "out", "-", "")
+	flag.Var(&outs, "out", "")
 	flag.BoolVar(&readOnly, "ro", false, "")
 	flag.BoolVar(&json, "json", false, "")
 	flag.BoolVar(&csv, "csv", false, "")
+	flag.StringVar(&format, "format", "", "")
+	flag.IntVar(&buffer, "buffer", 1024, "")
+	flag.StringVar(&overflow, "overflow", "block", "")
+	flag.StringVar(&paths, "path-style", "shadow", "")
+	flag.StringVar(&maxSize, "out-max-size", "", "")
+	flag.DurationVar(&maxAge, "out-max-age", 0, "")
+	flag.IntVar(&keep, "out-keep", 0, "")
+	flag.StringVar(&compress, "out-compress", "none", "")
+	flag.BoolVar(&stats, "stats", false, "")
+	flag.DurationVar(&interval, "stats-interval", 2*time.Second, "")
+	flag.StringVar(&statsOut, "stats-out", "", "")
+	flag.StringVar(&metrics, "metrics-listen", "", "")
+	flag.StringVar(&rules, "inject", "", "")
+	flag.StringVar(&crash, "crash-sim", "", "")
+	includes := make([]*listFlag, len(filterOptions))
+	excludes := make([]*listFlag, len(filterOptions))
+	for i, opt := range filterOptions {
+		includes[i] = &listFlag{split: opt.split}
+		excludes[i] = &listFlag{split: opt.split}
+		flag.Var(includes[i], "include-"+opt.name, "")
+		flag.Var(excludes[i], "exclude-"+opt.name, "")
+	}
 	flag.Parse()
 	if !flag.Parsed() {
 		return nil, parseErr
@@ -96,15 +139,294 @@ func ParseArguments() (*Config, error) {
 	}
 
 	// Validate arguments and save configuration
-	config, err := saveConfig(mount, shadow, outFile, csv, json, readOnly)
+	config, err := saveConfig(mount, shadow, paths, readOnly)
 	if err != nil {
 		errlog.Println(err)
 		return nil, err
 	}
+	statsOpts, err := buildStatsOptions(stats, interval, statsOut)
+	if err != nil {
+		errlog.Println(err)
+		return nil, err
+	}
+	config.SetStatsOptions(statsOpts)
+	if len(metrics) > 0 {
+		if _, _, err := net.SplitHostPort(metrics); err != nil {
+			err = fmt.Errorf("invalid value for option --metrics-listen: %s", err)
+			errlog.Println(err)
+			return nil, err
+		}
+	}
+	config.SetMetricsAddress(metrics)
+	outputs, err := buildOutputs(outs.values, format, csv, json, buffer, overflow, stats)
+	if err != nil {
+		errlog.Println(err)
+		return nil, err
+	}
+	config.SetOutputs(outputs)
+	rotate, err := buildRotateOptions(outputs, maxSize, maxAge, keep, compress)
+	if err != nil {
+		errlog.Println(err)
+		return nil, err
+	}
+	config.SetRotateOptions(rotate)
+	filter, err := buildFilter(includes, excludes)
+	if err != nil {
+		errlog.Println(err)
+		return nil, err
+	}
+	config.SetFilter(filter)
+	if len(rules) > 0 {
+		injectRules, err := inject.LoadRules(rules)
+		if err != nil {
+			err = fmt.Errorf("invalid value for option --inject: %s", err)
+			errlog.Println(err)
+			return nil, err
+		}
+		config.SetInjectRules(rules, injectRules)
+	}
+	if len(crash) > 0 {
+		if _, err := fs.ParseCrashMode(crash); err != nil {
+			err = fmt.Errorf("invalid value for option --crash-sim: %s", err)
+			errlog.Println(err)
+			return nil, err
+		}
+		if readOnly {
+			err = fmt.Errorf("option --crash-sim is not compatible with --ro")
+			errlog.Println(err)
+			return nil, err
+		}
+	}
+	config.SetCrashMode(crash)
 	return config, nil
 }
 
-func saveConfig(mountDir, shadowDir, outFile string, csv, json, readonly bool) (*Config, error) {
+func buildQueueOptions(size int, overflow string) (trace.QueueOptions, error) {
+	if size <= 0 {
+		return trace.QueueOptions{}, fmt.Errorf("invalid value for option --buffer: %d", size)
+	}
+	policy, rate, err := trace.ParseOverflowPolicy(overflow)
+	if err != nil {
+		return trace.QueueOptions{}, fmt.Errorf("invalid value for option --overflow: %s", err)
+	}
+	return trace.QueueOptions{Size: size, Policy: policy, SampleRate: rate}, nil
+}
+
+func buildRotateOptions(outputs []Output, maxSize string, maxAge time.Duration, keep int, compress string) (trace.RotateOptions, error) {
+	var opts trace.RotateOptions
+	if len(maxSize) > 0 {
+		size, err := parseSize(maxSize)
+		if err != nil || size <= 0 {
+			return opts, fmt.Errorf("invalid value for option --out-max-size: %s", maxSize)
+		}
+		opts.MaxSize = size
+	}
+	if maxAge < 0 {
+		return opts, fmt.Errorf("invalid value for option --out-max-age: %s", maxAge)
+	}
+	opts.MaxAge = maxAge
+	if keep < 0 {
+		return opts, fmt.Errorf("invalid value for option --out-keep: %d", keep)
+	}
+	opts.Keep = keep
+	if !trace.ValidCompression(compress) {
+		return opts, fmt.Errorf("invalid value for option --out-compress: unknown compression '%s'", compress)
+	}
+	opts.Compress = compress
+	if !opts.IsEnabled() {
+		if keep > 0 || compress != "none" {
+			return opts, fmt.Errorf("options --out-keep and --out-compress require --out-max-size or --out-max-age")
+		}
+		return opts, nil
+	}
+	for _, o := range outputs {
+		if trace.IsFileDestination(o.Dest) {
+			return opts, nil
+		}
+	}
+	return opts, fmt.Errorf("options --out-max-size and --out-max-age require an output file")
+}
+
+// sizeUnits are the suffixes accepted by parseSize
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses a size in bytes, optionally followed by one of the
+// suffixes 'K', 'M', 'G' or 'T', e.g. '100M'
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	num := strings.TrimRight(s, "KMGTB")
+	unit := strings.TrimSuffix(s[len(num):], "B")
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * mult, nil
+}
+
+// Output is a destination of the trace events, with the format of the
+// events and the settings of the queue of events waiting to be written to it
+type Output struct {
+	Format string
+	Dest   string
+	Queue  trace.QueueOptions
+}
+
+// buildOutputs validates the values of the '--out' options, each one of
+// the form '[<format>:]<destination>[,buffer=<events>][,overflow=<policy>]'.
+// The format, the buffer size and the overflow policy default to those
+// given by the other options. If the statistics are shown on the standard
+// output, there is no default output and the standard output cannot be used.
+func buildOutputs(values []string, format string, csv, json bool, buffer int, overflow string, stats bool) ([]Output, error) {
+	defaultFormat, err := validateFormat(format, csv, json)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 && !stats {
+		values = []string{"-"}
+	}
+	outputs := make([]Output, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		o := Output{Dest: v, Format: defaultFormat}
+		size, policy := buffer, overflow
+		// Settings specific to this output are at the end
+		for {
+			i := strings.LastIndexByte(o.Dest, ',')
+			if i < 0 {
+				break
+			}
+			setting := o.Dest[i+1:]
+			if strings.HasPrefix(setting, "buffer=") {
+				n, err := strconv.Atoi(setting[len("buffer="):])
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for option --out: invalid buffer size in '%s'", v)
+				}
+				size = n
+			} else if strings.HasPrefix(setting, "overflow=") {
+				policy = setting[len("overflow="):]
+			} else {
+				break
+			}
+			o.Dest = o.Dest[:i]
+		}
+		if i := strings.IndexByte(o.Dest, ':'); i >= 0 && traceFormats[o.Dest[:i]] {
+			o.Format, o.Dest = o.Dest[:i], o.Dest[i+1:]
+		}
+		if len(o.Dest) == 0 {
+			o.Dest = "-"
+		}
+		if len(o.Format) == 0 {
+			o.Format = inferFormat(o.Dest)
+		}
+		if trace.IsURLDestination(o.Dest) && o.Format != "otlp" {
+			return nil, fmt.Errorf("invalid value for option --out: only 'otlp' events can be sent to '%s'", o.Dest)
+		}
+		if seen[o.Dest] {
+			return nil, fmt.Errorf("invalid value for option --out: '%s' is specified more than once", o.Dest)
+		}
+		seen[o.Dest] = true
+		if stats && o.Dest == "-" {
+			return nil, fmt.Errorf("invalid value for option --out: the standard output is used by option --stats")
+		}
+		if o.Queue, err = buildQueueOptions(size, policy); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, nil
+}
+
+// StatsOptions holds the settings of the statistics of the file system
+// operations
+type StatsOptions struct {
+	// Display shows the statistics on the standard output, refreshed every
+	// Interval
+	Display  bool
+	Interval time.Duration
+
+	// Dest is where the statistics are written in JSON format: the path
+	// of a file, "-" for the standard output or "" for the standard error
+	Dest string
+}
+
+// IsEnabled returns true if the statistics are to be collected
+func (o StatsOptions) IsEnabled() bool {
+	return o.Display || len(o.Dest) > 0
+}
+
+func buildStatsOptions(display bool, interval time.Duration, dest string) (StatsOptions, error) {
+	if interval <= 0 {
+		return StatsOptions{}, fmt.Errorf("invalid value for option --stats-interval: %s", interval)
+	}
+	if display && dest == "-" {
+		return StatsOptions{}, fmt.Errorf("invalid value for option --stats-out: the standard output is used by option --stats")
+	}
+	return StatsOptions{Display: display, Interval: interval, Dest: dest}, nil
+}
+
+// listFlag is a command line option which can be specified several times.
+// If split is true, each occurrence may hold several comma-separated values.
+type listFlag struct {
+	values []string
+	split  bool
+}
+
+func (l *listFlag) String() string {
+	return strings.Join(l.values, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	if !l.split {
+		l.values = append(l.values, value)
+		return nil
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			l.values = append(l.values, v)
+		}
+	}
+	return nil
+}
+
+// filterOptions are the suffixes of the '--include-*' and '--exclude-*'
+// command line options and the event attribute each one applies to
+var filterOptions = []struct {
+	name  string
+	field trace.FilterField
+	split bool
+}{
+	{"ops", trace.FilterOp, true},
+	{"path", trace.FilterPath, false},
+	{"uid", trace.FilterUid, true},
+	{"gid", trace.FilterGid, true},
+	{"pid", trace.FilterPid, true},
+	{"proc", trace.FilterProc, false},
+}
+
+func buildFilter(includes, excludes []*listFlag) (*trace.Filter, error) {
+	filter := trace.NewFilter()
+	for i, opt := range filterOptions {
+		if err := filter.Include(opt.field, includes[i].values...); err != nil {
+			return nil, fmt.Errorf("invalid value for option --include-%s: %s", opt.name, err)
+		}
+		if err := filter.Exclude(opt.field, excludes[i].values...); err != nil {
+			return nil, fmt.Errorf("invalid value for option --exclude-%s: %s", opt.name, err)
+		}
+	}
+	return filter, nil
+}
+
+func saveConfig(mountDir, shadowDir, pathStyle string, readonly bool) (*Config, error) {
 	// Validate mount directory
 	absMount, err := validateMountPoint(mountDir)
 	if err != nil {
@@ -125,18 +447,14 @@ func saveConfig(mountDir, shadowDir, outFile string, csv, json, readonly bool) (
 		return nil, fmt.Errorf("mount point (%s) cannot be under target directory (%s)", absMount, absShadow)
 	}
 
-	// Validate output format
-	f, err := validateFormat(outFile, csv, json)
-	if err != nil {
-		return nil, err
-	}
-	conf.SetOutputFormat(f)
-
 	// Set read only
 	conf.SetReadOnly(readonly)
 
-	// Save trace destination
-	conf.SetTraceDestination(outFile)
+	// Validate path style
+	if _, err := fs.ParsePathStyle(pathStyle); err != nil {
+		return nil, fmt.Errorf("invalid value for option --path-style: %s", err)
+	}
+	conf.SetPathStyle(pathStyle)
 
 	return conf, nil
 }
@@ -168,25 +486,55 @@ func validateShadowDir(path string) (string, error) {
 	return abspath, nil
 }
 
-func validateFormat(outFile string, csv, json bool) (string, error) {
-	if csv && json {
-		return "", fmt.Errorf("only one of 'csv' or 'json' options can be specified")
-	}
-	if !csv && !json {
-		// Infer trace format from output file extension, if any
-		switch strings.ToLower(filepath.Ext(outFile)) {
-		case ".json":
-			return "json", nil
-		case ".csv":
-			fallthrough
-		default:
-			return "csv", nil
+// traceFormats are the formats of the trace events, as given to the
+// --format option
+var traceFormats = map[string]bool{
+	"csv":  true,
+	"json": true,
+	"bin":  true,
+	"otlp": true,
+}
+
+// validateFormat returns the format specified by the '--format', '--csv' or
+// '--json' options, or "" if none of them is specified
+func validateFormat(format string, csv, json bool) (string, error) {
+	specified := 0
+	for _, b := range []bool{len(format) > 0, csv, json} {
+		if b {
+			specified++
 		}
 	}
-	if json {
+	if specified > 1 {
+		return "", fmt.Errorf("only one of 'format', 'csv' or 'json' options can be specified")
+	}
+	switch {
+	case csv:
+		return "csv", nil
+	case json:
 		return "json", nil
+	case len(format) > 0:
+		if !traceFormats[format] {
+			return "", fmt.Errorf("invalid value for option --format: unknown format '%s'", format)
+		}
+		return format, nil
+	}
+	return "", nil
+}
+
+// inferFormat returns the format of the trace events written to dest,
+// given the extension of the output file, if any. Events sent to a URL
+// are exported as OTLP spans.
+func inferFormat(dest string) string {
+	if trace.IsURLDestination(dest) {
+		return "otlp"
 	}
-	return "csv", nil
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".json":
+		return "json"
+	case ".bin":
+		return "bin"
+	}
+	return "csv"
 }
 
 func ensureIsDir(abspath string) error {
@@ -223,8 +571,21 @@ func ensureDirEmpty(abspath string) error {
 func printUsage(f *os.File, kind HelpType) {
 	const usageTempl = `
 USAGE:
-{{.Sp3}}{{.AppName}} --mount=<directory>  --shadow=<directory>  [--out=<file>]
-{{.Sp3}}{{.AppNameFiller}} [(--csv | --json)]  [--ro]
+{{.Sp3}}{{.AppName}} --mount=<directory>  --shadow=<directory>  [--out=<output>]...
+{{.Sp3}}{{.AppNameFiller}} [(--csv | --json | --format=<format>)]  [--ro]
+{{.Sp3}}{{.AppNameFiller}} [--out-max-size=<size>]  [--out-max-age=<duration>]
+{{.Sp3}}{{.AppNameFiller}} [--out-keep=<files>]  [--out-compress=(none | gzip)]
+{{.Sp3}}{{.AppNameFiller}} [--buffer=<events>]  [--overflow=<policy>]
+{{.Sp3}}{{.AppNameFiller}} [--path-style=(shadow | mount | relative)]
+{{.Sp3}}{{.AppNameFiller}} [(--include-<attr> | --exclude-<attr>)=<values>]...
+{{.Sp3}}{{.AppNameFiller}} [--stats]  [--stats-interval=<duration>]  [--stats-out=<file>]
+{{.Sp3}}{{.AppNameFiller}} [--metrics-listen=<address>]  [--inject=<file>]
+{{.Sp3}}{{.AppNameFiller}} [--crash-sim=(discard | reorder | tear)]
+{{.Sp3}}{{.AppName}} top --mount=<directory>  --shadow=<directory>  [<options>]
+{{.Sp3}}{{.AppName}} schema [(--csv | --json)]
+{{.Sp3}}{{.AppName}} decode [(--csv | --json)]  [<file>]
+{{.Sp3}}{{.AppName}} replay --target=<directory>  [--timing=(original | fast | <factor>)]
+{{.Sp3}}{{.AppNameFiller}}        [--create-missing]  [--verbose]  [(--csv | --json)]  [<file>]
 {{.Sp3}}{{.AppName}} --help
 {{.Sp3}}{{.AppName}} --version
 {{if eq .UsageVersion "short"}}
@@ -244,7 +605,10 @@ DESCRIPTION:
 {{.Sp3}}directory. See the EXAMPLES section below.
 
 {{.Sp3}}Individual trace events generated by {{.AppName}} are written to the specified
-{{.Sp3}}output file (option --out) in the specified format.
+{{.Sp3}}output file (option --out) in the specified format. The first record
+{{.Sp3}}of the output gives the version of the format of the records, the version
+{{.Sp3}}of {{.AppName}}, the mount point, the shadow directory, the host name and
+{{.Sp3}}the time {{.AppName}} started.
 
 
 OPTIONS:
@@ -258,16 +622,65 @@ OPTIONS:
 {{.Tab1}}actually reside.
 {{.Tab1}}The specified directory must exist but may be empty.
 
-{{.Sp3}}--out=<file>
+{{.Sp3}}--out=[<format>:]<file>[,buffer=<events>][,overflow=<policy>]
 {{.Tab1}}Path of the text file to write the trace events to. If this file
 {{.Tab1}}does not exist it will be created, otherwise new events will be appended.
 {{.Tab1}}Note that this file cannot be located under the shadow directory.
 {{.Tab1}}Use '-' (dash) to write the trace events to the standard output.
-{{.Tab1}}In addition, you can specify a file name with extension '.csv' or '.json'
-{{.Tab1}}to instruct {{.AppName}} to emit records in the corresponding format,
-{{.Tab1}}as if you had used the '--csv' or '--json' options (see below).
+{{.Tab1}}Use 'unix:<path>' to send the trace events to the processes connected
+{{.Tab1}}to a Unix domain socket created at <path>, or 'tcp:<host>:<port>' to send
+{{.Tab1}}them to the processes connected to a TCP socket, <host> being a loopback
+{{.Tab1}}address such as '127.0.0.1'. Processes may connect and disconnect at any
+{{.Tab1}}time; each one first receives the header record. Events are queued
+{{.Tab1}}separately for each process and are dropped, instead of slowing down the
+{{.Tab1}}file system, when a process does not read them fast enough.
+{{.Tab1}}Use an HTTP URL such as 'http://127.0.0.1:4318' to export the trace
+{{.Tab1}}events as spans to an OpenTelemetry collector, in format 'otlp' (see
+{{.Tab1}}option '--format' below). Events are dropped, instead of slowing down
+{{.Tab1}}the file system, when the collector does not accept them fast enough.
+{{.Tab1}}In addition, you can specify a file name with extension '.csv', '.json'
+{{.Tab1}}or '.bin' to instruct {{.AppName}} to emit records in the corresponding
+{{.Tab1}}format, as if you had used the '--format' option (see below).
+{{.Tab1}}This option can be specified several times to write the trace events
+{{.Tab1}}to several outputs at once, each one possibly in a different format.
+{{.Tab1}}The format of an output can be given as a prefix, e.g. 'json:-' or
+{{.Tab1}}'bin:/var/tmp/trace'. Each output has its own buffer of events waiting
+{{.Tab1}}to be written, which size and overflow policy are set by the options
+{{.Tab1}}'--buffer' and '--overflow' (see below) unless they are given after the
+{{.Tab1}}destination, e.g. 'csv:/var/tmp/trace.csv,buffer=4096,overflow=block'.
 {{.Tab1}}Default: write trace records to standard output.
 
+{{.Sp3}}--out-max-size=<size>
+{{.Tab1}}Rotate the output file when its size reaches <size> bytes. The size may
+{{.Tab1}}be followed by one of the suffixes 'K', 'M', 'G' or 'T', e.g. '100M'.
+{{.Tab1}}When rotated, the output file is closed, renamed by appending the time
+{{.Tab1}}of the rotation to its name, e.g. 'trace.csv.20170301T101010.000000000Z',
+{{.Tab1}}and a new output file is started. Each file begins with the header
+{{.Tab1}}record, so that it can be processed on its own, and holds only complete
+{{.Tab1}}events. Since events are written in batches, a rotated file may be
+{{.Tab1}}slightly larger than <size>.
+{{.Tab1}}This option requires an output file (option '--out') which is not a
+{{.Tab1}}socket.
+{{.Tab1}}Default: no limit
+
+{{.Sp3}}--out-max-age=<duration>
+{{.Tab1}}Rotate the output file when it is older than <duration>, provided it
+{{.Tab1}}holds at least one event. The duration is a number followed by a unit,
+{{.Tab1}}e.g. '30m' or '24h'. Both '--out-max-size' and '--out-max-age' can be
+{{.Tab1}}specified, the output file being rotated as soon as one of the limits is
+{{.Tab1}}reached.
+{{.Tab1}}Default: no limit
+
+{{.Sp3}}--out-keep=<files>
+{{.Tab1}}Number of rotated output files to keep. The oldest ones are removed.
+{{.Tab1}}Default: keep all the rotated output files
+
+{{.Sp3}}--out-compress=(none | gzip)
+{{.Tab1}}Compress the rotated output files. With 'gzip', the extension '.gz' is
+{{.Tab1}}appended to the name of the compressed files. zstd is not offered, as
+{{.Tab1}}the Go standard library has no zstd encoder.
+{{.Tab1}}Default: none
+
 {{.Sp3}}--csv
 {{.Tab1}}Format each individual trace event generated by {{.AppName}} as a set of
 {{.Tab1}}comma-separated values in a single line.
@@ -276,7 +689,8 @@ OPTIONS:
 {{.Tab1}}the documentation at 'https://github.com/airnandez/{{.AppName}}' for
 {{.Tab1}}details on the format of each event.
 {{.Tab1}}CSV is the default output format unless the output file name (see option
-{{.Tab1}}'--out' above) has a '.json' extension.
+{{.Tab1}}'--out' above) has a '.json' or '.bin' extension.
+{{.Tab1}}This option is equivalent to '--format=csv'.
 
 {{.Sp3}}--json
 {{.Tab1}}Format each individual trace event generated by {{.AppName}} as
@@ -285,18 +699,209 @@ OPTIONS:
 {{.Tab1}}requires specific arguments. Please refer to the documentation
 {{.Tab1}}at 'https://github.com/airnandez/{{.AppName}}' for details on the format
 {{.Tab1}}of each event.
+{{.Tab1}}This option is equivalent to '--format=json'.
+
+{{.Sp3}}--format=(csv | json | bin | otlp)
+{{.Tab1}}Format of the trace events. The 'csv' and 'json' formats are described
+{{.Tab1}}above. With 'bin', events are written in a compact binary format which
+{{.Tab1}}is much cheaper to produce, intended for workloads which generate a lot
+{{.Tab1}}of events. Use the '{{.AppName}} decode' command to convert it into CSV or
+{{.Tab1}}JSON. With 'otlp', each event is exported as an OpenTelemetry span, the
+{{.Tab1}}operations on an open file being grouped under a span which covers the
+{{.Tab1}}file from its opening to its release. The spans are sent to a collector
+{{.Tab1}}if the output is an HTTP URL, or written in the JSON encoding of OTLP
+{{.Tab1}}otherwise.
+{{.Tab1}}This option, as well as '--csv' and '--json', applies to the outputs
+{{.Tab1}}which format is not given as a prefix (see option '--out' above).
 
 {{.Sp3}}--ro
 {{.Tab1}}Expose the shadow file system as a read-only file system.
 {{.Tab1}}Default: if this option is not specified, the file system is mounted in
 {{.Tab1}}read-write mode.
 
+{{.Sp3}}--path-style=(shadow | mount | relative)
+{{.Tab1}}How the paths of files and directories are written in trace events.
+{{.Tab1}}With 'shadow' they are absolute paths under the shadow directory, with
+{{.Tab1}}'mount' they are absolute paths under the mount point, as seen by the
+{{.Tab1}}traced applications, and with 'relative' they are relative to the
+{{.Tab1}}mount point, '.' being the mount point itself. Patterns given to the
+{{.Tab1}}'--include-path' and '--exclude-path' options (see below) must use
+{{.Tab1}}the same style.
+{{.Tab1}}Default: shadow
+
+{{.Sp3}}--buffer=<events>
+{{.Tab1}}Maximum number of trace events waiting to be written to the output file.
+{{.Tab1}}Default: 1024
+
+{{.Sp3}}--overflow=<policy>
+{{.Tab1}}What to do with a new trace event when there are already as many events
+{{.Tab1}}waiting to be written as specified by '--buffer'. When the output file is
+{{.Tab1}}slow, this happens on every file system operation. Possible values are:
+
+{{.Tab1}}block         the operation waits until the event can be queued
+{{.Tab1}}drop-newest   the new event is dropped
+{{.Tab1}}drop-oldest   the oldest waiting event is dropped
+{{.Tab1}}sample[:N]    when more than half of the buffer is used, only one out
+{{.Tab1}}              of every N events is kept (default N: 10); when the
+{{.Tab1}}              buffer is full the new event is dropped
+
+{{.Tab1}}With all policies except 'block', a 'lost' record with the number of
+{{.Tab1}}events dropped is periodically written to the output file, and a warning
+{{.Tab1}}is printed when the file system is unmounted.
+{{.Tab1}}Default: block
+
+{{.Sp3}}--include-<attr>=<values>
+{{.Sp3}}--exclude-<attr>=<values>
+{{.Tab1}}Emit only the trace events which attribute <attr> matches one of the
+{{.Tab1}}values of the '--include-<attr>' options, if any, and none of the values
+{{.Tab1}}of the '--exclude-<attr>' options. Both options can be specified several
+{{.Tab1}}times and for several attributes; an event is emitted only if it is
+{{.Tab1}}selected for every attribute. The supported attributes are:
+
+{{.Tab1}}ops{{.Tab1}}comma-separated list of operation types, e.g. 'open,read'
+{{.Tab1}}path{{.Tab1}}pattern the path of the file or directory must match
+{{.Tab1}}uid{{.Tab1}}comma-separated list of user ids
+{{.Tab1}}gid{{.Tab1}}comma-separated list of group ids
+{{.Tab1}}pid{{.Tab1}}comma-separated list of process ids
+{{.Tab1}}proc{{.Tab1}}pattern the path of the process executable must match
+
+{{.Tab1}}Patterns are shell globs where '**' matches any number of directories,
+{{.Tab1}}e.g. '**/.git/**'. A glob without '/' is matched against the last
+{{.Tab1}}element of the path, e.g. '*.o'. Patterns prefixed by 're:' are regular
+{{.Tab1}}expressions, e.g. 're:\.(h|c)$'.
+{{.Tab1}}Default: emit all the trace events.
+
+{{.Sp3}}--stats
+{{.Tab1}}Keep running totals of the file system operations per type of operation,
+{{.Tab1}}per path and per process: number of operations, number of errors, bytes
+{{.Tab1}}read and written and a histogram of the duration of the operations.
+{{.Tab1}}They are shown on the standard output as a table, like top(1) does, which
+{{.Tab1}}lists the paths and the processes with the most operations. With this
+{{.Tab1}}option the trace events are not written to the standard output, and
+{{.Tab1}}they are not written at all unless the option '--out' is specified.
+{{.Tab1}}The statistics are also written in JSON format when {{.AppName}} receives
+{{.Tab1}}the signal SIGUSR1 and when the file system is unmounted (see option
+{{.Tab1}}'--stats-out' below).
+
+{{.Sp3}}--stats-interval=<duration>
+{{.Tab1}}Period at which the table shown by option '--stats' is refreshed, e.g.
+{{.Tab1}}'5s'.
+{{.Tab1}}Default: 2s
+
+{{.Sp3}}--stats-out=<file>
+{{.Tab1}}Path of the file the statistics are appended to, as a JSON object in a
+{{.Tab1}}single line, on reception of the signal SIGUSR1 and when the file system
+{{.Tab1}}is unmounted. Use '-' (dash) to write them to the standard output. This
+{{.Tab1}}option makes {{.AppName}} keep the statistics even if option '--stats' is
+{{.Tab1}}not specified.
+{{.Tab1}}Default: write the statistics to the standard error if option '--stats'
+{{.Tab1}}is specified
+
+{{.Sp3}}--metrics-listen=<address>
+{{.Tab1}}Serve metrics of the file system operations in the Prometheus text
+{{.Tab1}}format at the URL path '/metrics' of the given TCP address, e.g.
+{{.Tab1}}'127.0.0.1:9180'. The metrics are the number of operations, their
+{{.Tab1}}duration and their errors per type of operation and error number, the
+{{.Tab1}}bytes read and written, the number of open files and directories and,
+{{.Tab1}}for each output, the number of trace events waiting to be written and
+{{.Tab1}}the number of events dropped.
+{{.Tab1}}Default: no metrics are served
+
+{{.Sp3}}--inject=<file>
+{{.Tab1}}Make the operations selected by the rules in <file> fail or wait, for
+{{.Tab1}}testing how applications cope with storage failures or slowness. Each
+{{.Tab1}}line of the file is a rule of the form
+{{.Tab1}}    <operations> [<condition>]... -> <action> [<condition>]...
+{{.Tab1}}where <operations> is a comma-separated list of operation types, as in
+{{.Tab1}}the trace events, or '*'. The action is one of:
+{{.Tab1}}    <error>                        fail with an error such as 'EIO',
+{{.Tab1}}                                   without performing the operation
+{{.Tab1}}    delay <duration>               wait for a duration, e.g. '10ms'
+{{.Tab1}}    delay uniform <min> <max>      wait for a random duration drawn
+{{.Tab1}}    delay normal <mean> <stddev>   from the given distribution
+{{.Tab1}}    delay pareto <min> <shape>
+{{.Tab1}}    bandwidth <rate> per <scope>   limit the bytes read and written
+{{.Tab1}}                                   per second, e.g. '10M', for each
+{{.Tab1}}                                   'file', 'process' or the 'mount'
+{{.Tab1}}    short <fraction>               make reads and writes transfer a
+{{.Tab1}}    short random                   given or random part of the bytes
+{{.Tab1}}The conditions are 'on <path pattern>', 'by pid <pid>', 'by uid <uid>',
+{{.Tab1}}'by gid <gid>', 'by proc <path pattern>', 'with probability <p>',
+{{.Tab1}}'after <n> calls' and 'at most <n> times'. For instance:
+{{.Tab1}}    write on **/*.db with probability 0.01 -> ENOSPC
+{{.Tab1}}    open by pid 1234 -> EIO after 100 calls
+{{.Tab1}}    read -> bandwidth 20M per process
+{{.Tab1}}    read,write -> short random with probability 0.1
+{{.Tab1}}The paths are matched in the style set by '--path-style'. The delays
+{{.Tab1}}of the rules which apply to an operation add up, the shortest transfer
+{{.Tab1}}and the first error win. EINTR and EAGAIN may only be injected in the
+{{.Tab1}}operations which may legally fail with them. Lines starting with '#'
+{{.Tab1}}are ignored. Send SIGHUP to {{.AppName}} to load the rules again: the
+{{.Tab1}}transfers are only shortened on the files opened in direct I/O mode,
+{{.Tab1}}which is decided at open time. The trace events of the operations which
+{{.Tab1}}failed or which transfers were shortened this way are marked
+{{.Tab1}}'injected' and the events record the injected delay.
+{{.Tab1}}Default: no faults are injected
+
+{{.Sp3}}--crash-sim=(discard | reorder | tear)
+{{.Tab1}}Simulate power cuts, for testing the crash recovery of applications.
+{{.Tab1}}The writes to a file become durable when it is flushed, which happens
+{{.Tab1}}each time a descriptor of the file is closed, or synced with fsync(2)
+{{.Tab1}}or when its size changes. On reception of the signal SIGUSR2, the
+{{.Tab1}}writes not durable yet are undone on the shadow directory, all the
+{{.Tab1}}operations fail with EIO from then on and {{.AppName}} tries to unmount
+{{.Tab1}}the file system. With 'discard', all of those writes are lost. With
+{{.Tab1}}'reorder', a random subset of them is kept, as a device which reorders
+{{.Tab1}}its writes would do. With 'tear', some of the writes kept are only
+{{.Tab1}}partially kept, by sectors of 512 bytes. Creating, renaming and
+{{.Tab1}}removing files and directories are always durable.
+{{.Tab1}}Default: power cuts are not simulated
+
 {{.Sp3}}--help
 {{.Tab1}}Show this help
 
 {{.Sp3}}--version
 {{.Tab1}}Show version information and source repository location
 
+COMMANDS:
+{{.Sp3}}top --mount=<directory>  --shadow=<directory>  [<options>]
+{{.Tab1}}Mount the file system and show the statistics of its operations. This
+{{.Tab1}}is equivalent to using the option '--stats' (see above), and accepts the
+{{.Tab1}}same options.
+
+{{.Sp3}}schema [(--csv | --json)]
+{{.Tab1}}Print a JSON Schema describing every record {{.AppName}} emits in JSON
+{{.Tab1}}format, that is the header record and the event record of each type
+{{.Tab1}}of operation. With '--csv', print instead the position, the name and
+{{.Tab1}}the type of each value of the records in CSV format, as CSV records.
+
+{{.Sp3}}decode [(--csv | --json)]  [<file>]
+{{.Tab1}}Convert a trace in binary format (see option '--format' above) read from
+{{.Tab1}}<file>, or from the standard input if not specified, into CSV (the
+{{.Tab1}}default) or JSON format and write it to the standard output.
+
+{{.Sp3}}replay --target=<directory>  [--timing=(original | fast | <factor>)]
+{{.Sp3}}       [--create-missing]  [--verbose]  [(--csv | --json)]  [<file>]
+{{.Tab1}}Re-issue the operations of a trace in CSV or JSON format read from <file>,
+{{.Tab1}}or from the standard input if not specified, against the files under
+{{.Tab1}}the target directory. The paths of the trace are taken relative to the
+{{.Tab1}}mount point or the shadow directory of the traced file system. The
+{{.Tab1}}operations of each process are replayed in order, and the processes
+{{.Tab1}}run concurrently. An operation is replayed once the operations which
+{{.Tab1}}had ended when it started in the trace are, so that only operations
+{{.Tab1}}which overlapped in the trace may overlap. The data written are not
+{{.Tab1}}those of the trace.
+{{.Tab1}}The format is inferred from the contents of the trace, unless '--csv'
+{{.Tab1}}or '--json' is specified.
+{{.Tab1}}With '--timing=original' (the default) the operations start at the same
+{{.Tab1}}intervals as in the trace, with 'fast' they start as soon as possible,
+{{.Tab1}}and with a factor the intervals are multiplied by it, e.g. 0.5 replays
+{{.Tab1}}twice as fast.
+{{.Tab1}}With '--create-missing' the files and directories the trace opens which
+{{.Tab1}}do not exist in the target directory are created, with the size they
+{{.Tab1}}had in the trace. With '--verbose' the operations which outcome differs
+{{.Tab1}}from the trace are reported on the standard error.
+
 EXAMPLES:
 {{.Sp3}}To trace file I/O operations on files under $HOME/data use:
 
@@ -333,6 +938,13 @@ EXAMPLES:
 
 {{.Tab1}}rm $HOME/data/notes.txt
 
+{{.Sp3}}To trace only the open, read and write operations made by any process
+{{.Sp3}}but the shell on files not located under a '.git' directory use:
+
+{{.Tab1}}{{.AppName}} --mount=/tmp/trace --shadow=$HOME/data \
+{{.Tab1}}{{.AppNameFiller}} --include-ops=open,read,write \
+{{.Tab1}}{{.AppNameFiller}} --exclude-path='**/.git/**' --exclude-proc='/bin/*sh'
+
 {{.Sp3}}To unmount the file system exposed by {{.AppName}} use:
 
 {{.Tab1}}umount /tmp/trace
@@ -340,6 +952,18 @@ EXAMPLES:
 {{.Sp3}}Alternatively, on MacOS X you can also use the diskutil(8) command:
 
 {{.Tab1}}/usr/sbin/diskutil unmount /tmp/trace
+
+{{.Sp3}}You can also send the signal SIGINT or SIGTERM to {{.AppName}} to make it
+{{.Sp3}}unmount the file system by itself. In all cases, {{.AppName}} writes all the
+{{.Sp3}}pending trace events and closes the output file before exiting.
+
+EXIT STATUS:
+{{.Sp3}}0{{.Tab1}}the file system was unmounted and the trace is complete
+{{.Sp3}}1{{.Tab1}}invalid command line arguments
+{{.Sp3}}2{{.Tab1}}the tracer or the file system could not be created
+{{.Sp3}}3{{.Tab1}}the file system could not be mounted or served
+{{.Sp3}}4{{.Tab1}}the file system was unmounted but some trace events could not
+{{.Sp3}} {{.Tab1}}be written
 {{end}}
 `
 
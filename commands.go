@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"os"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// commands maps the name of each subcommand of this application, given
+// as its first argument, to the function which runs it. That function
+// receives the remaining arguments and returns the exit status.
+var commands = map[string]func(args []string) int{
+	"schema": schemaCommand,
+	"decode": decodeCommand,
+	"top":    topCommand,
+	"replay": replayCommand,
+}
+
+// runCommand runs the subcommand named by the first command line argument.
+// It returns false if that argument is not a subcommand.
+func runCommand() (int, bool) {
+	if len(os.Args) < 2 {
+		return 0, false
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		return 0, false
+	}
+	return cmd(os.Args[2:]), true
+}
+
+// schemaCommand prints the JSON Schema of the trace records or, with --csv,
+// the description of the values of the records in CSV format
+func schemaCommand(args []string) int {
+	flags := flag.NewFlagSet(programName+" schema", flag.ContinueOnError)
+	asCSV := flags.Bool("csv", false, "describe the records in CSV format")
+	asJSON := flags.Bool("json", false, "describe the records in JSON format (default)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if (*asJSON && *asCSV) || flags.NArg() > 0 {
+		errlog.Printf("usage: %s schema [(--csv | --json)]", programName)
+		return 1
+	}
+	if *asCSV {
+		writer := csv.NewWriter(os.Stdout)
+		writer.WriteAll(trace.CSVSchema())
+		if err := writer.Error(); err != nil {
+			errlog.Printf("could not write schema [%s]", err)
+			return 2
+		}
+		return 0
+	}
+	schema, err := trace.JSONSchema()
+	if err != nil {
+		errlog.Printf("could not build schema [%s]", err)
+		return 2
+	}
+	os.Stdout.Write(append(schema, '\n'))
+	return 0
+}
+
+// topCommand mounts the file system and shows the statistics of its
+// operations, as the '--stats' option does
+func topCommand(args []string) int {
+	os.Args = append([]string{os.Args[0], "--stats"}, args...)
+	return mountAndServe()
+}
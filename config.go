@@ -1,7 +1,17 @@
 package main
 
+import (
+	"github.com/airnandez/cluefs/inject"
+	"github.com/airnandez/cluefs/trace"
+)
+
 type Config struct {
 	entries map[string]string
+	filter  *trace.Filter
+	outputs []Output
+	rotate  trace.RotateOptions
+	stats   StatsOptions
+	rules   []*inject.Rule
 }
 
 func NewConfig() *Config {
@@ -24,20 +34,20 @@ func (c *Config) GetShadowDir() string {
 	return c.entries["shadow"]
 }
 
-func (c *Config) SetOutputFormat(format string) {
-	c.entries["format"] = format
+func (c *Config) SetOutputs(outputs []Output) {
+	c.outputs = outputs
 }
 
-func (c *Config) GetOutputFormat() string {
-	return c.entries["format"]
+func (c *Config) GetOutputs() []Output {
+	return c.outputs
 }
 
-func (c *Config) SetTraceDestination(fileName string) {
-	c.entries["destination"] = fileName
+func (c *Config) SetPathStyle(style string) {
+	c.entries["pathstyle"] = style
 }
 
-func (c *Config) GetTraceDestination() string {
-	return c.entries["destination"]
+func (c *Config) GetPathStyle() string {
+	return c.entries["pathstyle"]
 }
 
 func (c *Config) SetReadOnly(readonly bool) {
@@ -54,3 +64,60 @@ func (c *Config) GetReadOnly() bool {
 	}
 	return false
 }
+
+func (c *Config) SetFilter(filter *trace.Filter) {
+	c.filter = filter
+}
+
+func (c *Config) GetFilter() *trace.Filter {
+	return c.filter
+}
+
+func (c *Config) SetRotateOptions(rotate trace.RotateOptions) {
+	c.rotate = rotate
+}
+
+func (c *Config) GetRotateOptions() trace.RotateOptions {
+	return c.rotate
+}
+
+func (c *Config) SetStatsOptions(stats StatsOptions) {
+	c.stats = stats
+}
+
+func (c *Config) GetStatsOptions() StatsOptions {
+	return c.stats
+}
+
+func (c *Config) SetMetricsAddress(addr string) {
+	c.entries["metrics"] = addr
+}
+
+func (c *Config) GetMetricsAddress() string {
+	return c.entries["metrics"]
+}
+
+// SetInjectRules sets the path of the file of fault injection rules and
+// the rules it holds
+func (c *Config) SetInjectRules(path string, rules []*inject.Rule) {
+	c.entries["inject"] = path
+	c.rules = rules
+}
+
+func (c *Config) GetInjectFile() string {
+	return c.entries["inject"]
+}
+
+func (c *Config) GetInjectRules() []*inject.Rule {
+	return c.rules
+}
+
+// SetCrashMode sets the name of the crash mode of the simulation of power
+// cuts, or an empty string if they are not simulated
+func (c *Config) SetCrashMode(mode string) {
+	c.entries["crash"] = mode
+}
+
+func (c *Config) GetCrashMode() string {
+	return c.entries["crash"]
+}
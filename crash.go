@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/airnandez/cluefs/fs"
+)
+
+// powerCut simulates a power cut with crash and reports what became of the
+// writes which were not durable
+func powerCut(crash *fs.CrashSimulator) {
+	report, err := crash.PowerCut()
+	if err != nil {
+		errlog.Printf("simulated power cut [%s]", err)
+		return
+	}
+	errlog.Printf("simulated power cut: %d writes to %d files were not durable, %d of them kept (%d torn)",
+		report.Writes, report.Files, report.Persisted, report.Torn)
+}
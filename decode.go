@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// decodeCommand converts a trace in binary format into CSV or JSON
+func decodeCommand(args []string) int {
+	flags := flag.NewFlagSet(programName+" decode", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write records in JSON format")
+	asCSV := flags.Bool("csv", false, "write records in CSV format (default)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if (*asJSON && *asCSV) || flags.NArg() > 1 {
+		errlog.Printf("usage: %s decode [(--csv | --json)] [<file>]", programName)
+		return 1
+	}
+	in := os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			errlog.Printf("could not open trace [%s]", err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	write := csvRecordWriter(out)
+	if *asJSON {
+		write = jsonRecordWriter(out)
+	}
+	decoder := trace.NewBinaryDecoder(in)
+	for {
+		record, err := decoder.Next()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			errlog.Printf("could not decode trace [%s]", err)
+			return 3
+		}
+		if err = write(record); err != nil {
+			errlog.Printf("could not write record [%s]", err)
+			return 4
+		}
+	}
+}
+
+// csvRecordWriter returns a function which writes a decoded record to w as
+// comma-separated values
+func csvRecordWriter(w io.Writer) func(record interface{}) error {
+	writer := csv.NewWriter(w)
+	return func(record interface{}) error {
+		var values []string
+		switch r := record.(type) {
+		case *trace.StreamInfo:
+			values = r.MarshalCSV()
+		case trace.FsOperTracer:
+			values = r.MarshalCSV()
+		}
+		writer.Write(values)
+		writer.Flush()
+		return writer.Error()
+	}
+}
+
+// jsonRecordWriter returns a function which writes a decoded record to w as
+// a JSON object in a single line
+func jsonRecordWriter(w io.Writer) func(record interface{}) error {
+	return func(record interface{}) error {
+		m, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(m, '\n'))
+		return err
+	}
+}
@@ -0,0 +1,12 @@
+// +build linux darwin
+
+package fs
+
+/*
+#include <unistd.h>
+*/
+import "C"
+
+func access(path string, mode uint32) bool {
+	return C.access(C.CString(path), C.int(mode)) == 0
+}
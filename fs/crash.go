@@ -0,0 +1,384 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// CrashMode specifies what becomes of the writes not yet synced when a power
+// cut is simulated
+type CrashMode uint32
+
+const (
+	// CrashDiscard loses all the writes not yet synced
+	CrashDiscard CrashMode = iota
+
+	// CrashReorder keeps a random subset of the writes not yet synced, as
+	// a device which reorders the writes in its cache would do
+	CrashReorder
+
+	// CrashTear is like CrashReorder, except that some of the writes kept
+	// are torn: only some of their sectors are kept
+	CrashTear
+)
+
+var crashModeNames = map[CrashMode]string{
+	CrashDiscard: "discard",
+	CrashReorder: "reorder",
+	CrashTear:    "tear",
+}
+
+func (m CrashMode) String() string {
+	if n, ok := crashModeNames[m]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// ParseCrashMode returns the crash mode which name is s, e.g. "reorder"
+func ParseCrashMode(s string) (CrashMode, error) {
+	for mode, n := range crashModeNames {
+		if n == s {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown crash mode '%s'", s)
+}
+
+// sectorSize is the unit in which the writes are torn
+const sectorSize = 512
+
+// CrashSimulator stages the writes to the files of the shadow directory
+// until they are synced, so that a power cut can be simulated by throwing
+// them away. The writes are performed on the shadow directory as usual but
+// the previous contents of the bytes they overwrite are kept, so that they
+// can be undone. The writes to a file become durable when it is flushed,
+// which happens each time a descriptor of the file is closed, or synced
+// with fsync(2), or when its size is changed. Creating, renaming or removing
+// files and directories is always durable.
+type CrashSimulator struct {
+	mode CrashMode
+
+	// mutex protects the fields below. It is never held while the files
+	// are read or written: the writes to each file are serialized by the
+	// mutex of its pendingFile.
+	mutex   sync.Mutex
+	pending map[fileID]*pendingFile
+	down    bool
+	rand    *rand.Rand
+}
+
+// fileID identifies a file independently of its names, which may change
+// or be shared by hard links
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func getFileID(info os.FileInfo) fileID {
+	st := info.Sys().(*syscall.Stat_t)
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
+
+// pendingFile holds the writes to a file not synced yet
+type pendingFile struct {
+	// mutex serializes the writes to the file, so that the bytes they
+	// overwrite are read consistently, and protects the fields below
+	mutex sync.Mutex
+
+	// path is the path of the file when it was first written to, only
+	// used for reporting
+	path string
+
+	// file is a descriptor of the file which can be read, for keeping the
+	// bytes overwritten, and written, for undoing the writes. It remains
+	// valid if the file is renamed or removed.
+	file   *os.File
+	writes []*pendingWrite
+
+	// done is set once the writes are synced or undone, after which the
+	// pendingFile must not be used any more
+	done bool
+}
+
+// pendingWrite is a write not synced yet
+type pendingWrite struct {
+	offset int64
+
+	// size is the size of the file before the write and old the previous
+	// contents of the bytes overwritten within that size
+	size int64
+	old  []byte
+
+	// data are the bytes written, only kept when the write may persist
+	data []byte
+}
+
+// CrashReport describes the effects of a simulated power cut
+type CrashReport struct {
+	// Files is the number of files which had writes not synced
+	Files int
+
+	// Writes is the number of writes not synced, of which Persisted were
+	// kept, Torn of them partially
+	Writes    int
+	Persisted int
+	Torn      int
+}
+
+func NewCrashSimulator(mode CrashMode) *CrashSimulator {
+	return &CrashSimulator{
+		mode:    mode,
+		pending: make(map[fileID]*pendingFile),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// isDown returns true once a power cut was simulated
+func (c *CrashSimulator) isDown() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.down
+}
+
+// pendingFile returns the writes not synced yet of the file with the given
+// identifier, which path is path and which is open as file
+func (c *CrashSimulator) pendingFile(id fileID, path string, file *os.File) (*pendingFile, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.down {
+		return nil, fuse.EIO
+	}
+	if p, ok := c.pending[id]; ok {
+		return p, nil
+	}
+	f, err := openPendingFile(id, path, file)
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingFile{path: path, file: f}
+	c.pending[id] = p
+	return p, nil
+}
+
+// openPendingFile opens again the file with the given identifier, which path
+// is path and which is open as file, for both reading and writing. The
+// descriptor of the handle may not allow reading the bytes about to be
+// overwritten.
+func openPendingFile(id fileID, path string, file *os.File) (*os.File, error) {
+	if f, err := os.OpenFile(path, os.O_RDWR, 0); err == nil {
+		if info, err := f.Stat(); err == nil && getFileID(info) == id {
+			return f, nil
+		}
+		f.Close()
+	}
+	// The file can not be opened for reading, or it was renamed or
+	// removed: use a copy of the descriptor of the handle
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("could not duplicate the descriptor of %s [%s]", path, err)
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// writeAt writes data at offset in file, which path is path, and stages the
+// write until the file is synced
+func (c *CrashSimulator) writeAt(path string, file *os.File, data []byte, offset int64) (int, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	id := getFileID(info)
+	for {
+		p, err := c.pendingFile(id, path, file)
+		if err != nil {
+			return 0, err
+		}
+		p.mutex.Lock()
+		if !p.done {
+			defer p.mutex.Unlock()
+			return c.stage(p, file, data, offset)
+		}
+		// The writes were synced or undone meanwhile
+		p.mutex.Unlock()
+	}
+}
+
+// stage performs the write of data at offset in file and records it in p,
+// which mutex must be held
+func (c *CrashSimulator) stage(p *pendingFile, file *os.File, data []byte, offset int64) (int, error) {
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	w := &pendingWrite{offset: offset, size: info.Size()}
+	if offset < w.size {
+		w.old = make([]byte, len(data))
+		n, err := p.file.ReadAt(w.old, offset)
+		if n < len(w.old) && err != nil && err != io.EOF {
+			return 0, err
+		}
+		w.old = w.old[:n]
+	}
+	n, err := file.WriteAt(data, offset)
+	if n > 0 {
+		if len(w.old) > n {
+			w.old = w.old[:n]
+		}
+		if c.mode != CrashDiscard {
+			w.data = append([]byte(nil), data[:n]...)
+		}
+		p.writes = append(p.writes, w)
+	}
+	return n, err
+}
+
+// synced makes the staged writes to the file durable. The file is the one
+// open as file if not nil, otherwise the one at path.
+func (c *CrashSimulator) synced(path string, file *os.File) {
+	var info os.FileInfo
+	var err error
+	if file != nil {
+		info, err = file.Stat()
+	} else {
+		info, err = os.Lstat(path)
+	}
+	if err != nil {
+		return
+	}
+	id := getFileID(info)
+	c.mutex.Lock()
+	p, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+	// Wait for the write in progress, if any
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done = true
+	p.file.Close()
+}
+
+// PowerCut simulates a power cut: the writes not synced are undone, except
+// those the crash mode keeps. Afterwards, the file system fails all the
+// operations with EIO, as a device which lost power would do.
+func (c *CrashSimulator) PowerCut() (CrashReport, error) {
+	var report CrashReport
+	c.mutex.Lock()
+	if c.down {
+		c.mutex.Unlock()
+		return report, fmt.Errorf("power was already cut")
+	}
+	c.down = true
+	pending := c.pending
+	c.pending = make(map[fileID]*pendingFile)
+	c.mutex.Unlock()
+
+	var failed []string
+	for _, p := range pending {
+		p.mutex.Lock()
+		report.Files++
+		report.Writes += len(p.writes)
+		if err := c.revert(p, &report); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", p.path, err))
+		}
+		p.done = true
+		p.file.Close()
+		p.mutex.Unlock()
+	}
+	if len(failed) > 0 {
+		return report, fmt.Errorf("could not undo the writes to %d files [%s]", len(failed), strings.Join(failed, "; "))
+	}
+	return report, nil
+}
+
+// revert undoes the writes to the file of p, from the last one to the
+// first, and performs again those the crash mode keeps. The mutex of p must
+// be held.
+func (c *CrashSimulator) revert(p *pendingFile, report *CrashReport) error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Sys().(*syscall.Stat_t).Nlink == 0 {
+		// The file was removed since
+		return nil
+	}
+	file, writes := p.file, p.writes
+	if len(writes) == 0 {
+		return nil
+	}
+	for i := len(writes) - 1; i >= 0; i-- {
+		if _, err := file.WriteAt(writes[i].old, writes[i].offset); err != nil {
+			return err
+		}
+	}
+	if err := file.Truncate(writes[0].size); err != nil {
+		return err
+	}
+	if c.mode == CrashDiscard {
+		return file.Sync()
+	}
+	for _, w := range writes {
+		if c.rand.Intn(2) == 0 {
+			continue
+		}
+		report.Persisted++
+		if c.mode == CrashTear && c.rand.Intn(2) == 0 {
+			report.Torn++
+			err = c.writeSectors(file, w)
+		} else {
+			_, err = file.WriteAt(w.data, w.offset)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// writeSectors performs the write w partially: each one of the sectors it
+// spans is written with probability 1/2
+func (c *CrashSimulator) writeSectors(file *os.File, w *pendingWrite) error {
+	for start := 0; start < len(w.data); {
+		// Sectors are aligned on the offsets in the file
+		end := start + sectorSize - int((w.offset+int64(start))%sectorSize)
+		if end > len(w.data) {
+			end = len(w.data)
+		}
+		if c.rand.Intn(2) == 1 {
+			if _, err := file.WriteAt(w.data[start:end], w.offset+int64(start)); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// writeAt writes data at offset in file, which path is path, staging the
+// write if a crash simulator is set
+func (fs *ClueFS) writeAt(path string, file *os.File, data []byte, offset int64) (int, error) {
+	if fs.opts.Crash == nil {
+		return file.WriteAt(data, offset)
+	}
+	return fs.opts.Crash.writeAt(path, file, data, offset)
+}
+
+// synced makes the staged writes to the file durable. The file is the one
+// open as file if not nil, otherwise the one at path.
+func (fs *ClueFS) synced(path string, file *os.File) {
+	if fs.opts.Crash != nil {
+		fs.opts.Crash.synced(path, file)
+	}
+}
@@ -0,0 +1,200 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// openCrashFile creates the file name in dir with the given durable
+// contents and opens it for writing
+func openCrashFile(t *testing.T, dir, name string, contents []byte) (string, *os.File) {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return path, file
+}
+
+// stageWrites writes each one of data at the offset of the same index with c
+func stageWrites(t *testing.T, c *CrashSimulator, path string, file *os.File, offsets []int64, data ...[]byte) {
+	for i, d := range data {
+		if n, err := c.writeAt(path, file, d, offsets[i]); n != len(d) || err != nil {
+			t.Fatalf("write %d: wrote %d bytes [%v]", i, n, err)
+		}
+	}
+}
+
+// checkContents checks that the file at path holds want
+func checkContents(t *testing.T, path string, want []byte) {
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: got %q, want %q", filepath.Base(path), got, want)
+	}
+}
+
+func TestPowerCutDiscard(t *testing.T) {
+	c := NewCrashSimulator(CrashDiscard)
+	path, file := openCrashFile(t, t.TempDir(), "file", []byte("hello world"))
+	defer file.Close()
+	// The writes overlap and extend the file
+	stageWrites(t, c, path, file, []int64{0, 2, 9},
+		[]byte("HELLO"), []byte("xxxx"), []byte("LD!!"))
+	checkContents(t, path, []byte("HExxxxworLD!!"))
+
+	report, err := c.PowerCut()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if report != (CrashReport{Files: 1, Writes: 3}) {
+		t.Errorf("got report %+v", report)
+	}
+	checkContents(t, path, []byte("hello world"))
+
+	// The device is down
+	if _, err := c.writeAt(path, file, []byte("x"), 0); err != fuse.EIO {
+		t.Errorf("got %v writing after the power cut, want EIO", err)
+	}
+	if _, err := c.PowerCut(); err == nil {
+		t.Errorf("cutting the power twice succeeded")
+	}
+}
+
+func TestPowerCutSynced(t *testing.T) {
+	c := NewCrashSimulator(CrashDiscard)
+	dir := t.TempDir()
+	path, file := openCrashFile(t, dir, "file", []byte("hello world"))
+	defer file.Close()
+	stageWrites(t, c, path, file, []int64{0}, []byte("HELLO"))
+	// Flushed through its descriptor
+	c.synced(path, file)
+	stageWrites(t, c, path, file, []int64{6}, []byte("WORLD"))
+
+	// Synced through its path, under a new name
+	other, otherFile := openCrashFile(t, dir, "other", []byte("abc"))
+	defer otherFile.Close()
+	stageWrites(t, c, other, otherFile, []int64{3}, []byte("def"))
+	renamed := filepath.Join(dir, "renamed")
+	if err := os.Rename(other, renamed); err != nil {
+		t.Fatalf("%s", err)
+	}
+	c.synced(renamed, nil)
+
+	report, err := c.PowerCut()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if report != (CrashReport{Files: 1, Writes: 1}) {
+		t.Errorf("got report %+v", report)
+	}
+	checkContents(t, path, []byte("HELLO world"))
+	checkContents(t, renamed, []byte("abcdef"))
+}
+
+func TestPowerCutSizeChange(t *testing.T) {
+	c := NewCrashSimulator(CrashDiscard)
+	fs, _ := newTestFS(t, Options{Crash: c})
+	path, file := openCrashFile(t, fs.shadowDir, "file", []byte("hello world"))
+	defer file.Close()
+	stageWrites(t, c, path, file, []int64{0}, []byte("HELLO"))
+
+	// Changing the size of the file makes the writes which preceded it
+	// durable, the following ones are not
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 8}
+	var resp fuse.SetattrResponse
+	if err := NewNode(fs.shadowDir, "file", fs).Setattr(context.Background(), req, &resp); err != nil {
+		t.Fatalf("setattr failed: %s", err)
+	}
+	stageWrites(t, c, path, file, []int64{6, 10}, []byte("WO"), []byte("!"))
+
+	report, err := c.PowerCut()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if report != (CrashReport{Files: 1, Writes: 2}) {
+		t.Errorf("got report %+v", report)
+	}
+	checkContents(t, path, []byte("HELLO wo"))
+}
+
+func TestPowerCutKeep(t *testing.T) {
+	// Each write spans two sectors of its own, filled with its index plus
+	// one, of a file which is initially zeroed
+	const writes = 8
+	const span = 2 * sectorSize
+	offsets := make([]int64, writes)
+	data := make([][]byte, writes)
+	for i := range data {
+		offsets[i] = int64(i * span)
+		data[i] = bytes.Repeat([]byte{byte(i + 1)}, span)
+	}
+	for _, mode := range []CrashMode{CrashReorder, CrashTear} {
+		var persisted, torn int
+		for seed := int64(1); seed <= 10; seed++ {
+			c := NewCrashSimulator(mode)
+			c.rand = rand.New(rand.NewSource(seed))
+			path, file := openCrashFile(t, t.TempDir(), "file", make([]byte, writes*span))
+			stageWrites(t, c, path, file, offsets, data...)
+			report, err := c.PowerCut()
+			file.Close()
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			if len(got) != writes*span {
+				t.Fatalf("%s: got size %d, want %d", mode, len(got), writes*span)
+			}
+			// Each sector holds either its previous contents or the
+			// bytes written, and the writes kept entirely are
+			// the ones persisted and not torn
+			var kept, partial int
+			for i := 0; i < writes; i++ {
+				var written int
+				for s := 0; s < span/sectorSize; s++ {
+					sector := got[i*span+s*sectorSize : i*span+(s+1)*sectorSize]
+					switch {
+					case bytes.Equal(sector, data[i][:sectorSize]):
+						written++
+					case !bytes.Equal(sector, make([]byte, sectorSize)):
+						t.Fatalf("%s: sector %d of write %d is corrupted", mode, s, i)
+					}
+				}
+				switch written {
+				case span / sectorSize:
+					kept++
+				case 0:
+				default:
+					partial++
+				}
+			}
+			if report.Writes != writes || partial > report.Torn || kept < report.Persisted-report.Torn || kept+partial > report.Persisted {
+				t.Errorf("%s: got report %+v, %d writes kept, %d partially", mode, report, kept, partial)
+			}
+			persisted += report.Persisted
+			torn += report.Torn
+		}
+		// Some of the writes were kept, but not all of them
+		if persisted == 0 || persisted == 10*writes {
+			t.Errorf("%s: %d writes kept out of %d", mode, persisted, 10*writes)
+		}
+		if (mode == CrashTear) != (torn > 0) {
+			t.Errorf("%s: %d writes torn", mode, torn)
+		}
+	}
+}
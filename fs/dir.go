@@ -1,4 +1,4 @@
-package main
+package fs
 
 import (
 	"fmt"
@@ -12,6 +12,8 @@ import (
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 	"golang.org/x/net/context"
+
+	"github.com/airnandez/cluefs/trace"
 )
 
 // This is a temporal fix: don't rewrite the targets of symbolic links by
@@ -39,7 +41,7 @@ func init() {
 type Dir struct {
 	*Node
 	*Handle
-	ProcessInfo
+	trace.ProcessInfo
 
 	// mutex protects the entries map
 	mutex sync.RWMutex
@@ -61,7 +63,7 @@ func (d Dir) String() string {
 }
 
 func (d *Dir) SetProcessInfo(h fuse.Header) {
-	d.ProcessInfo = ProcessInfo{Uid: h.Uid, Gid: h.Gid, Pid: h.Pid}
+	d.ProcessInfo = trace.ProcessInfo{Uid: h.Uid, Gid: h.Gid, Pid: h.Pid}
 }
 
 // saveEntry saves a *File or *Dir object associated to a
@@ -93,14 +95,18 @@ func (d *Dir) getEntry(name string) interface{} {
 	return d.entries[name]
 }
 
-func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
-	op := NewOpenOp(req, d.path)
-	defer trace(op)
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fusefs.Handle, err error) {
+	op := trace.NewOpenOp(req, d.path)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
 	newdir := NewDir(d.parent, d.name, d.fs)
-	size, err := newdir.doOpen(d.path, req.Flags)
+	size, err := newdir.doOpen(d.path, req.Flags, d.fs.newHandleID())
 	if err != nil {
 		return nil, err
 	}
+	d.fs.handleOpened()
 	newdir.SetProcessInfo(req.Header)
 	resp.Handle = fuse.HandleID(newdir.handleID)
 	op.FileSize = size
@@ -109,24 +115,41 @@ func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenRe
 	return newdir, nil
 }
 
-func (d *Dir) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+func (d *Dir) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
 	if !d.isOpen() {
 		return nil
 	}
-	defer trace(NewReleaseOp(req, d.path, d.handleID))
-	if req.ReleaseFlags&fuse.ReleaseFlush != 0 {
-		d.doSync()
+	op := trace.NewReleaseOp(req, d.path, d.handleID)
+	defer d.fs.trace(op, &err)
+	defer d.fs.handleClosed()
+	// The handle is closed even if a fault is injected, since it is not
+	// used any more
+	if err = d.doClose(); err != nil {
+		return err
+	}
+	return d.fs.inject(ctx, op)
+}
+
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	op := trace.NewFsyncOp(req, d.path)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return err
 	}
-	return d.doClose()
+	return d.doFsync(d.path, op.DataSync)
 }
 
-func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fusefs.Node, error) {
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (node fusefs.Node, err error) {
 	if skipDirEntry(req.Name) {
 		return nil, fuse.ENOENT
 	}
 	path := filepath.Join(d.path, req.Name)
 	isDir := false
-	defer trace(NewLookupOp(req, path, isDir))
+	op := trace.NewLookupOp(req, path, isDir)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
 	var st syscall.Stat_t
 	if err := syscall.Lstat(path, &st); err != nil {
 		return nil, fuse.ENOENT
@@ -160,11 +183,15 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	return ff, nil
 }
 
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+func (d *Dir) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err error) {
 	if !d.isOpen() {
 		return nil, fuse.ENOTSUP
 	}
-	defer trace(NewReadDirOp(d.path, d.ProcessInfo, d.handleID))
+	op := trace.NewReadDirOp(d.path, d.ProcessInfo, d.handleID)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
 	names, err := d.file.Readdirnames(0)
 	if err != nil {
 		return nil, fuse.EIO
@@ -190,9 +217,13 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return append(result, dots...), nil
 }
 
-func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (node fusefs.Node, err error) {
 	path := filepath.Join(d.path, req.Name)
-	defer trace(NewMkdirOp(req, path, req.Mode))
+	op := trace.NewMkdirOp(req, path, req.Mode)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
 	if err := os.Mkdir(path, req.Mode); err != nil {
 		return nil, osErrorToFuseError(err)
 	}
@@ -201,9 +232,13 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, e
 	return newdir, nil
 }
 
-func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
 	path := filepath.Join(d.path, req.Name)
-	defer trace(NewRemoveOp(req, path))
+	op := trace.NewRemoveOp(req, path)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return err
+	}
 	if err := os.Remove(path); err != nil {
 		return osErrorToFuseError(err)
 	}
@@ -211,24 +246,36 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	return nil
 }
 
-func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (node fusefs.Node, handle fusefs.Handle, err error) {
 	path := filepath.Join(d.path, req.Name)
-	op := NewCreateOp(req, path)
-	defer trace(op)
+	op := trace.NewCreateOp(req, path)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, nil, err
+	}
 	h := NewHandle()
-	if err := h.doCreate(path, req.Flags, req.Mode); err != nil {
+	if err := h.doCreate(path, req.Flags, req.Mode, d.fs.newHandleID()); err != nil {
 		return nil, nil, err
 	}
+	d.fs.handleOpened()
+	if h.directIO = d.fs.directIO(op); h.directIO {
+		resp.Flags |= fuse.OpenDirectIO
+	}
 	newfile := NewFileWithHandle(d.path, req.Name, d.fs, h)
+	d.fs.fileOpened(newfile.Node, h)
 	d.saveEntry(req.Name, newfile)
 	op.OpenID = newfile.handleID
 	return newfile, newfile, nil
 }
 
-func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fusefs.Node, error) {
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (node fusefs.Node, err error) {
 	absNewName := filepath.Join(d.path, req.NewName)
 	targetIsDir := false
-	defer trace(NewSymlinkOp(req, absNewName, req.Target, targetIsDir))
+	op := trace.NewSymlinkOp(req, absNewName, req.Target, targetIsDir)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
 
 	linkTarget, absTarget := req.Target, req.Target
 	if rewriteSymlinkTargets {
@@ -277,14 +324,18 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fusefs.Nod
 	return entry, nil
 }
 
-func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) (err error) {
 	destDir, ok := newDir.(*Dir)
 	if !ok {
 		return fuse.EIO
 	}
 	oldpath := filepath.Join(d.path, req.OldName)
 	newpath := filepath.Join(destDir.path, req.NewName)
-	defer trace(NewRenameOp(req, oldpath, newpath))
+	op := trace.NewRenameOp(req, oldpath, newpath)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return err
+	}
 	if err := os.Rename(oldpath, newpath); err != nil {
 		return osErrorToFuseError(err)
 	}
@@ -312,19 +363,67 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs
 	return nil
 }
 
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (node fusefs.Node, err error) {
+	path := filepath.Join(d.path, req.Name)
+	op := trace.NewMknodOp(req, path)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
+	if err := syscall.Mknod(path, fileModeToStatMode(req.Mode), rdevFromFuse(req.Rdev)); err != nil {
+		return nil, osErrorToFuseError(err)
+	}
+	newfile := NewFile(d.path, req.Name, d.fs)
+	d.saveEntry(req.Name, newfile)
+	return newfile, nil
+}
+
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fusefs.Node) (node fusefs.Node, err error) {
+	var oldpath string
+	isDir := false
+	switch n := old.(type) {
+	case *File:
+		oldpath = n.path
+	case *Dir:
+		oldpath, isDir = n.path, true
+	default:
+		return nil, fuse.EIO
+	}
+	newpath := filepath.Join(d.path, req.NewName)
+	op := trace.NewLinkOp(req, oldpath, newpath, isDir)
+	defer d.fs.trace(op, &err)
+	if err = d.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
+	if isDir {
+		// Hard links to directories are not allowed
+		return nil, fuse.EPERM
+	}
+	if err := os.Link(oldpath, newpath); err != nil {
+		return nil, osErrorToFuseError(err)
+	}
+	newfile := NewFile(d.path, req.NewName, d.fs)
+	d.saveEntry(req.NewName, newfile)
+	return newfile, nil
+}
+
 // osErrorToFuseError converts an os.PathError, os.LinkError or
 // syscall.Errno into an error
 func osErrorToFuseError(err error) error {
 	if err == nil {
 		return nil
 	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
 	errno := syscall.EIO
-	if patherr, ok := err.(*os.PathError); ok {
-		errno = patherr.Err.(syscall.Errno)
-	} else if linkerr, ok := err.(*os.LinkError); ok {
-		errno = linkerr.Err.(syscall.Errno)
-	} else if _, ok := err.(*syscall.Errno); ok {
-		errno = err.(syscall.Errno)
+	if e, ok := err.(syscall.Errno); ok {
+		errno = e
 	}
 	return fuse.Errno(errno)
 }
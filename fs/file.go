@@ -0,0 +1,140 @@
+package fs
+
+import (
+	"io"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+type File struct {
+	*Node
+	*Handle
+}
+
+func NewFile(parent string, name string, fs *ClueFS) *File {
+	return &File{
+		Node:   NewNode(parent, name, fs),
+		Handle: &Handle{},
+	}
+}
+
+func NewFileWithHandle(parent string, name string, fs *ClueFS, handle *Handle) *File {
+	return &File{
+		Node:   NewNode(parent, name, fs),
+		Handle: handle,
+	}
+}
+
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fusefs.Handle, err error) {
+	op := trace.NewOpenOp(req, f.path)
+	defer f.fs.trace(op, &err)
+	if err = f.fs.inject(ctx, op); err != nil {
+		return nil, err
+	}
+	newfile := NewFile(f.parent, f.name, f.fs)
+	size, err := newfile.doOpen(f.path, req.Flags, f.fs.newHandleID())
+	if err != nil {
+		return nil, err
+	}
+	f.fs.handleOpened()
+	f.fs.fileOpened(f.Node, newfile.Handle)
+	resp.Handle = fuse.HandleID(newfile.handleID)
+	if newfile.directIO = f.fs.directIO(op); newfile.directIO {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	op.FileSize = size
+	op.BlockSize = newfile.blksize
+	op.OpenID = newfile.handleID
+	return newfile, nil
+}
+
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	if !f.isOpen() {
+		return fuse.ENOTSUP
+	}
+	op := trace.NewReleaseOp(req, f.path, f.handleID)
+	defer f.fs.trace(op, &err)
+	defer f.fs.handleClosed()
+	// The handle is closed even if a fault is injected, since it is not
+	// used any more
+	f.fs.fileClosed(f.Handle)
+	if err = f.doClose(); err != nil {
+		return err
+	}
+	return f.fs.inject(ctx, op)
+}
+
+func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	if !f.isOpen() {
+		return fuse.ENOTSUP
+	}
+	op := trace.NewFlushOp(req, f.path, f.handleID)
+	defer f.fs.trace(op, &err)
+	if err = f.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	size, err := f.getFileSize()
+	if err != nil {
+		return err
+	}
+	op.FileSize = size
+	op.Flags = fuse.OpenFlags(f.flags)
+	f.fs.synced(f.path, f.file)
+	return nil
+}
+
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	op := trace.NewFsyncOp(req, f.path)
+	defer f.fs.trace(op, &err)
+	if err = f.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	if err = f.doFsync(f.path, op.DataSync); err != nil {
+		return err
+	}
+	f.fs.synced(f.path, f.file)
+	return nil
+}
+
+func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	if !f.isOpen() {
+		return fuse.ENOTSUP
+	}
+	op := trace.NewReadOp(req, f.path, f.handleID)
+	defer f.fs.trace(op, &err)
+	count, err := f.fs.injectTransfer(ctx, op, req.Size, f.directIO)
+	if err != nil {
+		return err
+	}
+	size, err := f.getFileSize()
+	if err != nil {
+		return err
+	}
+	op.FileSize = size
+	n, err := f.file.ReadAt(resp.Data[0:count], req.Offset)
+	resp.Data = resp.Data[0:n]
+	op.BytesRead = n
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	return osErrorToFuseError(err)
+}
+
+func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	if !f.isOpen() {
+		return fuse.ENOTSUP
+	}
+	op := trace.NewWriteOp(req, f.path, f.handleID)
+	defer f.fs.trace(op, &err)
+	count, err := f.fs.injectTransfer(ctx, op, len(req.Data), f.directIO)
+	if err != nil {
+		return err
+	}
+	resp.Size, err = f.fs.writeAt(f.path, f.file, req.Data[0:count], req.Offset)
+	op.BytesWritten = resp.Size
+	return osErrorToFuseError(err)
+}
@@ -0,0 +1,345 @@
+// Package fs implements a FUSE file system which exposes the contents of a
+// shadow directory and emits a trace event for every operation it serves.
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/airnandez/cluefs/inject"
+	"github.com/airnandez/cluefs/trace"
+)
+
+// Options holds the settings of a ClueFS file system
+type Options struct {
+	// ShadowDir is the absolute path of the directory which contents
+	// are exposed through the mount point
+	ShadowDir string
+
+	// MountDir is the absolute path of the directory where the file
+	// system is mounted
+	MountDir string
+
+	// ReadOnly makes the file system be mounted in read-only mode
+	ReadOnly bool
+
+	// PathStyle is how paths are reported in trace events.
+	// Default: PathShadow
+	PathStyle PathStyle
+
+	// FSName is the name the mounted file system is known by.
+	// Default: "cluefs"
+	FSName string
+
+	// Debug, if not nil, receives the FUSE protocol debug messages
+	Debug func(msg interface{})
+
+	// Injector, if not nil, makes some of the operations fail instead of
+	// performing them on the shadow directory
+	Injector *inject.Injector
+
+	// Crash, if not nil, stages the writes until they are synced, so that
+	// a power cut can be simulated
+	Crash *CrashSimulator
+}
+
+type ClueFS struct {
+	shadowDir string
+	mountDir  string
+	opts      Options
+	tracer    trace.Tracer
+	root      *Dir
+
+	// lastHandleID is the last identifier given to an open file or directory
+	// and openHandles is the number of files and directories currently open
+	lastHandleID uint64
+	openHandles  int64
+
+	// files holds the handles of the files open through each node, so that
+	// the requests made on an open file can be applied to one of them
+	filesMutex sync.Mutex
+	files      map[*Node][]*Handle
+
+	conn *fuse.Conn
+	done chan struct{}
+	err  error
+}
+
+// NewClueFS creates a file system which exposes the contents of
+// opts.ShadowDir and sends its trace events to tracer
+func NewClueFS(opts Options, tracer trace.Tracer) (*ClueFS, error) {
+	if !filepath.IsAbs(opts.ShadowDir) {
+		return nil, fmt.Errorf("'%s' is not an absolute path", opts.ShadowDir)
+	}
+	if len(opts.MountDir) == 0 {
+		return nil, fmt.Errorf("no mount point specified")
+	}
+	if tracer == nil {
+		return nil, fmt.Errorf("no tracer specified")
+	}
+	dir, err := os.Open(opts.ShadowDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	if len(opts.FSName) == 0 {
+		opts.FSName = "cluefs"
+	}
+	return &ClueFS{
+		shadowDir: opts.ShadowDir,
+		mountDir:  opts.MountDir,
+		opts:      opts,
+		tracer:    tracer,
+		files:     make(map[*Node][]*Handle),
+	}, nil
+}
+
+// trace emits a file I/O event. It is intended to be deferred by each
+// handler with a pointer to the handler's named error result, so that the
+// outcome of the operation is recorded in the event.
+func (fs *ClueFS) trace(op trace.FsOperTracer, err *error) {
+	op.SetTimeEnd()
+	op.SetResult(*err)
+	if fs.opts.PathStyle != PathShadow {
+		op.RewritePaths(fs.rewritePath)
+	}
+	fs.tracer.Trace(op)
+}
+
+// inject makes op wait for the delay the injector, if any, selects for it
+// and returns the fault it selects, in which case op must not be performed,
+// or nil. It is intended to be called by each handler right after deferring
+// the emission of op.
+func (fs *ClueFS) inject(ctx context.Context, op trace.FsOperTracer) error {
+	_, err := fs.injectTransfer(ctx, op, 0, false)
+	return err
+}
+
+// injectTransfer is like inject for the read and write operations, which
+// request size bytes. It also returns the number of bytes op must
+// transfer, which the injector may make smaller than size if the file was
+// opened in direct I/O mode, as told by directIO.
+func (fs *ClueFS) injectTransfer(ctx context.Context, op trace.FsOperTracer, size int, directIO bool) (int, error) {
+	if fs.opts.Crash != nil && fs.opts.Crash.isDown() {
+		// The simulated device lost power
+		op.GetHeader().Injected = true
+		return 0, fuse.EIO
+	}
+	if fs.opts.Injector == nil {
+		return size, nil
+	}
+	// The transfers on a file opened before the rules shortening them
+	// were loaded are not shortened: the kernel would take a short read
+	// from its page cache for the end of the file
+	effect := fs.opts.Injector.Evaluate(fs.injectHeader(op), size, directIO)
+	if effect.Delay > 0 {
+		start := time.Now()
+		timer := time.NewTimer(effect.Delay)
+		select {
+		case <-timer.C:
+			op.GetHeader().Delay = effect.Delay
+		case <-ctx.Done():
+			// The request was interrupted while waiting
+			timer.Stop()
+			op.GetHeader().Delay = time.Since(start)
+			op.GetHeader().Injected = true
+			return 0, fuse.EINTR
+		}
+	}
+	if effect.Errno != 0 {
+		op.GetHeader().Injected = true
+		return 0, fuse.Errno(effect.Errno)
+	}
+	if effect.Size < size {
+		op.GetHeader().Injected = true
+	}
+	return effect.Size, nil
+}
+
+// injectHeader returns the header of op as seen by the rules of the
+// injector, which match the paths in the style of the trace events
+func (fs *ClueFS) injectHeader(op trace.FsOperTracer) *trace.Header {
+	h := op.GetHeader()
+	if fs.opts.PathStyle != PathShadow {
+		rewritten := *h
+		rewritten.Path = fs.rewritePath(h.Path)
+		h = &rewritten
+	}
+	return h
+}
+
+// directIO returns true if the file opened by op must bypass the page cache
+// of the kernel, so that the short transfers the injector may select reach
+// the applications. It is decided once, when the file is opened.
+func (fs *ClueFS) directIO(op trace.FsOperTracer) bool {
+	return fs.opts.Injector != nil && fs.opts.Injector.ShortensTransfers(fs.injectHeader(op))
+}
+
+// newHandleID returns a new identifier for an open file or directory
+func (fs *ClueFS) newHandleID() uint64 {
+	return atomic.AddUint64(&fs.lastHandleID, 1)
+}
+
+// handleOpened and handleClosed account for the files and directories
+// opened and closed through the file system
+func (fs *ClueFS) handleOpened() {
+	atomic.AddInt64(&fs.openHandles, 1)
+}
+
+func (fs *ClueFS) handleClosed() {
+	atomic.AddInt64(&fs.openHandles, -1)
+}
+
+// fileOpened and fileClosed keep track of the handles of the files open
+// through node n
+func (fs *ClueFS) fileOpened(n *Node, h *Handle) {
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+	h.node = n
+	fs.files[n] = append(fs.files[n], h)
+}
+
+func (fs *ClueFS) fileClosed(h *Handle) {
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+	handles := fs.files[h.node]
+	for i := range handles {
+		if handles[i] == h {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+	if len(handles) == 0 {
+		delete(fs.files, h.node)
+	} else {
+		fs.files[h.node] = handles
+	}
+}
+
+// writableFile returns a new descriptor of one of the files open for
+// writing through node n, or nil if there is none. The descriptor remains
+// usable if the handle is released meanwhile.
+func (fs *ClueFS) writableFile(n *Node) (*os.File, error) {
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+	for _, h := range fs.files[n] {
+		if h.flags&fuse.OpenAccessModeMask == fuse.OpenReadOnly {
+			continue
+		}
+		fd, err := syscall.Dup(int(h.file.Fd()))
+		if err != nil {
+			return nil, osErrorToFuseError(err)
+		}
+		return os.NewFile(uintptr(fd), h.file.Name()), nil
+	}
+	return nil, nil
+}
+
+// OpenHandles returns the number of files and directories currently open
+// through the file system
+func (fs *ClueFS) OpenHandles() int64 {
+	return atomic.LoadInt64(&fs.openHandles)
+}
+
+// Mount mounts the file system and starts serving requests in the
+// background. It returns once the mount is complete. The file system is
+// unmounted when ctx is done or when Unmount is called.
+func (fs *ClueFS) Mount(ctx context.Context) error {
+	if fs.opts.Debug != nil {
+		fuse.Debug = fs.opts.Debug
+	}
+	mountOpts := []fuse.MountOption{
+		fuse.FSName(fs.opts.FSName),
+		fuse.Subtype(fs.opts.FSName),
+		fuse.VolumeName(fs.opts.FSName),
+		fuse.LocalVolume(),
+	}
+	if fs.opts.ReadOnly {
+		mountOpts = append(mountOpts, fuse.ReadOnly())
+	}
+	conn, err := fuse.Mount(fs.mountDir, mountOpts...)
+	if err != nil {
+		return err
+	}
+	fs.conn, fs.done = conn, make(chan struct{})
+
+	// Start serving requests
+	go func() {
+		defer close(fs.done)
+		defer conn.Close()
+		fs.err = fusefs.Serve(conn, fs)
+	}()
+
+	// Check for errors when mounting the file system
+	<-conn.Ready
+	if err = conn.MountError; err != nil {
+		return err
+	}
+
+	// Unmount when the caller's context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			fs.Unmount()
+		case <-fs.done:
+		}
+	}()
+	return nil
+}
+
+// Unmount unmounts the file system and waits until all the requests
+// being served are complete
+func (fs *ClueFS) Unmount() error {
+	if fs.done == nil {
+		return fmt.Errorf("file system is not mounted")
+	}
+	if err := fuse.Unmount(fs.mountDir); err != nil {
+		return err
+	}
+	<-fs.done
+	return nil
+}
+
+// Done returns a channel which is closed when the file system stops
+// serving requests, for instance because it was unmounted
+func (fs *ClueFS) Done() <-chan struct{} {
+	return fs.done
+}
+
+// Err returns the error, if any, which made the file system stop
+// serving requests. It must only be called after Done is closed.
+func (fs *ClueFS) Err() error {
+	return fs.err
+}
+
+func (fs *ClueFS) Root() (fusefs.Node, error) {
+	if fs.root == nil {
+		fs.root = NewDir("", fs.shadowDir, fs)
+	}
+	return fs.root, nil
+}
+
+func (fs *ClueFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	op := trace.NewStatFsOp(req, fs.mountDir)
+	defer fs.trace(op, &err)
+	if err = fs.inject(ctx, op); err != nil {
+		return err
+	}
+	return statfsToFuse(fs.shadowDir, resp)
+}
+
+func (fs *ClueFS) Destroy() {
+	if fs.root != nil {
+		fs.root.doClose()
+		fs.root = nil
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package fs
 
 import (
 	"fmt"
@@ -8,33 +8,18 @@ import (
 	"bazil.org/fuse"
 )
 
-var (
-	handleIDGeneratorChan <-chan uint64
-)
-
-func handleIDGenerator() <-chan uint64 {
-	outChan := make(chan uint64)
-	go func() {
-		for nextId := uint64(1); ; nextId++ {
-			outChan <- nextId
-		}
-	}()
-	return outChan
-}
-
-func newHandleID() uint64 {
-	return <-handleIDGeneratorChan
-}
-
-func init() {
-	handleIDGeneratorChan = handleIDGenerator()
-}
-
 type Handle struct {
 	file     *os.File
 	handleID uint64
 	flags    fuse.OpenFlags
 	blksize  uint32
+
+	// node is the node the file was opened through
+	node *Node
+
+	// directIO is true if the file was opened in direct I/O mode, which
+	// its transfers must be for the injector to shorten them
+	directIO bool
 }
 
 func NewHandle() *Handle {
@@ -49,7 +34,7 @@ func (h *Handle) isOpen() bool {
 	return h.file != nil
 }
 
-func (h *Handle) doOpen(path string, flags fuse.OpenFlags) (uint64, error) {
+func (h *Handle) doOpen(path string, flags fuse.OpenFlags, id uint64) (uint64, error) {
 	if h.isOpen() {
 		return 0, nil
 	}
@@ -63,11 +48,11 @@ func (h *Handle) doOpen(path string, flags fuse.OpenFlags) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	h.file, h.flags, h.handleID, h.blksize = file, flags, newHandleID(), blksize
+	h.file, h.flags, h.handleID, h.blksize = file, flags, id, blksize
 	return h.getFileSize()
 }
 
-func (h *Handle) doCreate(path string, flags fuse.OpenFlags, mode os.FileMode) error {
+func (h *Handle) doCreate(path string, flags fuse.OpenFlags, mode os.FileMode, id uint64) error {
 	if h.isOpen() {
 		return nil
 	}
@@ -79,7 +64,7 @@ func (h *Handle) doCreate(path string, flags fuse.OpenFlags, mode os.FileMode) e
 	if err != nil {
 		return err
 	}
-	h.file, h.flags, h.handleID, h.blksize = file, flags, newHandleID(), blksize
+	h.file, h.flags, h.handleID, h.blksize = file, flags, id, blksize
 	return nil
 }
 
@@ -101,14 +86,28 @@ func (h *Handle) doClose() error {
 	return nil
 }
 
-func (h *Handle) doSync() (uint64, error) {
+// doFsync flushes the contents of the file at path to stable storage, using
+// the open file if there is one. If datasync is true, only the data and the
+// metadata needed to retrieve it are flushed, as done by fdatasync(2).
+func (h *Handle) doFsync(path string, datasync bool) error {
+	file := h.file
 	if !h.isOpen() {
-		return 0, nil
+		// Any file descriptor will do: fsync(2) applies to the file, not
+		// to the descriptor
+		f, err := os.Open(path)
+		if os.IsPermission(err) {
+			f, err = os.OpenFile(path, os.O_WRONLY, 0)
+		}
+		if err != nil {
+			return osErrorToFuseError(err)
+		}
+		defer f.Close()
+		file = f
 	}
-	if err := h.file.Sync(); err != nil {
-		return 0, osErrorToFuseError(err)
+	if datasync {
+		return osErrorToFuseError(fdatasync(int(file.Fd())))
 	}
-	return h.getFileSize()
+	return osErrorToFuseError(file.Sync())
 }
 
 func getBlkSize(f *os.File) (uint32, error) {
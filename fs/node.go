@@ -0,0 +1,322 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/syscallx"
+	"golang.org/x/net/context"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+type Node struct {
+	parent string
+	name   string
+	path   string
+	fs     *ClueFS
+}
+
+func NewNode(parent string, name string, fs *ClueFS) *Node {
+	path := filepath.Join(parent, name)
+	if len(parent) == 0 {
+		path = name
+	}
+	return &Node{parent: parent, name: name, path: path, fs: fs}
+}
+
+func (n *Node) setParentAndName(parent string, name string) {
+	path := filepath.Join(parent, name)
+	if len(parent) == 0 {
+		path = name
+	}
+	n.parent, n.name, n.path = parent, name, path
+}
+
+func (n Node) String() string {
+	return fmt.Sprintf("%s %s", n.parent, n.name)
+}
+
+func (n *Node) Attr(ctx context.Context, attr *fuse.Attr) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(n.path, &st); err != nil {
+		return osErrorToFuseError(err)
+	}
+	*attr = statToFuseAttr(st)
+	return nil
+}
+
+func (n *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	return n.Attr(ctx, &resp.Attr)
+}
+
+func (n *Node) Access(ctx context.Context, req *fuse.AccessRequest) (err error) {
+	isDir, err := isDirectory(n.path)
+	op := trace.NewAccessOp(req, n.path, isDir)
+	defer n.fs.trace(op, &err)
+	if err != nil {
+		return err
+	}
+	if err = n.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	if access(n.path, req.Mask) {
+		return nil
+	}
+	return fuse.Errno(syscall.EACCES)
+}
+
+func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	op := trace.NewSetattrOp(req, n.path)
+	defer n.fs.trace(op, &err)
+	if err = n.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	if syscall.Lstat(n.path, &st) == nil {
+		op.SetPrevious(statToFuseAttr(st))
+	}
+	for _, step := range setattrSteps {
+		fields := req.Valid & step.fields
+		if fields == 0 {
+			continue
+		}
+		apply := step.apply
+		if fields&fuse.SetattrSize != 0 && req.Valid.Handle() {
+			apply = n.setOpenSize
+		}
+		if e := apply(n.path, req); e != nil {
+			op.Failed |= fields
+			if step.optional {
+				continue
+			}
+			// The following steps are not attempted, so that the request
+			// is not partially applied beyond the first failure
+			return osErrorToFuseError(e)
+		}
+		op.Applied |= fields
+		if fields&fuse.SetattrSize != 0 {
+			// Undoing the writes which preceded the change of size would
+			// not restore the previous contents of the file
+			n.fs.synced(n.path, nil)
+		}
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
+
+// setattrStep applies the attributes fields of a setattr request. The
+// failure of an optional step is recorded but does not fail the request.
+type setattrStep struct {
+	fields   fuse.SetattrValid
+	apply    func(path string, req *fuse.SetattrRequest) error
+	optional bool
+}
+
+// setattrSteps is the sequence of steps for applying a setattr request. The
+// ownership is changed before the mode, since chown(2) may clear the
+// set-user-ID and set-group-ID bits, and the times are set last, since the
+// other changes may modify them. A failing step stops the sequence. As
+// a symbolic link is never followed, the steps which could only change the
+// file it points to fail on it. The creation and change times, which can
+// not be set but which MacOS X sends along with the other times, e.g. when
+// copying files, come last and are optional.
+var setattrSteps = []setattrStep{
+	{fuse.SetattrUid | fuse.SetattrGid, setOwner, false},
+	{fuse.SetattrSize, setSize, false},
+	{fuse.SetattrMode, setMode, false},
+	{fuse.SetattrFlags, setFlags, false},
+	{fuse.SetattrAtime | fuse.SetattrMtime | fuse.SetattrAtimeNow | fuse.SetattrMtimeNow | fuse.SetattrBkuptime, setTimes, false},
+	{fuse.SetattrCrtime, setCrtime, true},
+	{fuse.SetattrChgtime, setChgtime, true},
+}
+
+func setOwner(path string, req *fuse.SetattrRequest) error {
+	uid, gid := -1, -1
+	if req.Valid.Uid() {
+		uid = int(req.Uid)
+	}
+	if req.Valid.Gid() {
+		gid = int(req.Gid)
+	}
+	return syscall.Lchown(path, uid, gid)
+}
+
+func setSize(path string, req *fuse.SetattrRequest) error {
+	return syscall.Truncate(path, int64(req.Size))
+}
+
+// setOpenSize changes the size of a file open for writing through n, as
+// ftruncate(2) does: the file may not be reachable by its path any more or
+// its permissions may not allow opening it for writing
+func (n *Node) setOpenSize(path string, req *fuse.SetattrRequest) error {
+	file, err := n.fs.writableFile(n)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return setSize(path, req)
+	}
+	defer file.Close()
+	return syscall.Ftruncate(int(file.Fd()), int64(req.Size))
+}
+
+func setMode(path string, req *fuse.SetattrRequest) error {
+	if err := refuseSymlink(path); err != nil {
+		return err
+	}
+	return syscall.Chmod(path, fileModeToStatMode(req.Mode)&07777)
+}
+
+// refuseSymlink fails if path is a symbolic link, which the system calls
+// changing its attributes without a variant acting on the link itself
+// would follow
+func refuseSymlink(path string) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return syscall.ENOTSUP
+	}
+	return nil
+}
+
+// setCrtime fails, since the FUSE bindings do not decode the creation time
+// of setattr requests
+func setCrtime(path string, req *fuse.SetattrRequest) error {
+	return syscall.ENOTSUP
+}
+
+// setChgtime fails, since the change time of a file can not be set
+func setChgtime(path string, req *fuse.SetattrRequest) error {
+	return syscall.ENOTSUP
+}
+
+func (n *Node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (dest string, err error) {
+	op := trace.NewReadlinkOp(req, n.path)
+	defer n.fs.trace(op, &err)
+	if err = n.fs.inject(ctx, op); err != nil {
+		return "", err
+	}
+	dest, err = os.Readlink(n.path)
+	if err != nil {
+		return "", osErrorToFuseError(err)
+	}
+	return dest, nil
+}
+
+func (n *Node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	op := trace.NewGetxattrOp(req, n.path)
+	defer n.fs.trace(op, &err)
+	if err = n.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	size, err := syscallx.Getxattr(n.path, req.Name, []byte{})
+	if err != nil || size <= 0 {
+		return fuse.ErrNoXattr
+	}
+	buffer := make([]byte, size)
+	size, err = syscallx.Getxattr(n.path, req.Name, buffer)
+	if err != nil {
+		return osErrorToFuseError(err)
+	}
+	resp.Xattr = buffer
+	return nil
+}
+
+func (n *Node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	op := trace.NewListxattrOp(req, n.path)
+	defer n.fs.trace(op, &err)
+	if err = n.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	size, err := syscallx.Listxattr(n.path, []byte{})
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buffer := make([]byte, size)
+	size, err = syscallx.Listxattr(n.path, buffer)
+	if err != nil {
+		return osErrorToFuseError(err)
+	}
+	resp.Xattr = buffer
+	return nil
+}
+
+func (n *Node) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	op := trace.NewSetxattrOp(req, n.path)
+	defer n.fs.trace(op, &err)
+	if err = n.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	err = syscallx.Setxattr(n.path, req.Name, req.Xattr, int(req.Flags))
+	return osErrorToFuseError(err)
+}
+
+func (n *Node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	op := trace.NewRemovexattrOp(req, n.path)
+	defer n.fs.trace(op, &err)
+	if err = n.fs.inject(ctx, op); err != nil {
+		return err
+	}
+	// TODO: this needs to be improved, since the behavior of Removexattr depends
+	// on the previous existance of the attribute. The return code of the operation
+	// is governed by the flags. See bazil.org/fuse/syscallx.Removexattr comments.
+	_, err = syscallx.Getxattr(n.path, req.Name, []byte{})
+	if err == nil {
+		// TODO: There is already an attribute with that name. Should return
+		// the expected error code according to the request's flags
+		err = syscallx.Removexattr(n.path, req.Name)
+		return osErrorToFuseError(err)
+	}
+	return nil
+}
+
+func isDirectory(fullpath string) (bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(fullpath, &st); err != nil {
+		return false, osErrorToFuseError(err)
+	}
+	return st.Mode&syscall.S_IFMT == syscall.S_IFDIR, nil
+}
+
+func getFuseDirent(fullpath string, name string) fuse.Dirent {
+	var st syscall.Stat_t
+	syscall.Lstat(fullpath, &st)
+	return fuse.Dirent{
+		Inode: st.Ino,
+		Type:  fuseTypeFromStatMode(st.Mode),
+		Name:  name,
+	}
+}
+
+// fileModeToStatMode converts a file mode into the file type and
+// permission bits expected by mknod(2)
+func fileModeToStatMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	default:
+		m |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
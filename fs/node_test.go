@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// testTracer keeps the events it receives
+type testTracer struct {
+	ops []trace.FsOperTracer
+}
+
+func (t *testTracer) Trace(op trace.FsOperTracer) {
+	t.ops = append(t.ops, op)
+}
+
+func (t *testTracer) Close() error {
+	return nil
+}
+
+// newTestFS returns a file system exposing a new temporary directory
+func newTestFS(t *testing.T, opts Options) (*ClueFS, *testTracer) {
+	opts.ShadowDir = t.TempDir()
+	opts.MountDir = "/tmp/trace"
+	tracer := &testTracer{}
+	fs, err := NewClueFS(opts, tracer)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return fs, tracer
+}
+
+func TestSetattrOptionalSteps(t *testing.T) {
+	fs, tracer := newTestFS(t, Options{})
+	path := filepath.Join(fs.shadowDir, "file")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	mtime := time.Date(2015, 3, 26, 13, 41, 15, 0, time.UTC)
+	req := &fuse.SetattrRequest{
+		Valid:  fuse.SetattrMtime | fuse.SetattrCrtime,
+		Mtime:  mtime,
+		Crtime: mtime,
+	}
+	var resp fuse.SetattrResponse
+	if err := NewNode(fs.shadowDir, "file", fs).Setattr(context.Background(), req, &resp); err != nil {
+		t.Fatalf("setattr failed: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("got mtime %s, want %s", info.ModTime(), mtime)
+	}
+	op := tracer.ops[0].(*trace.SetattrOp)
+	if op.Applied != fuse.SetattrMtime || op.Failed != fuse.SetattrCrtime || op.Errno != 0 {
+		t.Errorf("got applied %v, failed %v, result %v", op.Applied, op.Failed, op.Errno)
+	}
+}
+
+func TestSetattrStopsAtFailure(t *testing.T) {
+	fs, tracer := newTestFS(t, Options{})
+	path := filepath.Join(fs.shadowDir, "link")
+	if err := os.Symlink("target", path); err != nil {
+		t.Fatalf("%s", err)
+	}
+	before, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req := &fuse.SetattrRequest{
+		Valid: fuse.SetattrMode | fuse.SetattrMtime,
+		Mode:  0600,
+		Mtime: time.Date(2015, 3, 26, 13, 41, 15, 0, time.UTC),
+	}
+	var resp fuse.SetattrResponse
+	if err := NewNode(fs.shadowDir, "link", fs).Setattr(context.Background(), req, &resp); err == nil {
+		t.Fatalf("changing the mode of a symbolic link succeeded")
+	}
+	after, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("the times were set after the mode failed")
+	}
+	op := tracer.ops[0].(*trace.SetattrOp)
+	if op.Applied != 0 || op.Failed != fuse.SetattrMode {
+		t.Errorf("got applied %v, failed %v", op.Applied, op.Failed)
+	}
+}
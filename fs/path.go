@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PathStyle specifies how the paths of files and directories are
+// reported in the trace events
+type PathStyle uint32
+
+const (
+	// PathShadow reports absolute paths under the shadow directory
+	PathShadow PathStyle = iota
+
+	// PathMount reports absolute paths under the mount point, as seen by
+	// the applications
+	PathMount
+
+	// PathRelative reports paths relative to the mount point
+	PathRelative
+)
+
+var pathStyleNames = map[PathStyle]string{
+	PathShadow:   "shadow",
+	PathMount:    "mount",
+	PathRelative: "relative",
+}
+
+func (s PathStyle) String() string {
+	if n, ok := pathStyleNames[s]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// ParsePathStyle returns the path style which name is s, e.g. "mount"
+func ParsePathStyle(s string) (PathStyle, error) {
+	for style, n := range pathStyleNames {
+		if n == s {
+			return style, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown path style '%s'", s)
+}
+
+// rewritePath converts a path under either the shadow directory or the
+// mount point into the path style of this file system. Other paths, such
+// as relative symbolic link targets, are returned unmodified.
+func (fs *ClueFS) rewritePath(path string) string {
+	rel, ok := relativeTo(path, fs.shadowDir)
+	if !ok {
+		if rel, ok = relativeTo(path, fs.mountDir); !ok {
+			return path
+		}
+	}
+	switch fs.opts.PathStyle {
+	case PathMount:
+		return filepath.Join(fs.mountDir, rel)
+	case PathRelative:
+		return rel
+	}
+	return filepath.Join(fs.shadowDir, rel)
+}
+
+// relativeTo returns the path of path relative to dir, if path is dir
+// itself or is located under dir
+func relativeTo(path, dir string) (string, bool) {
+	if path == dir {
+		return ".", true
+	}
+	if prefix := strings.TrimSuffix(dir, "/") + "/"; strings.HasPrefix(path, prefix) {
+		return path[len(prefix):], true
+	}
+	return "", false
+}
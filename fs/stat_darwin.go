@@ -0,0 +1,186 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"bazil.org/fuse"
+)
+
+func statToFuseAttr(st syscall.Stat_t) fuse.Attr {
+	var mode os.FileMode
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK, syscall.S_IFWHT:
+		mode = os.ModeDevice
+	case syscall.S_IFCHR:
+		mode = os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode = os.ModeDir
+	case syscall.S_IFIFO:
+		mode = os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode = os.ModeSymlink
+	case syscall.S_IFREG:
+		// nothing to do
+	case syscall.S_IFSOCK:
+		mode = os.ModeSocket
+	}
+	if st.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if st.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if st.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	perm := os.FileMode(st.Mode) & os.ModePerm
+	return fuse.Attr{
+		Inode:  uint64(st.Ino),
+		Size:   uint64(st.Size),
+		Blocks: uint64(st.Blocks),
+		Atime:  timespecToTime(st.Atimespec),
+		Mtime:  timespecToTime(st.Mtimespec),
+		Ctime:  timespecToTime(st.Ctimespec),
+		Crtime: timespecToTime(st.Birthtimespec),
+		Mode:   perm | mode,
+		Nlink:  uint32(st.Nlink),
+		Uid:    st.Uid,
+		Gid:    st.Gid,
+		Rdev:   rdevToFuse(st.Rdev),
+		// TODO: set Flags
+		// Flags:
+		BlockSize: uint32(st.Blksize),
+	}
+}
+
+// rdevToFuse converts a device number as found in Stat_t into the encoding
+// used by the FUSE protocol. On MacOS X both are the 32 bits dev_t.
+func rdevToFuse(rdev int32) uint32 {
+	return uint32(rdev)
+}
+
+// rdevFromFuse converts a device number in the encoding used by the FUSE
+// protocol into the one expected by mknod(2)
+func rdevFromFuse(rdev uint32) int {
+	return int(int32(rdev))
+}
+
+// fdatasync flushes the data of the file open as fd to stable storage.
+// MacOS X does not expose fdatasync(2), so a full fsync(2) is done instead.
+func fdatasync(fd int) error {
+	return syscall.Fsync(fd)
+}
+
+// Source: os.Syscall
+func timespecToTime(ts syscall.Timespec) time.Time {
+	return time.Unix(int64(ts.Sec), int64(ts.Nsec))
+}
+
+func fuseTypeFromStatMode(stmode uint16) fuse.DirentType {
+	t := fuse.DT_Unknown
+	switch stmode & syscall.S_IFMT {
+	case syscall.S_IFBLK, syscall.S_IFWHT:
+		t = fuse.DT_Block
+	case syscall.S_IFCHR:
+		t = fuse.DT_Char
+	case syscall.S_IFDIR:
+		t = fuse.DT_Dir
+	case syscall.S_IFIFO:
+		t = fuse.DT_FIFO
+	case syscall.S_IFLNK:
+		t = fuse.DT_Link
+	case syscall.S_IFREG:
+		t = fuse.DT_File
+	case syscall.S_IFSOCK:
+		t = fuse.DT_Socket
+	}
+	return t
+}
+
+// attrList mirrors struct attrlist, as used by setattrlist(2)
+type attrList struct {
+	bitmapCount uint16
+	reserved    uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+// Constants from <sys/attr.h>
+const (
+	attrBitMapCount = 5
+	attrCmnModtime  = 0x00000400
+	attrCmnAcctime  = 0x00001000
+	attrCmnBkuptime = 0x00002000
+	fsoptNoFollow   = 0x00000001
+)
+
+// setTimes sets the modification, access and backup times of path as
+// requested, with nanosecond precision and without following symbolic links
+func setTimes(path string, req *fuse.SetattrRequest) error {
+	list := attrList{bitmapCount: attrBitMapCount}
+	// The times must be given in the order of their attribute bits
+	times := make([]syscall.Timespec, 0, 3)
+	if req.Valid.Mtime() || req.Valid.MtimeNow() {
+		mtime := req.Mtime
+		if req.Valid.MtimeNow() {
+			mtime = time.Now()
+		}
+		list.commonAttr |= attrCmnModtime
+		times = append(times, syscall.NsecToTimespec(mtime.UnixNano()))
+	}
+	if req.Valid.Atime() || req.Valid.AtimeNow() {
+		atime := req.Atime
+		if req.Valid.AtimeNow() {
+			atime = time.Now()
+		}
+		list.commonAttr |= attrCmnAcctime
+		times = append(times, syscall.NsecToTimespec(atime.UnixNano()))
+	}
+	if req.Valid.Bkuptime() {
+		list.commonAttr |= attrCmnBkuptime
+		times = append(times, syscall.NsecToTimespec(req.Bkuptime.UnixNano()))
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&list)),
+		uintptr(unsafe.Pointer(&times[0])), uintptr(len(times))*unsafe.Sizeof(times[0]), fsoptNoFollow, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setFlags sets the file flags of path, as chflags(2) does
+func setFlags(path string, req *fuse.SetattrRequest) error {
+	if err := refuseSymlink(path); err != nil {
+		return err
+	}
+	return syscall.Chflags(path, int(req.Flags))
+}
+
+func statfsToFuse(path string, resp *fuse.StatfsResponse) error {
+	var buf syscall.Statfs_t
+	if err := syscall.Statfs(path, &buf); err != nil {
+		return fuse.ENOTSUP
+	}
+	resp.Blocks = uint64(buf.Blocks) // Total data blocks in file system.
+	resp.Bfree = uint64(buf.Bfree)   // Free blocks in file system.
+	resp.Bavail = uint64(buf.Bavail) // Free blocks in file system if you're not root.
+	resp.Files = uint64(buf.Files)   // Total files in file system.
+	resp.Ffree = uint64(buf.Ffree)   // Free files in file system.
+	resp.Bsize = uint32(buf.Bsize)   // Block size
+	// resp.Namelen = ????  // Does not exist on Mac OS X
+	// resp.Frsize = // Does not exist on Mac OS X
+	return nil
+}
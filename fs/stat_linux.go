@@ -1,9 +1,10 @@
-package main
+package fs
 
 import (
 	"os"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"bazil.org/fuse"
 )
@@ -48,11 +49,34 @@ func statToFuseAttr(st syscall.Stat_t) fuse.Attr {
 		Nlink:     uint32(st.Nlink),
 		Uid:       st.Uid,
 		Gid:       st.Gid,
-		Rdev:      uint32(st.Rdev), //TODO: how to correctly convert from Stat_t (64bits) to RDev (32bits)
+		Rdev:      rdevToFuse(uint64(st.Rdev)),
 		BlockSize: uint32(st.Blksize),
 	}
 }
 
+// rdevToFuse converts a device number as found in Stat_t (the 64 bits
+// encoding of the C library) into the 32 bits encoding used by the FUSE
+// protocol, that is the kernel's 'new_encode_dev'. This encoding can hold
+// major numbers up to 4095 and minor numbers up to 1048575.
+func rdevToFuse(rdev uint64) uint32 {
+	major := uint32((rdev>>8)&0xfff) | uint32((rdev>>32)&^0xfff)
+	minor := uint32(rdev&0xff) | uint32((rdev>>12)&^0xff)
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
+
+// rdevFromFuse converts a device number in the encoding used by the FUSE
+// protocol into the one expected by mknod(2)
+func rdevFromFuse(rdev uint32) int {
+	major := uint64((rdev & 0xfff00) >> 8)
+	minor := uint64((rdev & 0xff) | ((rdev >> 12) & 0xfff00))
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// fdatasync flushes the data of the file open as fd to stable storage
+func fdatasync(fd int) error {
+	return syscall.Fdatasync(fd)
+}
+
 // Source: os.Syscall
 func timespecToTime(ts syscall.Timespec) time.Time {
 	return time.Unix(int64(ts.Sec), int64(ts.Nsec))
@@ -79,13 +103,44 @@ func fuseTypeFromStatMode(mode uint32) fuse.DirentType {
 	return t
 }
 
-func statAtimeMtime(fullpath string) (time.Time, time.Time, error) {
-	var st syscall.Stat_t
-	if err := syscall.Lstat(fullpath, &st); err != nil {
-		var nulltime time.Time
-		return nulltime, nulltime, err
+// Constants for utimensat(2), from <fcntl.h> and <sys/stat.h>
+const (
+	atFdCwd           = -0x64
+	atSymlinkNoFollow = 0x100
+	utimeNow          = (1 << 30) - 1
+	utimeOmit         = (1 << 30) - 2
+)
+
+// setTimes sets the access and modification times of path as requested,
+// with nanosecond precision and without following symbolic links
+func setTimes(path string, req *fuse.SetattrRequest) error {
+	ts := [2]syscall.Timespec{{Nsec: utimeOmit}, {Nsec: utimeOmit}}
+	if req.Valid.AtimeNow() {
+		ts[0].Nsec = utimeNow
+	} else if req.Valid.Atime() {
+		ts[0] = syscall.NsecToTimespec(req.Atime.UnixNano())
+	}
+	if req.Valid.MtimeNow() {
+		ts[1].Nsec = utimeNow
+	} else if req.Valid.Mtime() {
+		ts[1] = syscall.NsecToTimespec(req.Mtime.UnixNano())
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	dirfd := atFdCwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return errno
 	}
-	return timespecToTime(st.Atim), timespecToTime(st.Mtim), nil
+	return nil
+}
+
+// setFlags fails, since Linux has no file flags as set by chflags(2)
+func setFlags(path string, req *fuse.SetattrRequest) error {
+	return syscall.ENOTSUP
 }
 
 func statfsToFuse(path string, resp *fuse.StatfsResponse) error {
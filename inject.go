@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/airnandez/cluefs/inject"
+)
+
+// startInjectReload loads again the fault injection rules from the file at
+// path on reception of SIGHUP. If the file is not valid, the current rules
+// are kept. The returned function stops doing so.
+func startInjectReload(injector *inject.Injector, path string) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-hup:
+				rules, err := inject.LoadRules(path)
+				if err != nil {
+					errlog.Printf("keeping current fault injection rules [%s]", err)
+					continue
+				}
+				injector.SetRules(rules)
+				errlog.Printf("loaded %d fault injection rules from '%s'", len(rules), path)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,189 @@
+package inject
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// distribution draws a random delay
+type distribution func(r *rand.Rand) time.Duration
+
+// parseDistribution parses the distribution of the delay following 'delay'
+// and returns the number of tokens it is made of
+func parseDistribution(tokens []string) (distribution, int, error) {
+	if len(tokens) == 0 {
+		return nil, 0, fmt.Errorf("missing duration after 'delay'")
+	}
+	switch tokens[0] {
+	case "uniform":
+		if len(tokens) < 3 {
+			return nil, 0, fmt.Errorf("expecting 'delay uniform <min> <max>'")
+		}
+		min, max, err := parseDurations(tokens[1], tokens[2])
+		if err != nil {
+			return nil, 0, err
+		}
+		if max < min {
+			return nil, 0, fmt.Errorf("maximum delay '%s' is less than minimum '%s'", tokens[2], tokens[1])
+		}
+		return func(r *rand.Rand) time.Duration {
+			return min + time.Duration(r.Int63n(int64(max-min)+1))
+		}, 3, nil
+	case "normal":
+		if len(tokens) < 3 {
+			return nil, 0, fmt.Errorf("expecting 'delay normal <mean> <stddev>'")
+		}
+		mean, stddev, err := parseDurations(tokens[1], tokens[2])
+		if err != nil {
+			return nil, 0, err
+		}
+		return func(r *rand.Rand) time.Duration {
+			// Durations cannot be negative
+			d := float64(mean) + r.NormFloat64()*float64(stddev)
+			return time.Duration(math.Max(d, 0))
+		}, 3, nil
+	case "pareto":
+		if len(tokens) < 3 {
+			return nil, 0, fmt.Errorf("expecting 'delay pareto <min> <shape>'")
+		}
+		min, err := parseDuration(tokens[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		shape, err := strconv.ParseFloat(tokens[2], 64)
+		if err != nil || shape <= 0 {
+			return nil, 0, fmt.Errorf("invalid shape '%s'", tokens[2])
+		}
+		return func(r *rand.Rand) time.Duration {
+			// Inverse transform sampling, with 1-U in (0,1]
+			d := float64(min) / math.Pow(1-r.Float64(), 1/shape)
+			return time.Duration(math.Min(d, math.MaxInt64))
+		}, 3, nil
+	}
+	d, err := parseDuration(tokens[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	return func(r *rand.Rand) time.Duration { return d }, 1, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return d, nil
+}
+
+func parseDurations(s1, s2 string) (time.Duration, time.Duration, error) {
+	d1, err := parseDuration(s1)
+	if err != nil {
+		return 0, 0, err
+	}
+	d2, err := parseDuration(s2)
+	return d1, d2, err
+}
+
+// throttleMaxBuckets is the maximum number of buckets of a throttle. When
+// reached, the buckets are forgotten, which is harmless for the files or
+// processes not transferring data at that moment.
+const throttleMaxBuckets = 10000
+
+// throttleScopes are the scopes which can follow 'per' in a bandwidth rule,
+// and the functions returning the key of the bucket of an operation
+var throttleScopes = map[string]func(h *trace.Header) string{
+	"file":    func(h *trace.Header) string { return h.Path },
+	"process": func(h *trace.Header) string { return strconv.FormatUint(uint64(h.Pid), 10) },
+	"mount":   func(h *trace.Header) string { return "" },
+}
+
+// rateUnits are the suffixes accepted in a bandwidth rule
+var rateUnits = map[string]float64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+}
+
+// throttle limits the bandwidth of the operations using a token bucket per
+// file, process or mount. The capacity of each bucket is the number of bytes
+// transferred in one second.
+type throttle struct {
+	rate float64
+	key  func(h *trace.Header) string
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// parseThrottle parses the bandwidth limit following 'bandwidth' and
+// returns the number of tokens it is made of
+func parseThrottle(tokens []string) (*throttle, int, error) {
+	if len(tokens) < 3 || tokens[1] != "per" {
+		return nil, 0, fmt.Errorf("expecting 'bandwidth <rate> per (file | process | mount)'")
+	}
+	rate, err := parseRate(tokens[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := throttleScopes[tokens[2]]
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected '%s' after 'per'", tokens[2])
+	}
+	return &throttle{rate: rate, key: key, buckets: make(map[string]*bucket)}, 3, nil
+}
+
+// parseRate parses a number of bytes per second, optionally followed by one
+// of the suffixes 'K', 'M' or 'G', e.g. '10M' or '10MB/s'
+func parseRate(s string) (float64, error) {
+	u := strings.TrimSuffix(strings.ToUpper(s), "/S")
+	num := strings.TrimRight(u, "KMGB")
+	mult, ok := rateUnits[strings.TrimSuffix(u[len(num):], "B")]
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth '%s'", s)
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid bandwidth '%s'", s)
+	}
+	return n * mult, nil
+}
+
+// wait takes size bytes from the bucket of the operation described by h at
+// time now, and returns how long the operation must wait for the bucket to
+// hold them. The bytes of the operations still waiting are taken into
+// account, so that concurrent operations share the bandwidth.
+func (t *throttle) wait(h *trace.Header, size int, now time.Time) time.Duration {
+	key := t.key(h)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	b, ok := t.buckets[key]
+	if !ok {
+		if len(t.buckets) >= throttleMaxBuckets {
+			t.buckets = make(map[string]*bucket)
+		}
+		b = &bucket{tokens: t.rate, last: now}
+		t.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(t.rate, b.tokens+elapsed.Seconds()*t.rate)
+		b.last = now
+	}
+	b.tokens -= float64(size)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / t.rate * float64(time.Second))
+}
@@ -0,0 +1,441 @@
+// Package inject implements the injection of faults and delays in the
+// operations served by a cluefs file system, according to a set of rules.
+// It is intended for testing how applications cope with failures or
+// slowness of the storage.
+package inject
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// Rule makes the operations it selects fail or wait. A rule is written in
+// a single line of the form
+//
+//	<operations> [<condition>]... -> <action> [<condition>]...
+//
+// where <operations> is a comma-separated list of operation types, as
+// written in the trace events, or '*' for all of them. The action is one of:
+//
+//	<error>                  fail with the error which symbolic name is
+//	                         given, e.g. 'ENOSPC'
+//	delay <duration>         wait for the given duration, e.g. '10ms'
+//	delay uniform <min> <max>
+//	                         wait for a duration uniformly distributed
+//	                         between min and max
+//	delay normal <mean> <stddev>
+//	                         wait for a normally distributed duration
+//	delay pareto <min> <shape>
+//	                         wait for a long-tailed duration, following
+//	                         a Pareto distribution of scale min and the
+//	                         given shape, e.g. 1.5
+//	bandwidth <rate> per (file | process | mount)
+//	                         limit the bytes requested by the read and
+//	                         write operations to rate bytes per second,
+//	                         e.g. '10M', for each file, each process or
+//	                         the whole file system
+//	short <fraction>         make the read and write operations transfer
+//	                         only the given fraction of the bytes they
+//	                         request, e.g. 0.5
+//	short random             make the read and write operations transfer
+//	                         a random number of the bytes they request,
+//	                         at least one
+//
+// The errors EINTR and EAGAIN may only be injected in the operations which
+// can legally fail with them, as the bandwidth limits and the short
+// transfers only apply to reads and writes: these operations are selected
+// when <operations> is '*'.
+//
+// The conditions are:
+//
+//	on <pattern>           the path of the file or directory matches the
+//	                       pattern, as in the '--include-path' option
+//	by pid <pid>           the requesting process has the given id
+//	by uid <uid>           the requesting user has the given id
+//	by gid <gid>           the requesting group has the given id
+//	by proc <pattern>      the executable of the requesting process matches
+//	                       the pattern
+//	with probability <p>   the action is taken with probability p
+//	after <n> calls        the first n selected operations are not affected
+//	at most <n> times      the action is taken at most n times
+//
+// A condition on the same attribute may be given several times, in which
+// case one of them must hold. For example:
+//
+//	write on **/*.db with probability 0.01 -> ENOSPC
+//	open by pid 1234 -> EIO after 100 calls
+//	stat,open -> delay pareto 100us 1.5
+//	read on /data/** -> bandwidth 20M per process
+//	read,write -> short random with probability 0.1
+type Rule struct {
+	text        string
+	filter      *trace.Filter
+	probability float64
+	after       uint64
+	limit       uint64
+
+	// The action of the rule is one of errno, delay, throttle or short
+	errno    syscall.Errno
+	delay    distribution
+	throttle *throttle
+	short    truncation
+
+	// calls counts the operations selected by the rule and injected the
+	// actions taken. They are accessed atomically.
+	calls    uint64
+	injected uint64
+}
+
+// byFields are the attributes which can follow 'by' in a rule
+var byFields = map[string]trace.FilterField{
+	"pid":  trace.FilterPid,
+	"uid":  trace.FilterUid,
+	"gid":  trace.FilterGid,
+	"proc": trace.FilterProc,
+}
+
+// ParseRule parses a rule written in a single line
+func ParseRule(line string) (*Rule, error) {
+	sides := strings.Split(line, "->")
+	if len(sides) != 2 {
+		return nil, fmt.Errorf("missing '->' in rule '%s'", line)
+	}
+	left, right := strings.Fields(sides[0]), strings.Fields(sides[1])
+	if len(left) == 0 {
+		return nil, fmt.Errorf("no operation in rule '%s'", line)
+	}
+	if len(right) == 0 {
+		return nil, fmt.Errorf("no action in rule '%s'", line)
+	}
+	r := &Rule{
+		text:        strings.Join(append(append(left, "->"), right...), " "),
+		filter:      trace.NewFilter(),
+		probability: 1,
+	}
+	n, err := r.parseAction(right)
+	if err != nil {
+		return nil, fmt.Errorf("%s in rule '%s'", err, line)
+	}
+	if err := r.includeOps(left[0], right[0]); err != nil {
+		return nil, fmt.Errorf("%s in rule '%s'", err, line)
+	}
+	for _, conds := range [][]string{left[1:], right[n:]} {
+		if err := r.parseConditions(conds); err != nil {
+			return nil, fmt.Errorf("%s in rule '%s'", err, line)
+		}
+	}
+	return r, nil
+}
+
+// parseAction parses the action at the beginning of tokens and returns the
+// number of tokens it is made of
+func (r *Rule) parseAction(tokens []string) (int, error) {
+	switch tokens[0] {
+	case "delay":
+		d, n, err := parseDistribution(tokens[1:])
+		r.delay = d
+		return n + 1, err
+	case "bandwidth":
+		t, n, err := parseThrottle(tokens[1:])
+		r.throttle = t
+		return n + 1, err
+	case "short":
+		t, n, err := parseTruncation(tokens[1:])
+		r.short = t
+		return n + 1, err
+	}
+	errno, ok := trace.ParseErrno(tokens[0])
+	if !ok {
+		return 0, fmt.Errorf("unknown error '%s'", tokens[0])
+	}
+	r.errno = errno
+	return 1, nil
+}
+
+func (r *Rule) parseConditions(tokens []string) error {
+	for len(tokens) > 0 {
+		var n int
+		var err error
+		switch tokens[0] {
+		case "on":
+			n, err = r.parseOn(tokens)
+		case "by":
+			n, err = r.parseBy(tokens)
+		case "with":
+			n, err = r.parseProbability(tokens)
+		case "after":
+			n, err = r.parseAfter(tokens)
+		case "at":
+			n, err = r.parseAtMost(tokens)
+		default:
+			return fmt.Errorf("unexpected '%s'", tokens[0])
+		}
+		if err != nil {
+			return err
+		}
+		tokens = tokens[n:]
+	}
+	return nil
+}
+
+func (r *Rule) parseOn(tokens []string) (int, error) {
+	if len(tokens) < 2 {
+		return 0, fmt.Errorf("missing pattern after 'on'")
+	}
+	return 2, r.filter.Include(trace.FilterPath, tokens[1])
+}
+
+func (r *Rule) parseBy(tokens []string) (int, error) {
+	if len(tokens) < 3 {
+		return 0, fmt.Errorf("incomplete condition 'by'")
+	}
+	field, ok := byFields[tokens[1]]
+	if !ok {
+		return 0, fmt.Errorf("unexpected '%s' after 'by'", tokens[1])
+	}
+	return 3, r.filter.Include(field, tokens[2])
+}
+
+func (r *Rule) parseProbability(tokens []string) (int, error) {
+	if len(tokens) < 3 || tokens[1] != "probability" {
+		return 0, fmt.Errorf("expecting 'with probability <p>'")
+	}
+	p, err := strconv.ParseFloat(tokens[2], 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("invalid probability '%s'", tokens[2])
+	}
+	r.probability = p
+	return 3, nil
+}
+
+func (r *Rule) parseAfter(tokens []string) (int, error) {
+	if len(tokens) < 3 || (tokens[2] != "calls" && tokens[2] != "call") {
+		return 0, fmt.Errorf("expecting 'after <n> calls'")
+	}
+	n, err := strconv.ParseUint(tokens[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number of calls '%s'", tokens[1])
+	}
+	r.after = n
+	return 3, nil
+}
+
+func (r *Rule) parseAtMost(tokens []string) (int, error) {
+	if len(tokens) < 4 || tokens[1] != "most" || (tokens[3] != "times" && tokens[3] != "time") {
+		return 0, fmt.Errorf("expecting 'at most <n> times'")
+	}
+	n, err := strconv.ParseUint(tokens[2], 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid number of times '%s'", tokens[2])
+	}
+	r.limit = n
+	return 4, nil
+}
+
+// take accounts for an action taken by the rule. It returns false if the
+// rule already took its action as many times as allowed.
+func (r *Rule) take() bool {
+	for {
+		n := atomic.LoadUint64(&r.injected)
+		if r.limit > 0 && n >= r.limit {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&r.injected, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (r *Rule) String() string {
+	return r.text
+}
+
+// Injected returns the number of times the rule took its action so far
+func (r *Rule) Injected() uint64 {
+	return atomic.LoadUint64(&r.injected)
+}
+
+// ParseRules parses the rules read from rd, one per line. Empty lines and
+// lines starting with '#' are ignored.
+func ParseRules(rd io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadRules parses the rules in the file at path
+func LoadRules(path string) ([]*Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open rules file [%s]", err)
+	}
+	defer f.Close()
+	rules, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file '%s' [%s]", path, err)
+	}
+	return rules, nil
+}
+
+// Injector decides which operations fail or wait according to a set of
+// rules, which may be replaced at any time
+type Injector struct {
+	mutex sync.RWMutex
+	rules []*Rule
+
+	// randMutex protects rand
+	randMutex sync.Mutex
+	rand      *rand.Rand
+}
+
+func NewInjector(rules []*Rule) *Injector {
+	return &Injector{
+		rules: rules,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetRules replaces the rules of the injector. The new rules count the
+// operations they select from zero.
+func (in *Injector) SetRules(rules []*Rule) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	in.rules = rules
+}
+
+// Rules returns the rules of the injector
+func (in *Injector) Rules() []*Rule {
+	in.mutex.RLock()
+	defer in.mutex.RUnlock()
+	return in.rules
+}
+
+// Effect is what an operation undergoes because of the rules
+type Effect struct {
+	// Errno is the error number the operation must fail with, or 0 if it
+	// must be performed
+	Errno syscall.Errno
+
+	// Delay is how long the operation must wait before failing or being
+	// performed
+	Delay time.Duration
+
+	// Size is the number of bytes the read or write operation must
+	// transfer, at most the number of bytes it requests
+	Size int
+}
+
+// Evaluate returns the effect of the rules on the operation described by
+// h, which requests size bytes if it is a read or a write. Transfers may
+// only be shortened if shorten is true. The rules are evaluated in order:
+// the delays of the rules which apply add up, the shortest transfer wins
+// and the first rule which makes the operation fail ends the evaluation.
+func (in *Injector) Evaluate(h *trace.Header, size int, shorten bool) Effect {
+	in.mutex.RLock()
+	defer in.mutex.RUnlock()
+	e := Effect{Size: size}
+	for _, r := range in.rules {
+		if !r.filter.Accept(h) || ((r.throttle != nil || r.short != nil) && size <= 0) {
+			// Bandwidth limits and short transfers only apply to the bytes
+			// read or written
+			continue
+		}
+		if r.short != nil && !shorten {
+			// The rule is not counted as matching the operation
+			continue
+		}
+		if atomic.AddUint64(&r.calls, 1) <= r.after {
+			continue
+		}
+		if r.probability < 1 && in.random() >= r.probability {
+			continue
+		}
+		if !r.take() {
+			continue
+		}
+		switch {
+		case r.delay != nil:
+			e.Delay += in.sample(r.delay)
+		case r.throttle != nil:
+			e.Delay += r.throttle.wait(h, size, time.Now())
+		case r.short != nil:
+			if n := in.truncate(r.short, size); n < e.Size {
+				e.Size = n
+			}
+		default:
+			e.Errno = r.errno
+			return e
+		}
+	}
+	return e
+}
+
+// random returns a pseudo-random number in [0.0,1.0)
+func (in *Injector) random() float64 {
+	in.randMutex.Lock()
+	defer in.randMutex.Unlock()
+	return in.rand.Float64()
+}
+
+// truncate returns the number of bytes transferred out of size according
+// to t
+func (in *Injector) truncate(t truncation, size int) int {
+	in.randMutex.Lock()
+	defer in.randMutex.Unlock()
+	return t(in.rand, size)
+}
+
+// ShortensTransfers returns true if some rule may shorten the reads or the
+// writes of the file opened by the operation described by h. Such a file
+// must be opened in direct I/O mode, since the kernel takes a short read
+// from its page cache for the end of the file. The rules set afterwards do
+// not change the mode of the files already open.
+func (in *Injector) ShortensTransfers(h *trace.Header) bool {
+	in.mutex.RLock()
+	defer in.mutex.RUnlock()
+	transfer := *h
+	for _, r := range in.rules {
+		if r.short == nil {
+			continue
+		}
+		for _, t := range []trace.FSOperType{trace.FsRead, trace.FsWrite} {
+			transfer.OperType = t
+			if r.filter.Accept(&transfer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sample returns a duration drawn from the distribution d
+func (in *Injector) sample(d distribution) time.Duration {
+	in.randMutex.Lock()
+	defer in.randMutex.Unlock()
+	return d(in.rand)
+}
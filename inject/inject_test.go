@@ -0,0 +1,343 @@
+package inject
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+func header(t trace.FSOperType, path string, pid uint32) *trace.Header {
+	return &trace.Header{
+		ProcessInfo: trace.ProcessInfo{Uid: 9986, Gid: 1021, Pid: pid},
+		OperType:    t,
+		Path:        path,
+	}
+}
+
+// newTestInjector returns an injector of the given rules which draws the
+// same pseudo-random numbers at each run
+func newTestInjector(t *testing.T, rules ...string) *Injector {
+	var parsed []*Rule
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		parsed = append(parsed, r)
+	}
+	in := NewInjector(parsed)
+	in.rand = rand.New(rand.NewSource(1))
+	return in
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line        string
+		text        string
+		errno       syscall.Errno
+		probability float64
+		after       uint64
+		limit       uint64
+	}{
+		{"write -> ENOSPC", "write -> ENOSPC", syscall.ENOSPC, 1, 0, 0},
+		{"  write   ->   ENOSPC  ", "write -> ENOSPC", syscall.ENOSPC, 1, 0, 0},
+		{"write on **/*.db with probability 0.01 -> ENOSPC", "write on **/*.db with probability 0.01 -> ENOSPC", syscall.ENOSPC, 0.01, 0, 0},
+		{"open by pid 1234 -> EIO after 100 calls", "open by pid 1234 -> EIO after 100 calls", syscall.EIO, 1, 100, 0},
+		{"open -> EIO after 1 call at most 1 time", "open -> EIO after 1 call at most 1 time", syscall.EIO, 1, 1, 1},
+		{"* -> EACCES with probability 0 at most 3 times", "* -> EACCES with probability 0 at most 3 times", syscall.EACCES, 0, 0, 3},
+		{"read,write by uid 0 by uid 1 -> EIO", "read,write by uid 0 by uid 1 -> EIO", syscall.EIO, 1, 0, 0},
+		{"* -> EINTR", "* -> EINTR", syscall.EINTR, 1, 0, 0},
+	}
+	for _, test := range tests {
+		r, err := ParseRule(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if r.String() != test.text {
+			t.Errorf("%s: text is '%s', want '%s'", test.line, r, test.text)
+		}
+		if r.errno != test.errno || r.probability != test.probability || r.after != test.after || r.limit != test.limit {
+			t.Errorf("%s: got errno %d, probability %g, after %d, limit %d", test.line, r.errno, r.probability, r.after, r.limit)
+		}
+	}
+}
+
+func TestParseRuleActions(t *testing.T) {
+	tests := []struct {
+		line  string
+		check func(r *Rule) bool
+	}{
+		{"stat -> delay 10ms", func(r *Rule) bool { return r.delay != nil && r.delay(nil) == 10*time.Millisecond }},
+		{"stat -> delay uniform 1ms 3ms", func(r *Rule) bool { return r.delay != nil }},
+		{"open -> delay normal 5ms 1ms", func(r *Rule) bool { return r.delay != nil }},
+		{"access -> delay pareto 1ms 1.5", func(r *Rule) bool { return r.delay != nil }},
+		{"read -> bandwidth 1M per process", func(r *Rule) bool { return r.throttle != nil }},
+		{"read,write -> short 0.5", func(r *Rule) bool { return r.short != nil && r.short(nil, 10) == 5 }},
+		{"* -> short random with probability 0.1", func(r *Rule) bool { return r.short != nil && r.probability == 0.1 }},
+	}
+	for _, test := range tests {
+		r, err := ParseRule(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if !test.check(r) {
+			t.Errorf("%s: unexpected action", test.line)
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"write ENOSPC",
+		"write -> EIO -> EIO",
+		" -> EIO",
+		"write -> ",
+		"write -> ENOPE",
+		"wrte -> EIO",
+		"write on -> EIO",
+		"write on [a -> EIO",
+		"write by -> EIO",
+		"write by foo 1 -> EIO",
+		"write by pid x -> EIO",
+		"write -> EIO with probability 2",
+		"write -> EIO with chance 0.5",
+		"write -> EIO after x calls",
+		"write -> EIO after 3",
+		"write -> EIO at most 0 times",
+		"write -> EIO at least 2 times",
+		"write -> EIO sometimes",
+		"stat -> EINTR",
+		"stat -> EAGAIN",
+		"stat -> short 0.5",
+		"read -> short 1",
+		"read -> delay",
+		"read -> delay uniform 3ms 1ms",
+	} {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("%s: no error", line)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# Comments and empty lines are ignored
+
+write -> ENOSPC
+	# Even indented
+open -> EIO after 2 calls
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(rules))
+	}
+	_, err = ParseRules(strings.NewReader("write -> EIO\n\nwrite -> EFOO\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("got error %v, want an error at line 3", err)
+	}
+}
+
+// documentedRules returns the example rules of the documentation of Rule
+// and of the README
+func documentedRules(t *testing.T) []string {
+	var rules []string
+	src, err := ioutil.ReadFile("inject.go")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	examples := false
+	for _, line := range strings.Split(string(src), "\n") {
+		if strings.HasPrefix(line, "type Rule ") {
+			break
+		}
+		if strings.HasSuffix(line, "For example:") {
+			examples = true
+		} else if examples && strings.HasPrefix(line, "//\t") {
+			rules = append(rules, strings.TrimPrefix(line, "//\t"))
+		}
+	}
+	readme, err := ioutil.ReadFile("../README.md")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	// The rules are in the code blocks with no language, along with the
+	// example traces
+	blocks := strings.Split(string(readme), "```")
+	for i := 1; i < len(blocks); i += 2 {
+		if !strings.HasPrefix(blocks[i], "\n") {
+			continue
+		}
+		for _, line := range strings.Split(blocks[i], "\n") {
+			if strings.Contains(line, " -> ") && !strings.HasPrefix(line, "#") {
+				rules = append(rules, line)
+			}
+		}
+	}
+	return rules
+}
+
+func TestDocumentedRules(t *testing.T) {
+	rules := documentedRules(t)
+	if len(rules) < 10 {
+		t.Fatalf("found %d documented rules, expecting more", len(rules))
+	}
+	for _, line := range rules {
+		if _, err := ParseRule(line); err != nil {
+			t.Errorf("documented rule '%s': %s", line, err)
+		}
+	}
+}
+
+func TestEvaluateSelection(t *testing.T) {
+	in := newTestInjector(t,
+		"read,write on /data/** by pid 1 by pid 2 -> EIO",
+		"open on *.db -> EACCES",
+	)
+	tests := []struct {
+		h     *trace.Header
+		errno syscall.Errno
+	}{
+		{header(trace.FsRead, "/data/file", 1), syscall.EIO},
+		{header(trace.FsWrite, "/data/dir/file", 2), syscall.EIO},
+		{header(trace.FsWrite, "/data/file", 3), 0},
+		{header(trace.FsRead, "/other/file", 1), 0},
+		{header(trace.FsOpen, "/data/file", 1), 0},
+		{header(trace.FsOpen, "/any/base.db", 3), syscall.EACCES},
+	}
+	for _, test := range tests {
+		if e := in.Evaluate(test.h, 0, true); e.Errno != test.errno {
+			t.Errorf("%s %s by %d: got errno %d, want %d", test.h.OperType, test.h.Path, test.h.Pid, e.Errno, test.errno)
+		}
+	}
+}
+
+func TestEvaluateCounts(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string // the outcome of successive calls: 'x' if injected
+	}{
+		{"open -> EIO", "xxxxxx"},
+		{"open -> EIO after 3 calls", "...xxx"},
+		{"open -> EIO at most 2 times", "xx...."},
+		{"open -> EIO after 1 call at most 2 times", ".xx..."},
+		{"open -> EIO with probability 0", "......"},
+		{"open -> EIO with probability 1", "xxxxxx"},
+	}
+	for _, test := range tests {
+		in := newTestInjector(t, test.rule)
+		var got []byte
+		for range test.want {
+			// Operations not selected by the rule are not counted
+			in.Evaluate(header(trace.FsRead, "/f", 1), 0, true)
+			if in.Evaluate(header(trace.FsOpen, "/f", 1), 0, true).Errno == syscall.EIO {
+				got = append(got, 'x')
+			} else {
+				got = append(got, '.')
+			}
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.rule, got, test.want)
+		}
+		if n, want := in.Rules()[0].Injected(), uint64(strings.Count(test.want, "x")); n != want {
+			t.Errorf("%s: %d injected, want %d", test.rule, n, want)
+		}
+	}
+}
+
+func TestEvaluateProbability(t *testing.T) {
+	const calls = 10000
+	for _, p := range []float64{0.01, 0.25, 0.5, 0.9} {
+		r, err := ParseRule("open -> EIO")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		r.probability = p
+		in := NewInjector([]*Rule{r})
+		in.rand = rand.New(rand.NewSource(1))
+		n := 0
+		for i := 0; i < calls; i++ {
+			if in.Evaluate(header(trace.FsOpen, "/f", 1), 0, true).Errno != 0 {
+				n++
+			}
+		}
+		// Allow for 5 standard deviations of the binomial distribution
+		mean := p * calls
+		if tolerance := 5 * math.Sqrt(calls*p*(1-p)); float64(n) < mean-tolerance || float64(n) > mean+tolerance {
+			t.Errorf("probability %g: %d injected out of %d calls", p, n, calls)
+		}
+	}
+}
+
+func TestEvaluateOrder(t *testing.T) {
+	// Delays add up until a rule makes the operation fail, and the shortest
+	// transfer wins
+	in := newTestInjector(t,
+		"write -> delay 1ms",
+		"write -> short 0.5",
+		"write -> short 0.25",
+		"write on /fail -> ENOSPC",
+		"write -> delay 2ms",
+	)
+	e := in.Evaluate(header(trace.FsWrite, "/f", 1), 100, true)
+	if e.Errno != 0 || e.Delay != 3*time.Millisecond || e.Size != 25 {
+		t.Errorf("got %+v", e)
+	}
+	e = in.Evaluate(header(trace.FsWrite, "/fail", 1), 100, true)
+	if e.Errno != syscall.ENOSPC || e.Delay != time.Millisecond || e.Size != 25 {
+		t.Errorf("got %+v", e)
+	}
+	// Short transfers only apply to the bytes read or written
+	e = in.Evaluate(header(trace.FsWrite, "/f", 1), 0, true)
+	if e.Errno != 0 || e.Delay != 3*time.Millisecond || e.Size != 0 {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestEvaluateNoShorten(t *testing.T) {
+	// The transfers which may not be shortened do not count as matching
+	// the rules shortening them
+	in := newTestInjector(t, "read -> short 0.5 after 1 call at most 1 time")
+	h := header(trace.FsRead, "/f", 1)
+	tests := []struct {
+		shorten bool
+		want    int
+	}{
+		{false, 100},
+		{false, 100},
+		{true, 100},
+		{true, 50},
+		{true, 100},
+	}
+	for i, test := range tests {
+		if e := in.Evaluate(h, 100, test.shorten); e.Size != test.want {
+			t.Errorf("call %d: got size %d, want %d", i, e.Size, test.want)
+		}
+	}
+}
+
+func TestShortensTransfers(t *testing.T) {
+	in := newTestInjector(t, "read on /data/** -> short random", "write -> EIO")
+	tests := []struct {
+		h    *trace.Header
+		want bool
+	}{
+		{header(trace.FsOpen, "/data/file", 1), true},
+		{header(trace.FsCreate, "/data/dir/file", 1), true},
+		{header(trace.FsOpen, "/other", 1), false},
+	}
+	for _, test := range tests {
+		if got := in.ShortensTransfers(test.h); got != test.want {
+			t.Errorf("%s %s: got %v, want %v", test.h.OperType, test.h.Path, got, test.want)
+		}
+	}
+}
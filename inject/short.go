@@ -0,0 +1,97 @@
+package inject
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// truncation draws the number of bytes a read or write operation transfers
+// out of the size bytes it requests
+type truncation func(r *rand.Rand, size int) int
+
+// transferOps are the operations which transfer bytes and may thus be
+// shortened
+var transferOps = []string{"read", "write"}
+
+// interruptibleOps are the operations which may legally fail with the
+// errors below, e.g. a read(2) interrupted by a signal or on a file opened
+// with O_NONBLOCK. Rules injecting them in other operations are refused,
+// since applications are not expected to handle them there.
+var interruptibleOps = map[syscall.Errno][]string{
+	syscall.EINTR:  {"open", "creat", "read", "write", "flush", "fsync", "setattr"},
+	syscall.EAGAIN: {"open", "read", "write"},
+}
+
+// parseTruncation parses the fraction of the requested bytes which are
+// transferred following 'short' and returns the number of tokens it is
+// made of
+func parseTruncation(tokens []string) (truncation, int, error) {
+	if len(tokens) == 0 {
+		return nil, 0, fmt.Errorf("missing fraction after 'short'")
+	}
+	if tokens[0] == "random" {
+		return func(r *rand.Rand, size int) int {
+			// At least one byte is transferred, since transferring none
+			// means the end of the file for a read
+			if size <= 1 {
+				return size
+			}
+			return 1 + r.Intn(size-1)
+		}, 1, nil
+	}
+	f, err := strconv.ParseFloat(tokens[0], 64)
+	if err != nil || f <= 0 || f >= 1 {
+		return nil, 0, fmt.Errorf("invalid fraction '%s'", tokens[0])
+	}
+	return func(r *rand.Rand, size int) int {
+		n := int(float64(size) * f)
+		if n < 1 && size > 0 {
+			n = 1
+		}
+		return n
+	}, 1, nil
+}
+
+// legalOps returns the operations to which the action of the rule may
+// apply, or nil if it applies to all of them
+func (r *Rule) legalOps() []string {
+	if r.short != nil {
+		return transferOps
+	}
+	return interruptibleOps[r.errno]
+}
+
+// includeOps makes the rule select the operations ops, or all those to
+// which its action, named action, may apply if ops is '*'
+func (r *Rule) includeOps(ops, action string) error {
+	legal := r.legalOps()
+	if ops == "*" {
+		if legal == nil {
+			return nil
+		}
+		return r.filter.Include(trace.FilterOp, legal...)
+	}
+	names := strings.Split(ops, ",")
+	if legal != nil {
+		for _, name := range names {
+			if !contains(legal, name) {
+				return fmt.Errorf("'%s' does not apply to '%s'", action, name)
+			}
+		}
+	}
+	return r.filter.Include(trace.FilterOp, names...)
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
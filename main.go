@@ -2,35 +2,182 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/airnandez/cluefs/fs"
+	"github.com/airnandez/cluefs/inject"
+	"github.com/airnandez/cluefs/trace"
 )
 
 func main() {
+	// Run the subcommand, if any
+	if status, ok := runCommand(); ok {
+		os.Exit(status)
+	}
+	os.Exit(mountAndServe())
+}
+
+// mountAndServe mounts the file system according to the command line
+// arguments and serves it until it is unmounted. It returns the exit status.
+func mountAndServe() int {
 	// Parse command line arguments
 	conf, err := ParseArguments()
 	if err != nil {
-		os.Exit(1)
+		return 1
 	}
 
 	// Create the tracer
-	tracer, err := NewTracer(conf.GetOutputFormat(), conf.GetTraceDestination())
+	var stats *trace.StatsTracer
+	if conf.GetStatsOptions().IsEnabled() || len(conf.GetMetricsAddress()) > 0 {
+		stats = trace.NewStatsTracer(conf.GetStatsOptions().IsEnabled(), trace.QueueOptions{})
+	}
+	tracer, outputs, err := newTracer(conf)
 	if err != nil {
 		errlog.Printf("%s", err)
-		os.Exit(2)
+		return 2
+	}
+	if filter := conf.GetFilter(); !filter.IsEmpty() {
+		tracer = trace.NewFilterTracer(filter, tracer)
+	}
+	// The statistics and the metrics account for all the operations,
+	// including those filtered out of the trace
+	if stats != nil {
+		tracer = trace.NewMultiTracer(stats, tracer)
 	}
 
 	// Create the file system object
-	cfs, err := NewClueFS(conf.GetShadowDir(), tracer)
+	pathStyle, _ := fs.ParsePathStyle(conf.GetPathStyle())
+	opts := fs.Options{
+		ShadowDir: conf.GetShadowDir(),
+		MountDir:  conf.GetMountPoint(),
+		ReadOnly:  conf.GetReadOnly(),
+		PathStyle: pathStyle,
+		FSName:    programName,
+	}
+	if IsDebugActive() {
+		opts.Debug = FuseDebug
+	}
+	if path := conf.GetInjectFile(); len(path) > 0 {
+		opts.Injector = inject.NewInjector(conf.GetInjectRules())
+	}
+	if name := conf.GetCrashMode(); len(name) > 0 {
+		mode, _ := fs.ParseCrashMode(name)
+		opts.Crash = fs.NewCrashSimulator(mode)
+	}
+	cfs, err := fs.NewClueFS(opts, tracer)
 	if err != nil {
 		errlog.Printf("could not create file system [%s]", err)
-		os.Exit(2)
+		tracer.Close()
+		return 2
 	}
 
-	// Mount and serve file system requests
-	if err = cfs.MountAndServe(conf.GetMountPoint(), conf.GetReadOnly()); err != nil {
+	// Serve the metrics, if requested
+	var metrics *metricsServer
+	if addr := conf.GetMetricsAddress(); len(addr) > 0 {
+		if metrics, err = startMetrics(addr, stats, cfs, conf.GetOutputs(), outputs); err != nil {
+			errlog.Printf("could not serve metrics [%s]", err)
+			tracer.Close()
+			return 2
+		}
+	}
+
+	// Mount and serve file system requests until unmounted. Catch SIGINT and
+	// SIGTERM before mounting, so that we always have a chance to unmount,
+	// as well as SIGUSR2 which simulates a power cut
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if opts.Crash != nil {
+		signal.Notify(sigChan, syscall.SIGUSR2)
+	}
+	if err = cfs.Mount(context.Background()); err != nil {
 		errlog.Printf("could not mount file system [%s]", err)
-		os.Exit(3)
+		if metrics != nil {
+			metrics.Close()
+		}
+		tracer.Close()
+		return 3
+	}
+	var stopStats, stopReload func()
+	if conf.GetStatsOptions().IsEnabled() {
+		stopStats = startStats(stats, conf.GetStatsOptions())
+	}
+	if opts.Injector != nil {
+		stopReload = startInjectReload(opts.Injector, conf.GetInjectFile())
+	}
+	waitUntilUnmounted(cfs, conf.GetMountPoint(), sigChan, opts.Crash)
+	signal.Stop(sigChan)
+	if stopReload != nil {
+		stopReload()
+	}
+	if metrics != nil {
+		metrics.Close()
+	}
+	status := 0
+	if err = cfs.Err(); err != nil {
+		errlog.Printf("could not serve file system [%s]", err)
+		status = 3
+	}
+
+	// Write all the pending trace events
+	if err = tracer.Close(); err != nil {
+		errlog.Printf("trace is incomplete [%s]", err)
+		if status == 0 {
+			status = 4
+		}
+	}
+
+	// Show the final statistics, once all the events are accounted for
+	if stopStats != nil {
+		stopStats()
 	}
 
 	// We are done
-	os.Exit(0)
+	return status
+}
+
+// newTracer creates a tracer for each output specified in the configuration
+// and returns a tracer which forwards the events to all of them. It also
+// returns the tracer of each output.
+func newTracer(conf *Config) (trace.Tracer, []trace.Tracer, error) {
+	info := trace.NewStreamInfo(version, conf.GetMountPoint(), conf.GetShadowDir())
+	outputs := conf.GetOutputs()
+	tracers := make([]trace.Tracer, 0, len(outputs))
+	for _, o := range outputs {
+		tracer, err := trace.NewTracer(o.Format, o.Dest, info, o.Queue, conf.GetRotateOptions())
+		if err != nil {
+			for _, t := range tracers {
+				t.Close()
+			}
+			return nil, nil, err
+		}
+		tracers = append(tracers, tracer)
+	}
+	if len(tracers) == 1 {
+		return tracers[0], tracers, nil
+	}
+	return trace.NewMultiTracer(tracers...), tracers, nil
+}
+
+// waitUntilUnmounted blocks until the file system is unmounted. On reception
+// of a signal it unmounts the file system itself, after simulating a power
+// cut with crash if the signal is SIGUSR2.
+func waitUntilUnmounted(cfs *fs.ClueFS, mountPoint string, sigChan <-chan os.Signal, crash *fs.CrashSimulator) {
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGUSR2 {
+				powerCut(crash)
+			}
+			errlog.Printf("received signal '%s': unmounting %s", sig, mountPoint)
+			if err := cfs.Unmount(); err != nil {
+				// The file system may be busy: keep serving requests
+				errlog.Printf("could not unmount %s [%s]", mountPoint, err)
+			}
+		case <-cfs.Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/airnandez/cluefs/fs"
+	"github.com/airnandez/cluefs/trace"
+)
+
+// metricsOutput is an output of the trace events which queue is reported
+// in the metrics
+type metricsOutput struct {
+	name  string
+	queue trace.QueueReporter
+}
+
+// metricsServer serves the metrics of the file system operations in the
+// Prometheus text exposition format
+type metricsServer struct {
+	stats   *trace.StatsTracer
+	cfs     *fs.ClueFS
+	outputs []metricsOutput
+	server  *http.Server
+}
+
+// startMetrics starts serving the metrics at the address addr, at the path
+// '/metrics'. The queue of each one of the tracers is reported under the
+// name of the corresponding output.
+func startMetrics(addr string, stats *trace.StatsTracer, cfs *fs.ClueFS, outputs []Output, tracers []trace.Tracer) (*metricsServer, error) {
+	m := &metricsServer{stats: stats, cfs: cfs}
+	for i, t := range tracers {
+		if q, ok := t.(trace.QueueReporter); ok {
+			m.outputs = append(m.outputs, metricsOutput{outputs[i].Dest, q})
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serveMetrics)
+	m.server = &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go m.server.Serve(listener)
+	return m, nil
+}
+
+func (m *metricsServer) Close() error {
+	return m.server.Close()
+}
+
+func (m *metricsServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	m.writeMetrics(out)
+	out.Flush()
+}
+
+// labelEscaper escapes the values of the labels of the metrics, as the
+// exposition format requires: only the backslash, the double quote and the
+// line feed are escaped
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricHeader writes the help and the type of a metric
+func metricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsServer) writeMetrics(w io.Writer) {
+	snap := m.stats.Snapshot()
+	ops := make([]trace.FSOperType, 0, len(snap.Ops))
+	for t := range snap.Ops {
+		ops = append(ops, t)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	metricHeader(w, "cluefs_operations_total", "counter", "Number of file system operations served.")
+	for _, t := range ops {
+		op := labelEscaper.Replace(t.String())
+		fmt.Fprintf(w, "cluefs_operations_total{op=\"%s\"} %d\n", op, snap.Ops[t].Count)
+	}
+
+	metricHeader(w, "cluefs_operation_errors_total", "counter", "Number of file system operations which failed, per error.")
+	for _, t := range ops {
+		op := labelEscaper.Replace(t.String())
+		errnos := make([]string, 0, len(snap.Errnos[t]))
+		for e := range snap.Errnos[t] {
+			errnos = append(errnos, e)
+		}
+		sort.Strings(errnos)
+		for _, e := range errnos {
+			fmt.Fprintf(w, "cluefs_operation_errors_total{op=\"%s\",errno=\"%s\"} %d\n", op, labelEscaper.Replace(e), snap.Errnos[t][e])
+		}
+	}
+
+	metricHeader(w, "cluefs_operation_duration_seconds", "histogram", "Duration of the file system operations.")
+	for _, t := range ops {
+		op := labelEscaper.Replace(t.String())
+		s := snap.Ops[t]
+		cumulative := uint64(0)
+		for i := 0; i < trace.LatencyBuckets-1; i++ {
+			cumulative += s.Latency[i]
+			fmt.Fprintf(w, "cluefs_operation_duration_seconds_bucket{op=\"%s\",le=\"%g\"} %d\n", op, trace.LatencyBound(i).Seconds(), cumulative)
+		}
+		fmt.Fprintf(w, "cluefs_operation_duration_seconds_bucket{op=\"%s\",le=\"+Inf\"} %d\n", op, s.Count)
+		fmt.Fprintf(w, "cluefs_operation_duration_seconds_sum{op=\"%s\"} %g\n", op, s.Elapsed.Seconds())
+		fmt.Fprintf(w, "cluefs_operation_duration_seconds_count{op=\"%s\"} %d\n", op, s.Count)
+	}
+
+	metricHeader(w, "cluefs_read_bytes_total", "counter", "Number of bytes read from the shadow directory.")
+	fmt.Fprintf(w, "cluefs_read_bytes_total %d\n", snap.Total.BytesRead)
+	metricHeader(w, "cluefs_written_bytes_total", "counter", "Number of bytes written to the shadow directory.")
+	fmt.Fprintf(w, "cluefs_written_bytes_total %d\n", snap.Total.BytesWritten)
+
+	metricHeader(w, "cluefs_open_handles", "gauge", "Number of files and directories currently open through the file system.")
+	fmt.Fprintf(w, "cluefs_open_handles %d\n", m.cfs.OpenHandles())
+
+	metricHeader(w, "cluefs_trace_queue_length", "gauge", "Number of trace events waiting to be written, per output.")
+	for _, o := range m.outputs {
+		fmt.Fprintf(w, "cluefs_trace_queue_length{output=\"%s\"} %d\n", labelEscaper.Replace(o.name), o.queue.QueueLength())
+	}
+	metricHeader(w, "cluefs_trace_dropped_events_total", "counter", "Number of trace events dropped because the queue was full, per output.")
+	for _, o := range m.outputs {
+		fmt.Fprintf(w, "cluefs_trace_dropped_events_total{output=\"%s\"} %d\n", labelEscaper.Replace(o.name), o.queue.Dropped())
+	}
+
+	metricHeader(w, "cluefs_start_time_seconds", "gauge", "Time cluefs started, in seconds since the Unix epoch.")
+	fmt.Fprintf(w, "cluefs_start_time_seconds %d\n", snap.Start.Unix())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/airnandez/cluefs/fs"
+	"github.com/airnandez/cluefs/trace"
+)
+
+// testQueue is the queue of an output with fixed figures
+type testQueue struct {
+	length  int
+	dropped uint64
+}
+
+func (q testQueue) QueueLength() int {
+	return q.length
+}
+
+func (q testQueue) Dropped() uint64 {
+	return q.dropped
+}
+
+func TestMetrics(t *testing.T) {
+	stats := trace.NewStatsTracer(false, trace.QueueOptions{})
+	stats.Trace(testEvent(&trace.ReadOp{OpenID: 1, BytesRead: 4096}, trace.FsRead, "a", 1, 0, 1))
+	stats.Trace(testEvent(&trace.WriteOp{OpenID: 1, BytesWritten: 10}, trace.FsWrite, "a", 1, 0, 3))
+	failed := testEvent(&trace.WriteOp{OpenID: 1, BytesWritten: -1}, trace.FsWrite, "a", 1, 0, 3)
+	failed.GetHeader().Errno = syscall.EIO
+	stats.Trace(failed)
+	if err := stats.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	cfs, err := fs.NewClueFS(fs.Options{ShadowDir: t.TempDir(), MountDir: "/tmp/trace"}, stats)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	m := &metricsServer{
+		stats: stats,
+		cfs:   cfs,
+		outputs: []metricsOutput{
+			// Only the backslash, the double quote and the line feed are
+			// escaped in the values of the labels
+			{"/var/tmp/\"été\"\\\n.csv", testQueue{3, 7}},
+		},
+	}
+	rec := httptest.NewRecorder()
+	m.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got content type '%s'", ct)
+	}
+	want := strings.Replace(metricsGolden, "START", fmt.Sprintf("%d", stats.Snapshot().Start.Unix()), 1)
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got metrics\n%s\nwant\n%s", got, want)
+	}
+}
+
+// metricsGolden is the expected exposition of the metrics, START standing
+// for the time the statistics started
+const metricsGolden = `# HELP cluefs_operations_total Number of file system operations served.
+# TYPE cluefs_operations_total counter
+cluefs_operations_total{op="read"} 1
+cluefs_operations_total{op="write"} 2
+# HELP cluefs_operation_errors_total Number of file system operations which failed, per error.
+# TYPE cluefs_operation_errors_total counter
+cluefs_operation_errors_total{op="write",errno="EIO"} 1
+# HELP cluefs_operation_duration_seconds Duration of the file system operations.
+# TYPE cluefs_operation_duration_seconds histogram
+cluefs_operation_duration_seconds_bucket{op="read",le="1e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="2e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="4e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="8e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="1.6e-05"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="3.2e-05"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="6.4e-05"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="0.000128"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="0.000256"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="0.000512"} 0
+cluefs_operation_duration_seconds_bucket{op="read",le="0.001024"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.002048"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.004096"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.008192"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.016384"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.032768"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.065536"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.131072"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.262144"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="0.524288"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="1.048576"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="2.097152"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="4.194304"} 1
+cluefs_operation_duration_seconds_bucket{op="read",le="+Inf"} 1
+cluefs_operation_duration_seconds_sum{op="read"} 0.001
+cluefs_operation_duration_seconds_count{op="read"} 1
+cluefs_operation_duration_seconds_bucket{op="write",le="1e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="2e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="4e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="8e-06"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="1.6e-05"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="3.2e-05"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="6.4e-05"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="0.000128"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="0.000256"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="0.000512"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="0.001024"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="0.002048"} 0
+cluefs_operation_duration_seconds_bucket{op="write",le="0.004096"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.008192"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.016384"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.032768"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.065536"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.131072"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.262144"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="0.524288"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="1.048576"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="2.097152"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="4.194304"} 2
+cluefs_operation_duration_seconds_bucket{op="write",le="+Inf"} 2
+cluefs_operation_duration_seconds_sum{op="write"} 0.006
+cluefs_operation_duration_seconds_count{op="write"} 2
+# HELP cluefs_read_bytes_total Number of bytes read from the shadow directory.
+# TYPE cluefs_read_bytes_total counter
+cluefs_read_bytes_total 4096
+# HELP cluefs_written_bytes_total Number of bytes written to the shadow directory.
+# TYPE cluefs_written_bytes_total counter
+cluefs_written_bytes_total 10
+# HELP cluefs_open_handles Number of files and directories currently open through the file system.
+# TYPE cluefs_open_handles gauge
+cluefs_open_handles 0
+# HELP cluefs_trace_queue_length Number of trace events waiting to be written, per output.
+# TYPE cluefs_trace_queue_length gauge
+cluefs_trace_queue_length{output="/var/tmp/\"été\"\\\n.csv"} 3
+# HELP cluefs_trace_dropped_events_total Number of trace events dropped because the queue was full, per output.
+# TYPE cluefs_trace_dropped_events_total counter
+cluefs_trace_dropped_events_total{output="/var/tmp/\"été\"\\\n.csv"} 7
+# HELP cluefs_start_time_seconds Time cluefs started, in seconds since the Unix epoch.
+# TYPE cluefs_start_time_seconds gauge
+cluefs_start_time_seconds START
+`
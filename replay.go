@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// replayQueueSize is the number of operations waiting to be replayed on
+// behalf of each process of the trace
+const replayQueueSize = 1024
+
+// replayDataSize is the size of the data written by the replayed writes,
+// which is reused for all of them
+const replayDataSize = 1 << 20
+
+// errSkipped is returned for the operations which cannot be replayed
+var errSkipped = fmt.Errorf("operation not replayed")
+
+// replayCommand re-issues the operations of a trace in CSV or JSON format
+// against a target directory
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet(programName+" replay", flag.ContinueOnError)
+	target := flags.String("target", "", "directory against which the operations are replayed")
+	timing := flags.String("timing", "original", "'original', 'fast' or the factor applied to the intervals between operations")
+	create := flags.Bool("create-missing", false, "create the files opened by the trace which do not exist in the target")
+	verbose := flags.Bool("verbose", false, "report the operations which outcome differs from the trace")
+	asJSON := flags.Bool("json", false, "read records in JSON format")
+	asCSV := flags.Bool("csv", false, "read records in CSV format")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(*target) == 0 || (*asJSON && *asCSV) || flags.NArg() > 1 {
+		errlog.Printf("usage: %s replay --target=<directory> [--timing=(original | fast | <factor>)] [--create-missing] [--verbose] [(--csv | --json)] [<file>]", programName)
+		return 1
+	}
+	scale, err := parseTiming(*timing)
+	if err != nil {
+		errlog.Printf("invalid value for option --timing: %s", err)
+		return 1
+	}
+	targetDir, err := filepath.Abs(*target)
+	if err == nil {
+		err = ensureIsDir(targetDir)
+	}
+	if err != nil {
+		errlog.Printf("invalid target directory [%s]", err)
+		return 2
+	}
+	in := os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			errlog.Printf("could not open trace [%s]", err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+
+	reader := bufio.NewReader(in)
+	var decoder interface {
+		Next() (interface{}, error)
+	}
+	if *asJSON || (!*asCSV && isJSONTrace(reader)) {
+		decoder = trace.NewJSONDecoder(reader)
+	} else {
+		decoder = trace.NewCSVDecoder(reader)
+	}
+	r := newReplayer(targetDir, scale, *create, *verbose)
+	status := 0
+	for {
+		record, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errlog.Printf("could not decode trace [%s]", err)
+			status = 3
+			break
+		}
+		switch rec := record.(type) {
+		case *trace.StreamInfo:
+			r.info = rec
+		case trace.FsOperTracer:
+			r.dispatch(rec)
+		}
+	}
+	r.wait()
+	r.report(os.Stdout)
+	return status
+}
+
+// parseTiming returns the factor by which the intervals between the
+// operations of the trace are multiplied when replaying them, or 0 if the
+// operations are replayed as fast as possible
+func parseTiming(s string) (float64, error) {
+	switch s {
+	case "original":
+		return 1, nil
+	case "fast":
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid timing '%s'", s)
+	}
+	return f, nil
+}
+
+// isJSONTrace returns true if the trace read by r starts with a JSON object
+func isJSONTrace(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch c := b[n-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{'
+		}
+	}
+}
+
+// replayer re-issues the operations of a trace. The operations of each
+// process of the trace are replayed in order by a goroutine of their own,
+// so that the processes run concurrently as they did when the trace was
+// recorded. Besides, each operation waits until the operations which had
+// ended when it started in the trace are replayed, so that the operations
+// of a process depending on those of another, e.g. the reads of a file
+// opened by another thread, are replayed after them.
+type replayer struct {
+	target  string
+	scale   float64
+	create  bool
+	verbose bool
+
+	// info describes the stream being replayed, if it has a header
+	info *trace.StreamInfo
+
+	// origin is the start of the first operation of the trace, last the
+	// end of its last operation and start the time the replay started
+	origin time.Time
+	last   time.Time
+	start  time.Time
+
+	// queues holds the operations waiting to be replayed for each process
+	// and handles the files opened, by open id. Both are only accessed by
+	// the goroutine dispatching the operations.
+	queues  map[uint32]chan *replayEvent
+	handles map[uint64]*replayHandle
+	workers sync.WaitGroup
+
+	// order tracks the operations replayed, numbered in the order of the
+	// trace. ends holds the end in the trace of the operations from
+	// number base on, which may not be replayed yet.
+	order *replayOrder
+	ends  []time.Time
+	base  uint64
+
+	// data is written by the replayed writes
+	data []byte
+
+	// The counters below are accessed atomically
+	replayed  uint64
+	failed    uint64
+	differing uint64
+	skipped   uint64
+	lost      uint64
+	created   uint64
+}
+
+// replayEvent is an operation to be replayed, with its paths in the target
+// directory
+type replayEvent struct {
+	op      trace.FsOperTracer
+	path    string
+	newPath string
+
+	// handle is the file the operation applies to, if any
+	handle *replayHandle
+
+	// seq is the number of the operation and after the number of the
+	// operations which must be replayed before it
+	seq   uint64
+	after uint64
+}
+
+// replayHandle is a file opened by the replayed operations
+type replayHandle struct {
+	file *os.File
+	err  error
+
+	// implicit is true if the trace does not show the file being opened,
+	// in which case it is opened by the first operation using it, once
+	// the operations before it are replayed
+	implicit bool
+	once     sync.Once
+
+	// seq is the number of the operation opening the file, if not
+	// implicit
+	seq uint64
+
+	// path is the path of the file in the target directory and pid the
+	// process which opened it. Both are only accessed by the goroutine
+	// dispatching the operations.
+	path string
+	pid  uint32
+}
+
+// open opens the file of h at path, if it is opened implicitly, and
+// returns the error found when opening it
+func (h *replayHandle) open(path string) error {
+	if h.implicit {
+		h.once.Do(func() {
+			h.file, h.err = os.OpenFile(path, os.O_RDWR, 0)
+			if h.err != nil {
+				h.file, h.err = os.Open(path)
+			}
+		})
+	}
+	return h.err
+}
+
+// replayOrder tracks the operations which are replayed
+type replayOrder struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// replayed is the number of operations replayed with all the previous
+	// ones, and done holds the numbers of the other operations replayed
+	replayed uint64
+	done     map[uint64]bool
+}
+
+func newReplayOrder() *replayOrder {
+	o := &replayOrder{done: make(map[uint64]bool)}
+	o.cond = sync.NewCond(&o.mutex)
+	return o
+}
+
+// wait waits until the first n operations are replayed
+func (o *replayOrder) wait(n uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for o.replayed < n {
+		o.cond.Wait()
+	}
+}
+
+// complete records that the operation numbered seq is replayed
+func (o *replayOrder) complete(seq uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.done[seq] = true
+	for o.done[o.replayed] {
+		delete(o.done, o.replayed)
+		o.replayed++
+	}
+	o.cond.Broadcast()
+}
+
+// count returns the number of operations replayed with all the previous
+// ones
+func (o *replayOrder) count() uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.replayed
+}
+
+func newReplayer(target string, scale float64, create, verbose bool) *replayer {
+	data := make([]byte, replayDataSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(data)
+	return &replayer{
+		target:  target,
+		scale:   scale,
+		create:  create,
+		verbose: verbose,
+		queues:  make(map[uint32]chan *replayEvent),
+		handles: make(map[uint64]*replayHandle),
+		order:   newReplayOrder(),
+		data:    data,
+	}
+}
+
+// targetPath returns the path in the target directory of the file which
+// path in the trace is path. That path must be under the mount point or
+// the shadow directory of the traced file system, or relative to it.
+func (r *replayer) targetPath(path string) (string, bool) {
+	if !filepath.IsAbs(path) {
+		return filepath.Join(r.target, path), true
+	}
+	if r.info != nil {
+		for _, dir := range []string{r.info.ShadowDir, r.info.MountDir} {
+			if rel, ok := relativeTo(path, dir); ok {
+				return filepath.Join(r.target, rel), true
+			}
+		}
+	}
+	return "", false
+}
+
+// relativeTo returns the path of path relative to dir, if path is dir
+// itself or is located under dir
+func relativeTo(path, dir string) (string, bool) {
+	if path == dir {
+		return ".", true
+	}
+	if prefix := strings.TrimSuffix(dir, "/") + "/"; len(dir) > 0 && strings.HasPrefix(path, prefix) {
+		return path[len(prefix):], true
+	}
+	return "", false
+}
+
+// dispatch queues the operation op to be replayed on behalf of its process
+func (r *replayer) dispatch(op trace.FsOperTracer) {
+	h := op.GetHeader()
+	if lost, ok := op.(*trace.LostOp); ok {
+		atomic.AddUint64(&r.lost, lost.Count)
+		return
+	}
+	if h.Injected && h.Errno != 0 {
+		// The fault was injected by cluefs: the operation never reached
+		// the storage
+		atomic.AddUint64(&r.skipped, 1)
+		return
+	}
+	ev, ok := r.newEvent(op)
+	if !ok {
+		atomic.AddUint64(&r.skipped, 1)
+		return
+	}
+	if r.origin.IsZero() {
+		r.origin, r.start = h.Start, time.Now()
+	}
+	if h.End.After(r.last) {
+		r.last = h.End
+	}
+	r.sequence(ev)
+	queue, ok := r.queues[h.Pid]
+	if !ok {
+		queue = make(chan *replayEvent, replayQueueSize)
+		r.queues[h.Pid] = queue
+		r.workers.Add(1)
+		go r.work(queue)
+	}
+	queue <- ev
+}
+
+// sequence numbers the operation of ev and determines the operations it
+// must wait for. The events are written to the trace when the operations
+// end, so those which ended before it started come before it, except for
+// the few written out of order which it then waits for too.
+func (r *replayer) sequence(ev *replayEvent) {
+	// Forget the ends of the operations already replayed
+	if n := r.order.count(); n > r.base {
+		r.ends = r.ends[n-r.base:]
+		r.base = n
+	}
+	h := ev.op.GetHeader()
+	ev.seq = r.base + uint64(len(r.ends))
+	ev.after = ev.seq
+	for i := len(r.ends) - 1; i >= 0 && r.ends[i].After(h.Start); i-- {
+		ev.after = r.base + uint64(i)
+	}
+	r.ends = append(r.ends, h.End)
+
+	// The operations on a file wait until it is opened, which is only
+	// not implied by the above for the operations which do not record
+	// the open id of their file
+	if ev.handle == nil || ev.handle.implicit {
+		return
+	}
+	switch ev.op.(type) {
+	case *trace.OpenOp, *trace.CreateOp:
+		ev.handle.seq = ev.seq
+	default:
+		if ev.after <= ev.handle.seq {
+			ev.after = ev.handle.seq + 1
+		}
+	}
+}
+
+// newEvent prepares the replay of op. It returns false if op cannot be
+// replayed.
+func (r *replayer) newEvent(op trace.FsOperTracer) (*replayEvent, bool) {
+	ev := &replayEvent{op: op}
+	var ok bool
+	if ev.path, ok = r.targetPath(op.GetHeader().Path); !ok {
+		return nil, false
+	}
+	switch o := op.(type) {
+	case *trace.RenameOp:
+		if ev.newPath, ok = r.targetPath(o.NewPath); ok && o.Errno == 0 {
+			r.renamed(ev.path, ev.newPath)
+		}
+	case *trace.LinkOp:
+		ev.newPath, ok = r.targetPath(o.NewPath)
+	case *trace.SymlinkOp:
+		// Relative targets are kept as they are
+		ev.newPath = o.Target
+		if p, found := r.targetPath(o.Target); found && filepath.IsAbs(o.Target) {
+			ev.newPath = p
+		}
+	case *trace.OpenOp:
+		ev.handle = r.openHandle(o.OpenID, o.Errno, ev.path, o.Pid)
+	case *trace.CreateOp:
+		ev.handle = r.openHandle(o.OpenID, o.Errno, ev.path, o.Pid)
+	case *trace.ReadOp:
+		ev.handle = r.handle(o.OpenID, ev.path, o.Pid)
+	case *trace.WriteOp:
+		ev.handle = r.handle(o.OpenID, ev.path, o.Pid)
+	case *trace.FlushOp:
+		ev.handle = r.handle(o.OpenID, ev.path, o.Pid)
+	case *trace.ReadDirOp:
+		ev.handle = r.handle(o.OpenID, ev.path, o.Pid)
+	case *trace.FsyncOp:
+		ev.handle = r.pathHandle(ev.path, o.Pid)
+	case *trace.ReleaseOp:
+		if ev.handle, ok = r.handles[o.OpenID]; ok {
+			delete(r.handles, o.OpenID)
+		}
+	}
+	return ev, ok
+}
+
+// openHandle returns the handle of the file which is being opened with the
+// given open id. The files which could not be opened in the trace have no
+// open id and are not used by other operations.
+func (r *replayer) openHandle(openID uint64, errno syscall.Errno, path string, pid uint32) *replayHandle {
+	if errno != 0 {
+		return nil
+	}
+	h := &replayHandle{path: path, pid: pid}
+	r.handles[openID] = h
+	return h
+}
+
+// handle returns the handle of the file at path opened with the given open
+// id. If the trace does not show it being opened, e.g. because the trace
+// started after that, the file is opened by the first operation using it.
+func (r *replayer) handle(openID uint64, path string, pid uint32) *replayHandle {
+	if h, ok := r.handles[openID]; ok {
+		return h
+	}
+	h := &replayHandle{implicit: true, path: path, pid: pid}
+	r.handles[openID] = h
+	return h
+}
+
+// pathHandle returns a handle of the file at path, preferably one opened by
+// the process pid, or nil if the file is not open. The operations which
+// do not record the open id of the file they apply to, such as fsync, are
+// replayed on such a handle, which remains valid if the file is removed.
+func (r *replayer) pathHandle(path string, pid uint32) *replayHandle {
+	var found *replayHandle
+	for _, h := range r.handles {
+		if h.path != path {
+			continue
+		}
+		if h.pid == pid {
+			return h
+		}
+		found = h
+	}
+	return found
+}
+
+// renamed updates the paths of the handles of the file or directory at
+// oldpath, and of the files under it, which is renamed to newpath
+func (r *replayer) renamed(oldpath, newpath string) {
+	for _, h := range r.handles {
+		if rel, ok := relativeTo(h.path, oldpath); ok {
+			h.path = filepath.Join(newpath, rel)
+		}
+	}
+}
+
+// work replays the operations received from queue in order
+func (r *replayer) work(queue <-chan *replayEvent) {
+	defer r.workers.Done()
+	var buf []byte
+	for ev := range queue {
+		r.waitUntil(ev.op.GetHeader().Start)
+		r.order.wait(ev.after)
+		err := r.replay(ev, &buf)
+		r.order.complete(ev.seq)
+		r.account(ev, err)
+	}
+}
+
+// waitUntil waits until it is time to replay the operation which started at
+// start in the trace
+func (r *replayer) waitUntil(start time.Time) {
+	if r.scale == 0 {
+		return
+	}
+	offset := time.Duration(float64(start.Sub(r.origin)) * r.scale)
+	if d := time.Until(r.start.Add(offset)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// account records the outcome of the replay of an operation
+func (r *replayer) account(ev *replayEvent, err error) {
+	if err == errSkipped {
+		atomic.AddUint64(&r.skipped, 1)
+		return
+	}
+	atomic.AddUint64(&r.replayed, 1)
+	if err != nil {
+		atomic.AddUint64(&r.failed, 1)
+	}
+	h := ev.op.GetHeader()
+	if (err == nil) == (h.Errno == 0) {
+		return
+	}
+	atomic.AddUint64(&r.differing, 1)
+	if r.verbose {
+		outcome := "OK"
+		if err != nil {
+			outcome = err.Error()
+		}
+		original := "OK"
+		if h.Errno != 0 {
+			original = h.Errno.Error()
+		}
+		errlog.Printf("replay of %s '%s' by pid %d: %s, trace: %s", h.OperType, h.Path, h.Pid, outcome, original)
+	}
+}
+
+// replay performs the operation of ev. buf is the buffer of the worker for
+// the bytes read.
+func (r *replayer) replay(ev *replayEvent, buf *[]byte) error {
+	switch op := ev.op.(type) {
+	case *trace.OpenOp:
+		f, err := r.openFile(ev.path, op)
+		return ev.opened(f, err)
+	case *trace.CreateOp:
+		f, err := os.OpenFile(ev.path, int(op.Flags)|os.O_CREATE, op.Mode)
+		return ev.opened(f, err)
+	case *trace.ReadOp:
+		if err := ev.handle.open(ev.path); err != nil {
+			return err
+		}
+		if len(*buf) < op.Size {
+			*buf = make([]byte, op.Size)
+		}
+		_, err := syscall.Pread(int(ev.handle.file.Fd()), (*buf)[:op.Size], op.Offset)
+		return err
+	case *trace.WriteOp:
+		if err := ev.handle.open(ev.path); err != nil {
+			return err
+		}
+		// Write as many bytes as the traced write did
+		size := op.Size
+		if op.BytesWritten >= 0 {
+			size = op.BytesWritten
+		}
+		_, err := syscall.Pwrite(int(ev.handle.file.Fd()), r.payload(size), op.Offset)
+		return err
+	case *trace.FlushOp:
+		// A file is flushed each time one of its descriptors is closed
+		if err := ev.handle.open(ev.path); err != nil {
+			return err
+		}
+		fd, err := syscall.Dup(int(ev.handle.file.Fd()))
+		if err != nil {
+			return err
+		}
+		return syscall.Close(fd)
+	case *trace.ReadDirOp:
+		if err := ev.handle.open(ev.path); err != nil {
+			return err
+		}
+		if _, err := ev.handle.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := ev.handle.file.Readdirnames(-1)
+		return err
+	case *trace.ReleaseOp:
+		if ev.handle.err != nil || ev.handle.file == nil {
+			// Already reported when opening the file, or never used
+			return nil
+		}
+		return ev.handle.file.Close()
+	case *trace.FsyncOp:
+		return fsync(ev, op.DataSync)
+	case *trace.MkdirOp:
+		return os.Mkdir(ev.path, op.Mode)
+	case *trace.MknodOp:
+		switch {
+		case op.Mode&os.ModeNamedPipe != 0:
+			return syscall.Mkfifo(ev.path, uint32(op.Mode.Perm()))
+		case op.Mode&os.ModeType == 0:
+			f, err := os.OpenFile(ev.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, op.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+		return errSkipped
+	case *trace.RemoveOp:
+		if op.IsDir {
+			return syscall.Rmdir(ev.path)
+		}
+		return syscall.Unlink(ev.path)
+	case *trace.SymlinkOp:
+		return os.Symlink(ev.newPath, ev.path)
+	case *trace.LookupOp:
+		_, err := os.Lstat(ev.path)
+		return err
+	case *trace.StatFsOp:
+		var st syscall.Statfs_t
+		return syscall.Statfs(ev.path, &st)
+	case *trace.RenameOp:
+		return os.Rename(ev.path, ev.newPath)
+	case *trace.LinkOp:
+		return os.Link(ev.path, ev.newPath)
+	case *trace.ReadlinkOp:
+		_, err := os.Readlink(ev.path)
+		return err
+	case *trace.AccessOp:
+		return syscall.Access(ev.path, op.Mask)
+	case *trace.SetattrOp:
+		return setattr(ev.path, op)
+	}
+	// Extended attributes are not replayed
+	return errSkipped
+}
+
+// fsync flushes the file of the operation of ev to stable storage, using
+// its handle if the file is open
+func fsync(ev *replayEvent, datasync bool) error {
+	f := (*os.File)(nil)
+	if ev.handle != nil && ev.handle.open(ev.path) == nil {
+		f = ev.handle.file
+	} else {
+		var err error
+		if f, err = os.Open(ev.path); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	if datasync {
+		return fdatasync(f)
+	}
+	return f.Sync()
+}
+
+// opened records the outcome of opening the file of the operation of ev.
+// The file is closed right away if it could not be opened in the trace,
+// since it is not used afterwards.
+func (ev *replayEvent) opened(f *os.File, err error) error {
+	if ev.handle == nil {
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+	ev.handle.file, ev.handle.err = f, err
+	return err
+}
+
+// openFile opens the file or directory at path as op did. If the file does
+// not exist and the replayer creates the missing files, it is created with
+// the size it had in the trace.
+func (r *replayer) openFile(path string, op *trace.OpenOp) (*os.File, error) {
+	open := func() (*os.File, error) {
+		if op.IsDir {
+			return os.Open(path)
+		}
+		return os.OpenFile(path, int(op.Flags), 0)
+	}
+	f, err := open()
+	if !os.IsNotExist(err) || !r.create || op.Errno != 0 {
+		return f, err
+	}
+	if op.IsDir {
+		err = os.MkdirAll(path, 0755)
+	} else {
+		err = createFile(path, int64(op.FileSize))
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&r.created, 1)
+	return open()
+}
+
+// createFile creates the file at path with the given size, as well as its
+// missing parent directories
+func createFile(path string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// payload returns size bytes to be written
+func (r *replayer) payload(size int) []byte {
+	if size <= len(r.data) {
+		return r.data[:size]
+	}
+	b := make([]byte, size)
+	for i := 0; i < size; i += len(r.data) {
+		copy(b[i:], r.data)
+	}
+	return b
+}
+
+// setattr changes the attributes of the file at path as op did
+func setattr(path string, op *trace.SetattrOp) error {
+	var errs []string
+	fail := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	v := op.AttrValid
+	if v.Size() {
+		fail(os.Truncate(path, int64(op.Size)))
+	}
+	if v.Mode() {
+		// The mode of a symbolic link cannot be changed, as in the file
+		// system, and chmod(2) would change the mode of its target
+		if info, err := os.Lstat(path); err != nil {
+			fail(err)
+		} else if info.Mode()&os.ModeSymlink == 0 {
+			fail(os.Chmod(path, op.Mode))
+		}
+	}
+	if v.Uid() || v.Gid() {
+		uid, gid := -1, -1
+		if v.Uid() {
+			uid = int(op.Uid)
+		}
+		if v.Gid() {
+			gid = int(op.Gid)
+		}
+		fail(os.Lchown(path, uid, gid))
+	}
+	var atime, mtime *time.Time
+	if v.Atime() || v.AtimeNow() {
+		atime = &op.Atime
+	}
+	if v.Mtime() || v.MtimeNow() {
+		mtime = &op.Mtime
+	}
+	if atime != nil || mtime != nil {
+		fail(lchtimes(path, atime, mtime))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// wait waits until all the operations are replayed and closes the files
+// left open by the trace
+func (r *replayer) wait() {
+	for _, queue := range r.queues {
+		close(queue)
+	}
+	r.workers.Wait()
+	for _, h := range r.handles {
+		if h.err == nil && h.file != nil {
+			h.file.Close()
+		}
+	}
+}
+
+// report writes a summary of the replay to w
+func (r *replayer) report(w io.Writer) {
+	elapsed := time.Since(r.start)
+	if r.origin.IsZero() {
+		elapsed = 0
+	}
+	fmt.Fprintf(w, "replayed %d operations in %s (%s in the trace)\n",
+		r.replayed, elapsed, r.last.Sub(r.origin))
+	fmt.Fprintf(w, "%d operations failed, %d operations had a different outcome than in the trace\n",
+		r.failed, r.differing)
+	if r.skipped > 0 {
+		fmt.Fprintf(w, "%d operations could not be replayed\n", r.skipped)
+	}
+	if r.created > 0 {
+		fmt.Fprintf(w, "%d missing files or directories were created\n", r.created)
+	}
+	if r.lost > 0 {
+		fmt.Fprintf(w, "%d events were lost when recording the trace\n", r.lost)
+	}
+}
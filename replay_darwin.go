@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fdatasync flushes the data of the file f to stable storage. MacOS X does
+// not expose fdatasync(2), so a full fsync(2) is done instead.
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// Constants for setattrlist(2), from <sys/attr.h>
+const (
+	attrBitMapCount = 5
+	attrCmnModtime  = 0x00000400
+	attrCmnAcctime  = 0x00001000
+	fsoptNoFollow   = 0x00000001
+)
+
+// attrList is the attribute list given to setattrlist(2)
+type attrList struct {
+	bitmapCount uint16
+	reserved    uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+// lchtimes sets the access and modification times of path which are not
+// nil, without following symbolic links
+func lchtimes(path string, atime, mtime *time.Time) error {
+	list := attrList{bitmapCount: attrBitMapCount}
+	// The times must be given in the order of their attribute bits
+	times := make([]syscall.Timespec, 0, 2)
+	if mtime != nil {
+		list.commonAttr |= attrCmnModtime
+		times = append(times, syscall.NsecToTimespec(mtime.UnixNano()))
+	}
+	if atime != nil {
+		list.commonAttr |= attrCmnAcctime
+		times = append(times, syscall.NsecToTimespec(atime.UnixNano()))
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&list)),
+		uintptr(unsafe.Pointer(&times[0])), uintptr(len(times))*unsafe.Sizeof(times[0]), fsoptNoFollow, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "setattrlist", Path: path, Err: errno}
+	}
+	return nil
+}
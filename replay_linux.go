@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fdatasync flushes the data of the file f to stable storage
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// Constants for utimensat(2), from <fcntl.h> and <sys/stat.h>
+const (
+	atFdCwd           = -0x64
+	atSymlinkNoFollow = 0x100
+	utimeOmit         = (1 << 30) - 2
+)
+
+// lchtimes sets the access and modification times of path which are not
+// nil, without following symbolic links
+func lchtimes(path string, atime, mtime *time.Time) error {
+	ts := [2]syscall.Timespec{{Nsec: utimeOmit}, {Nsec: utimeOmit}}
+	if atime != nil {
+		ts[0] = syscall.NsecToTimespec(atime.UnixNano())
+	}
+	if mtime != nil {
+		ts[1] = syscall.NsecToTimespec(mtime.UnixNano())
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	dirfd := atFdCwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: errno}
+	}
+	return nil
+}
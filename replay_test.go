@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// testEvent returns op with a header for the file at path in the shadow
+// directory, running from start to end milliseconds after an arbitrary
+// origin
+func testEvent(op trace.FsOperTracer, typ trace.FSOperType, path string, pid uint32, start, end int) trace.FsOperTracer {
+	origin := time.Unix(1427103948, 0)
+	h := op.GetHeader()
+	h.OperType = typ
+	h.Path = "/data/" + path
+	h.Pid = pid
+	h.Start = origin.Add(time.Duration(start) * time.Millisecond)
+	h.End = origin.Add(time.Duration(end) * time.Millisecond)
+	return op
+}
+
+func TestReplaySequence(t *testing.T) {
+	tests := []struct {
+		op    trace.FsOperTracer
+		after uint64 // the number of operations which must be replayed before
+	}{
+		// 0: the first operation waits for none
+		{testEvent(&trace.OpenOp{OpenID: 1}, trace.FsOpen, "a", 1, 0, 10), 0},
+		// 1: the operations which ended before it started
+		{testEvent(&trace.WriteOp{OpenID: 1}, trace.FsWrite, "a", 1, 20, 30), 1},
+		// 2: the operations of other processes too
+		{testEvent(&trace.LookupOp{}, trace.FsStat, "b", 2, 40, 100), 2},
+		// 3: not those which ended after it started
+		{testEvent(&trace.LookupOp{}, trace.FsStat, "c", 3, 50, 60), 2},
+		// 4: written out of order, it waits for the operations before it
+		// which ended when it started only
+		{testEvent(&trace.LookupOp{}, trace.FsStat, "d", 4, 15, 70), 1},
+		// 5: the operations on a file wait until it is opened, even if the
+		// open ended after they started
+		{testEvent(&trace.ReadOp{OpenID: 1}, trace.FsRead, "a", 5, 5, 80), 1},
+		// 6: but not those on a file which the trace does not show being
+		// opened
+		{testEvent(&trace.ReadOp{OpenID: 2}, trace.FsRead, "e", 6, 5, 90), 0},
+		// 7: the fsync of an open file waits until it is opened
+		{testEvent(&trace.FsyncOp{}, trace.FsFsync, "a", 7, 5, 110), 1},
+		// 8: the release of the file ends its use of the open id
+		{testEvent(&trace.ReleaseOp{OpenID: 1}, trace.FsRelease, "a", 1, 120, 130), 8},
+		// 9, 10: which may be given to another file
+		{testEvent(&trace.OpenOp{OpenID: 1}, trace.FsOpen, "f", 1, 125, 140), 8},
+		{testEvent(&trace.ReadOp{OpenID: 1}, trace.FsRead, "f", 1, 121, 150), 10},
+	}
+	r := newReplayer(t.TempDir(), 0, false, false)
+	r.info = &trace.StreamInfo{Schema: trace.SchemaVersion, ShadowDir: "/data"}
+	for i, test := range tests {
+		h := test.op.GetHeader()
+		ev, ok := r.newEvent(test.op)
+		if !ok {
+			t.Fatalf("%d: %s %s not replayed", i, h.OperType, h.Path)
+		}
+		r.sequence(ev)
+		if ev.seq != uint64(i) || ev.after != test.after {
+			t.Errorf("%d: %s %s has number %d and waits for %d operations, want %d and %d",
+				i, h.OperType, h.Path, ev.seq, ev.after, i, test.after)
+		}
+	}
+}
+
+func TestReplaySequenceForgets(t *testing.T) {
+	// The ends of the operations replayed with all the previous ones are
+	// forgotten, the numbering goes on
+	r := newReplayer(t.TempDir(), 0, false, false)
+	r.info = &trace.StreamInfo{Schema: trace.SchemaVersion, ShadowDir: "/data"}
+	for i := 0; i < 4; i++ {
+		ev, _ := r.newEvent(testEvent(&trace.LookupOp{}, trace.FsStat, "a", 1, 10*i, 10*i+5))
+		r.sequence(ev)
+	}
+	r.order.complete(1)
+	r.order.complete(0)
+	r.order.complete(3)
+	ev, _ := r.newEvent(testEvent(&trace.LookupOp{}, trace.FsStat, "a", 1, 0, 50))
+	r.sequence(ev)
+	if r.base != 2 || len(r.ends) != 3 {
+		t.Errorf("base %d and %d ends, want 2 and 3", r.base, len(r.ends))
+	}
+	if ev.seq != 4 || ev.after != 2 {
+		t.Errorf("got number %d waiting for %d operations, want 4 and 2", ev.seq, ev.after)
+	}
+}
+
+func TestReplayOrder(t *testing.T) {
+	o := newReplayOrder()
+	tests := []struct {
+		complete uint64
+		count    uint64
+	}{
+		{2, 0},
+		{0, 1},
+		{1, 3},
+		{4, 3},
+		{3, 5},
+	}
+	for _, test := range tests {
+		o.complete(test.complete)
+		if n := o.count(); n != test.count {
+			t.Errorf("after completing %d: %d operations replayed, want %d", test.complete, n, test.count)
+		}
+	}
+	if len(o.done) != 0 {
+		t.Errorf("%d operations left out of order", len(o.done))
+	}
+
+	// Waiting returns once all the operations before are replayed
+	o = newReplayOrder()
+	done := make(chan struct{})
+	go func() {
+		o.wait(2)
+		close(done)
+	}()
+	o.complete(1)
+	select {
+	case <-done:
+		t.Fatalf("wait returned before operation 0 was replayed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	o.complete(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("wait did not return")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ops := []trace.FsOperTracer{
+		testEvent(&trace.CreateOp{Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0640, OpenID: 1}, trace.FsCreate, "f", 1, 0, 1),
+		testEvent(&trace.WriteOp{Offset: 0, Size: 100, BytesWritten: 100, OpenID: 1}, trace.FsWrite, "f", 1, 2, 3),
+		// A write of another thread, shorter in the trace
+		testEvent(&trace.WriteOp{Offset: 100, Size: 100, BytesWritten: 50, OpenID: 1}, trace.FsWrite, "f", 2, 4, 5),
+		testEvent(&trace.FsyncOp{DataSync: true}, trace.FsFsync, "f", 1, 6, 7),
+		testEvent(&trace.ReleaseOp{OpenID: 1}, trace.FsRelease, "f", 1, 8, 9),
+		testEvent(&trace.MkdirOp{Mode: os.ModeDir | 0755}, trace.FsMkdir, "d", 3, 10, 11),
+		testEvent(&trace.RenameOp{NewPath: "/data/d/g"}, trace.FsRename, "f", 3, 12, 13),
+		testEvent(&trace.SetattrOp{AttrValid: fuse.SetattrSize, Size: 10}, trace.FsSetAttr, "d/g", 3, 14, 15),
+		testEvent(&trace.SymlinkOp{Target: "g"}, trace.FsSymlink, "d/l", 3, 16, 17),
+		// An operation which failed in the trace
+		testEvent(&trace.LookupOp{Header: trace.Header{Errno: 2}}, trace.FsStat, "missing", 3, 18, 19),
+		// A file written and synced by a process after removing it
+		testEvent(&trace.OpenOp{Flags: fuse.OpenWriteOnly, OpenID: 2}, trace.FsOpen, "h", 4, 20, 21),
+		testEvent(&trace.RemoveOp{}, trace.FsRemove, "h", 4, 22, 23),
+		testEvent(&trace.WriteOp{Offset: 0, Size: 10, BytesWritten: 10, OpenID: 2}, trace.FsWrite, "h", 4, 24, 25),
+		testEvent(&trace.FsyncOp{}, trace.FsFsync, "h", 4, 26, 27),
+		testEvent(&trace.ReleaseOp{OpenID: 2}, trace.FsRelease, "h", 4, 28, 29),
+		// Not under the traced directories
+		testEvent(&trace.LookupOp{}, trace.FsStat, "../elsewhere", 3, 30, 31),
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "trace.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.Encode(&trace.StreamInfo{Schema: trace.SchemaVersion, MountDir: "/mnt", ShadowDir: "/data"})
+	for _, op := range ops {
+		op.GetHeader().Path = filepath.Clean(op.GetHeader().Path)
+		if err := enc.Encode(op); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	f.Close()
+
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "h"), nil, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if status := replayCommand([]string{"--target=" + target, "--timing=fast", path}); status != 0 {
+		t.Fatalf("replay exited with status %d", status)
+	}
+	if fi, err := os.Stat(filepath.Join(target, "d/g")); err != nil || fi.Size() != 10 || fi.Mode().Perm() != 0640 {
+		t.Errorf("got %v, %v for the renamed file", fi, err)
+	}
+	if l, err := os.Readlink(filepath.Join(target, "d/l")); err != nil || l != "g" {
+		t.Errorf("got link '%s', %v", l, err)
+	}
+	for _, name := range []string{"f", "h"} {
+		if _, err := os.Lstat(filepath.Join(target, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want it to be missing", name, err)
+		}
+	}
+}
+
+func TestReplaySetattrSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	before, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// The attributes of the link are changed, not those of its target
+	mtime := time.Date(2015, 3, 26, 13, 41, 15, 0, time.UTC)
+	op := &trace.SetattrOp{AttrValid: fuse.SetattrMode | fuse.SetattrMtime, Mode: 0600, Mtime: mtime}
+	if err := setattr(link, op); err != nil {
+		t.Fatalf("%s", err)
+	}
+	after, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("target changed: got mode %s, mtime %s", after.Mode(), after.ModTime())
+	}
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("got mtime %s for the link, want %s", info.ModTime(), mtime)
+	}
+}
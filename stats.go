@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/airnandez/cluefs/trace"
+)
+
+// statsTopEntries is the number of paths and of processes shown in the
+// table of statistics
+const statsTopEntries = 15
+
+// clearScreen moves the cursor of the terminal to its top left corner and
+// clears the screen
+const clearScreen = "\033[H\033[2J"
+
+// startStats periodically shows the statistics on the standard output, if
+// requested, and dumps them in JSON format on reception of SIGUSR1. The
+// returned function stops doing so and dumps the final statistics.
+func startStats(stats *trace.StatsTracer, opts StatsOptions) func() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		var tick <-chan time.Time
+		var prev *trace.StatsSnapshot
+		if opts.Display {
+			ticker := time.NewTicker(opts.Interval)
+			defer ticker.Stop()
+			tick = ticker.C
+			prev = showStats(stats, nil)
+		}
+		for {
+			select {
+			case <-tick:
+				prev = showStats(stats, prev)
+			case <-usr1:
+				dumpStats(stats, opts.Dest)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(usr1)
+		close(stop)
+		<-done
+		dumpStats(stats, opts.Dest)
+	}
+}
+
+// showStats shows the table of statistics on the standard output. The rates
+// are computed since the snapshot prev, if not nil. It returns the snapshot
+// shown.
+func showStats(stats *trace.StatsTracer, prev *trace.StatsSnapshot) *trace.StatsSnapshot {
+	snap := stats.Snapshot()
+	out := bufio.NewWriter(os.Stdout)
+	out.WriteString(clearScreen)
+	snap.WriteTable(out, prev, statsTopEntries)
+	out.Flush()
+	return snap
+}
+
+// dumpStats writes the statistics as a JSON object in a single line,
+// appended to the file at dest, to the standard output if dest is "-" or
+// to the standard error if dest is empty
+func dumpStats(stats *trace.StatsTracer, dest string) {
+	b, err := json.Marshal(stats.Snapshot())
+	if err != nil {
+		errlog.Printf("could not format statistics [%s]", err)
+		return
+	}
+	out := os.Stderr
+	if dest == "-" {
+		out = os.Stdout
+	} else if len(dest) > 0 {
+		out, err = os.OpenFile(dest, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
+		if err != nil {
+			errlog.Printf("could not open file '%s' for writing [%s]", dest, err)
+			return
+		}
+		defer out.Close()
+	}
+	if _, err = out.Write(append(b, '\n')); err != nil {
+		errlog.Printf("could not write statistics [%s]", err)
+	}
+}
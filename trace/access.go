@@ -1,14 +1,4 @@
-// +build linux darwin
-package main
-
-/*
-#include <unistd.h>
-*/
-import "C"
-
-func access(path string, mode uint32) bool {
-	return C.access(C.CString(path), C.int(mode)) == 0
-}
+package trace
 
 var accessModeMap = map[uint32]string{
 	// See: <unistd.h> for these values
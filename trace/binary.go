@@ -0,0 +1,693 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// The binary format is a sequence of records, each one made of its length
+// in bytes as an unsigned varint followed by that many bytes: a byte with
+// the kind of record and its payload. The payload is made of the values
+// below, in the order given by binaryOps for the fields specific to each
+// type of operation:
+//
+//   unsigned integers   unsigned varint
+//   signed integers     signed (zig-zag) varint
+//   booleans            one byte, 0 or 1
+//   time stamps         signed varint seconds since the Unix epoch, followed
+//                       by unsigned varint nanoseconds
+//   optional values     one byte, 0 if absent, followed by the value
+//   strings             unsigned varint reference into the string table of
+//                       the stream: 0 means the string follows, as its
+//                       length and its bytes, and is added to the table
+//                       with the next index, starting at 1
+//
+// A stream starts with a header record, which also clears the string table,
+// so that each stream may be decoded on its own. See doc/EventFormats.md
+// for details.
+
+// Kinds of records of the binary format
+const (
+	binStream byte = 1 + iota // a StreamInfo
+	binEvent                  // an FsOperTracer
+	binReset                  // the string table is cleared
+)
+
+// binMagic starts the payload of every header record
+const binMagic = "cluefs"
+
+// binMaxStrings is the maximum number of entries of the string table. When
+// it is full, the table is cleared by a reset record.
+const binMaxStrings = 1 << 16
+
+// zeroUnix is the time in seconds since the Unix epoch of the zero time.Time
+var zeroUnix = time.Time{}.Unix()
+
+// binaryEncoder encodes records in the binary format
+type binaryEncoder struct {
+	payload bytes.Buffer
+	strings map[string]uint64
+	varint  [binary.MaxVarintLen64]byte
+}
+
+func newBinaryEncoder() *binaryEncoder {
+	return &binaryEncoder{strings: make(map[string]uint64, 1024)}
+}
+
+func (e *binaryEncoder) putUvarint(v uint64) {
+	n := binary.PutUvarint(e.varint[:], v)
+	e.payload.Write(e.varint[:n])
+}
+
+func (e *binaryEncoder) putVarint(v int64) {
+	n := binary.PutVarint(e.varint[:], v)
+	e.payload.Write(e.varint[:n])
+}
+
+func (e *binaryEncoder) putBool(v bool) {
+	if v {
+		e.payload.WriteByte(1)
+	} else {
+		e.payload.WriteByte(0)
+	}
+}
+
+func (e *binaryEncoder) putTime(t time.Time) {
+	e.putVarint(t.Unix())
+	e.putUvarint(uint64(t.Nanosecond()))
+}
+
+// putRawString writes a string which is not added to the string table
+func (e *binaryEncoder) putRawString(s string) {
+	e.putUvarint(uint64(len(s)))
+	e.payload.WriteString(s)
+}
+
+func (e *binaryEncoder) putString(s string) {
+	if id, ok := e.strings[s]; ok {
+		e.putUvarint(id)
+		return
+	}
+	e.putUvarint(0)
+	e.putRawString(s)
+	e.strings[s] = uint64(len(e.strings) + 1)
+}
+
+// writeRecord writes the record of the given kind which payload has been
+// encoded so far
+func (e *binaryEncoder) writeRecord(w io.Writer, kind byte) error {
+	n := binary.PutUvarint(e.varint[:], uint64(e.payload.Len()+1))
+	record := make([]byte, 0, n+1+e.payload.Len())
+	record = append(record, e.varint[:n]...)
+	record = append(record, kind)
+	record = append(record, e.payload.Bytes()...)
+	e.payload.Reset()
+	_, err := w.Write(record)
+	return err
+}
+
+func (e *binaryEncoder) encodeInfo(w io.Writer, info *StreamInfo) error {
+	e.strings = make(map[string]uint64, 1024)
+	e.payload.WriteString(binMagic)
+	e.putUvarint(uint64(info.Schema))
+	e.putRawString(info.Version)
+	e.putRawString(info.MountDir)
+	e.putRawString(info.ShadowDir)
+	e.putRawString(info.Host)
+	e.putTime(info.Start)
+	return e.writeRecord(w, binStream)
+}
+
+func (e *binaryEncoder) encodeEvent(w io.Writer, op FsOperTracer) error {
+	if len(e.strings) >= binMaxStrings {
+		e.strings = make(map[string]uint64, 1024)
+		if err := e.writeRecord(w, binReset); err != nil {
+			return err
+		}
+	}
+	h := op.GetHeader()
+	codec, ok := binaryOps[h.OperType]
+	if !ok {
+		return fmt.Errorf("cannot encode operation of type %s", h.OperType)
+	}
+	names := h.procNames()
+	e.putUvarint(uint64(h.OperType))
+	e.putUvarint(uint64(h.Uid))
+	e.putUvarint(uint64(h.Gid))
+	e.putUvarint(uint64(h.Pid))
+	e.putString(names.usr)
+	e.putString(names.grp)
+	e.putString(names.proc)
+	e.putTime(h.Start)
+	e.putVarint(int64(h.Duration()))
+	e.putString(h.Path)
+	e.putBool(h.IsDir)
+	e.putUvarint(uint64(h.Errno))
+	e.putBool(h.Injected)
+	e.putVarint(int64(h.Delay))
+
+	// The operation specific fields follow the header
+	codec.encode(e, op)
+	return e.writeRecord(w, binEvent)
+}
+
+// BinaryTracer writes the events in a compact binary format, which can
+// be converted into CSV or JSON with a BinaryDecoder
+type BinaryTracer struct {
+	*collector
+	writer  *bufio.Writer
+	encoder *binaryEncoder
+	closer  io.Closer
+}
+
+// NewBinaryTracer creates a tracer which writes each event to w in binary
+// format. If info is not nil, it is written first.
+func NewBinaryTracer(w io.Writer, info *StreamInfo, opts QueueOptions) *BinaryTracer {
+	tracer := &BinaryTracer{
+		writer:  bufio.NewWriterSize(w, 64*1024),
+		encoder: newBinaryEncoder(),
+	}
+	// Start the event collector
+	tracer.collector = newCollector(opts, info, tracer, w)
+	return tracer
+}
+
+func (t *BinaryTracer) writeInfo(info *StreamInfo) error {
+	return t.encoder.encodeInfo(t.writer, info)
+}
+
+func (t *BinaryTracer) write(op FsOperTracer) error {
+	return t.encoder.encodeEvent(t.writer, op)
+}
+
+func (t *BinaryTracer) flush() error {
+	return t.writer.Flush()
+}
+
+func (t *BinaryTracer) Trace(op FsOperTracer) {
+	t.put(op)
+}
+
+func (t *BinaryTracer) Close() error {
+	return closeDestination(t.close(), t.closer)
+}
+
+// BinaryDecoder reads records in the binary format
+type BinaryDecoder struct {
+	reader  *bufio.Reader
+	payload *bytes.Reader
+	strings []string
+	started bool
+
+	// err is the error found when decoding the current record
+	err error
+}
+
+func NewBinaryDecoder(r io.Reader) *BinaryDecoder {
+	return &BinaryDecoder{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next record of the stream, which is either a *StreamInfo
+// or an FsOperTracer. It returns io.EOF at the end of the stream.
+func (d *BinaryDecoder) Next() (interface{}, error) {
+	for {
+		length, err := binary.ReadUvarint(d.reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("could not read record length [%s]", err)
+		}
+		if length == 0 || length > 1<<24 {
+			return nil, fmt.Errorf("invalid record length %d", length)
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(d.reader, record); err != nil {
+			return nil, fmt.Errorf("truncated record [%s]", err)
+		}
+		d.payload, d.err = bytes.NewReader(record[1:]), nil
+		kind := record[0]
+		if !d.started && kind != binStream {
+			return nil, fmt.Errorf("not a cluefs binary trace")
+		}
+		switch kind {
+		case binStream:
+			d.started = true
+			return d.decodeInfo()
+		case binEvent:
+			return d.decodeEvent()
+		case binReset:
+			d.strings = d.strings[:0]
+		}
+		// Records of unknown kinds are skipped
+	}
+}
+
+// fail records the first error found when decoding the payload of a
+// record. Once an error is found, decoding yields zero values.
+func (d *BinaryDecoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+	d.payload.Seek(0, io.SeekEnd)
+}
+
+func (d *BinaryDecoder) uvarint() uint64 {
+	v, err := binary.ReadUvarint(d.payload)
+	if err != nil {
+		d.fail("invalid record [%s]", err)
+	}
+	return v
+}
+
+func (d *BinaryDecoder) varint() int64 {
+	v, err := binary.ReadVarint(d.payload)
+	if err != nil {
+		d.fail("invalid record [%s]", err)
+	}
+	return v
+}
+
+func (d *BinaryDecoder) bool() bool {
+	b, err := d.payload.ReadByte()
+	if err != nil {
+		d.fail("invalid record [%s]", err)
+	}
+	return b != 0
+}
+
+func (d *BinaryDecoder) time() time.Time {
+	sec := d.varint()
+	nsec := d.uvarint()
+	if sec == zeroUnix && nsec == 0 {
+		// Unset time stamps are decoded as such
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+func (d *BinaryDecoder) rawString() string {
+	n := d.uvarint()
+	if n > uint64(d.payload.Len()) {
+		d.fail("invalid record: string of %d bytes", n)
+		return ""
+	}
+	b := make([]byte, n)
+	d.payload.Read(b)
+	return string(b)
+}
+
+func (d *BinaryDecoder) string() string {
+	id := d.uvarint()
+	if id == 0 {
+		s := d.rawString()
+		d.strings = append(d.strings, s)
+		return s
+	}
+	if id > uint64(len(d.strings)) {
+		d.fail("invalid record: unknown string %d", id)
+		return ""
+	}
+	return d.strings[id-1]
+}
+
+func (d *BinaryDecoder) decodeInfo() (*StreamInfo, error) {
+	magic := make([]byte, len(binMagic))
+	if n, _ := d.payload.Read(magic); n != len(magic) || string(magic) != binMagic {
+		return nil, fmt.Errorf("not a cluefs binary trace")
+	}
+	d.strings = d.strings[:0]
+	info := &StreamInfo{Schema: int(d.uvarint())}
+	if d.err == nil && info.Schema > SchemaVersion {
+		return nil, fmt.Errorf("trace has schema version %d, only versions up to %d are supported", info.Schema, SchemaVersion)
+	}
+	info.Version = d.rawString()
+	info.MountDir = d.rawString()
+	info.ShadowDir = d.rawString()
+	info.Host = d.rawString()
+	info.Start = d.time()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return info, nil
+}
+
+func (d *BinaryDecoder) decodeEvent() (FsOperTracer, error) {
+	t := FSOperType(d.uvarint())
+	codec, ok := binaryOps[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation type %d", t)
+	}
+	op := newOp(t)
+	h := op.GetHeader()
+	h.Uid = uint32(d.uvarint())
+	h.Gid = uint32(d.uvarint())
+	h.Pid = uint32(d.uvarint())
+	h.names = knownNames(d.string(), d.string(), d.string())
+	h.Start = d.time()
+	h.End = h.Start.Add(time.Duration(d.varint()))
+	h.Path = d.string()
+	h.IsDir = d.bool()
+	h.Errno = syscall.Errno(d.uvarint())
+	h.Injected = d.bool()
+	h.Delay = time.Duration(d.varint())
+	codec.decode(d, op)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return op, nil
+}
+
+// binaryCodec encodes and decodes the values specific to a type of
+// operation, which follow the common header of its events
+type binaryCodec struct {
+	encode func(e *binaryEncoder, op FsOperTracer)
+	decode func(d *BinaryDecoder, op FsOperTracer)
+}
+
+// binaryOps lists explicitly the values specific to each type of operation,
+// in the order they are encoded. It must not depend on the layout of the Go
+// structures, which may change.
+var binaryOps = map[FSOperType]binaryCodec{
+	FsOpen: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*OpenOp)
+			e.putUvarint(uint64(o.Flags))
+			e.putUvarint(uint64(o.Perm))
+			e.putUvarint(o.FileSize)
+			e.putUvarint(uint64(o.BlockSize))
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*OpenOp)
+			o.Flags = fuse.OpenFlags(d.uvarint())
+			o.Perm = os.FileMode(d.uvarint())
+			o.FileSize = d.uvarint()
+			o.BlockSize = uint32(d.uvarint())
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsRead: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*ReadOp)
+			e.putUvarint(o.FileSize)
+			e.putVarint(o.Offset)
+			e.putVarint(int64(o.Size))
+			e.putVarint(int64(o.BytesRead))
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*ReadOp)
+			o.FileSize = d.uvarint()
+			o.Offset = d.varint()
+			o.Size = int(d.varint())
+			o.BytesRead = int(d.varint())
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsWrite: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*WriteOp)
+			e.putVarint(o.Offset)
+			e.putVarint(int64(o.Size))
+			e.putVarint(int64(o.BytesWritten))
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*WriteOp)
+			o.Offset = d.varint()
+			o.Size = int(d.varint())
+			o.BytesWritten = int(d.varint())
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsFlush: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*FlushOp)
+			e.putUvarint(uint64(o.Flags))
+			e.putUvarint(o.FileSize)
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*FlushOp)
+			o.Flags = fuse.OpenFlags(d.uvarint())
+			o.FileSize = d.uvarint()
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsRelease: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*ReleaseOp)
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*ReleaseOp)
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsMkdir: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*MkdirOp)
+			e.putUvarint(uint64(o.Mode))
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*MkdirOp)
+			o.Mode = os.FileMode(d.uvarint())
+		},
+	},
+	FsRemove: {
+		func(e *binaryEncoder, op FsOperTracer) {},
+		func(d *BinaryDecoder, op FsOperTracer) {},
+	},
+	FsCreate: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*CreateOp)
+			e.putUvarint(uint64(o.Flags))
+			e.putUvarint(uint64(o.Mode))
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*CreateOp)
+			o.Flags = fuse.OpenFlags(d.uvarint())
+			o.Mode = os.FileMode(d.uvarint())
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsSymlink: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*SymlinkOp)
+			e.putString(o.Target)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*SymlinkOp)
+			o.Target = d.string()
+		},
+	},
+	FsStat: {
+		func(e *binaryEncoder, op FsOperTracer) {},
+		func(d *BinaryDecoder, op FsOperTracer) {},
+	},
+	FsReadDir: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*ReadDirOp)
+			e.putUvarint(o.OpenID)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*ReadDirOp)
+			o.OpenID = d.uvarint()
+		},
+	},
+	FsStatfs: {
+		func(e *binaryEncoder, op FsOperTracer) {},
+		func(d *BinaryDecoder, op FsOperTracer) {},
+	},
+	FsRename: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*RenameOp)
+			e.putString(o.NewPath)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*RenameOp)
+			o.NewPath = d.string()
+		},
+	},
+	FsReadLink: {
+		func(e *binaryEncoder, op FsOperTracer) {},
+		func(d *BinaryDecoder, op FsOperTracer) {},
+	},
+	FsAccess: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*AccessOp)
+			e.putUvarint(uint64(o.Mask))
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*AccessOp)
+			o.Mask = uint32(d.uvarint())
+		},
+	},
+	FsSetAttr: {encodeSetattrBinary, decodeSetattrBinary},
+	FsListXattr: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*ListxattrOp)
+			e.putUvarint(uint64(o.Size))
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*ListxattrOp)
+			o.Size = uint32(d.uvarint())
+		},
+	},
+	FsGetXattr: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*GetxattrOp)
+			e.putString(o.AttrName)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*GetxattrOp)
+			o.AttrName = d.string()
+		},
+	},
+	FsRemoveXattr: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*RemovexattrOp)
+			e.putString(o.AttrName)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*RemovexattrOp)
+			o.AttrName = d.string()
+		},
+	},
+	FsSetXattr: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*SetxattrOp)
+			e.putString(o.AttrName)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*SetxattrOp)
+			o.AttrName = d.string()
+		},
+	},
+	FsLost: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*LostOp)
+			e.putUvarint(o.Count)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*LostOp)
+			o.Count = d.uvarint()
+		},
+	},
+	FsLink: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*LinkOp)
+			e.putString(o.NewPath)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*LinkOp)
+			o.NewPath = d.string()
+		},
+	},
+	FsMknod: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*MknodOp)
+			e.putUvarint(uint64(o.Mode))
+			e.putUvarint(uint64(o.Rdev))
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*MknodOp)
+			o.Mode = os.FileMode(d.uvarint())
+			o.Rdev = uint32(d.uvarint())
+		},
+	},
+	FsFsync: {
+		func(e *binaryEncoder, op FsOperTracer) {
+			o := op.(*FsyncOp)
+			e.putBool(o.DataSync)
+		},
+		func(d *BinaryDecoder, op FsOperTracer) {
+			o := op.(*FsyncOp)
+			o.DataSync = d.bool()
+		},
+	},
+}
+
+func encodeSetattrBinary(e *binaryEncoder, op FsOperTracer) {
+	o := op.(*SetattrOp)
+	e.putUvarint(uint64(o.AttrValid))
+	e.putUvarint(o.Size)
+	e.putUvarint(uint64(o.Mode))
+	e.putUvarint(uint64(o.Uid))
+	e.putUvarint(uint64(o.Gid))
+	e.putTime(o.Atime)
+	e.putTime(o.Mtime)
+	e.putUvarint(o.Handle)
+	e.putBool(o.Previous != nil)
+	if o.Previous != nil {
+		e.putAttr(o.Previous)
+	}
+	e.putUvarint(uint64(o.Applied))
+	e.putUvarint(uint64(o.Failed))
+}
+
+func decodeSetattrBinary(d *BinaryDecoder, op FsOperTracer) {
+	o := op.(*SetattrOp)
+	o.AttrValid = fuse.SetattrValid(d.uvarint())
+	o.Size = d.uvarint()
+	o.Mode = os.FileMode(d.uvarint())
+	o.Uid = uint32(d.uvarint())
+	o.Gid = uint32(d.uvarint())
+	o.Atime = d.time()
+	o.Mtime = d.time()
+	o.Handle = d.uvarint()
+	if d.bool() {
+		o.Previous = d.attr()
+	}
+	o.Applied = fuse.SetattrValid(d.uvarint())
+	o.Failed = fuse.SetattrValid(d.uvarint())
+}
+
+// putAttr writes the attributes of a file, field by field
+func (e *binaryEncoder) putAttr(o *fuse.Attr) {
+	e.putVarint(int64(o.Valid))
+	e.putUvarint(o.Inode)
+	e.putUvarint(o.Size)
+	e.putUvarint(o.Blocks)
+	e.putTime(o.Atime)
+	e.putTime(o.Mtime)
+	e.putTime(o.Ctime)
+	e.putTime(o.Crtime)
+	e.putUvarint(uint64(o.Mode))
+	e.putUvarint(uint64(o.Nlink))
+	e.putUvarint(uint64(o.Uid))
+	e.putUvarint(uint64(o.Gid))
+	e.putUvarint(uint64(o.Rdev))
+	e.putUvarint(uint64(o.Flags))
+	e.putUvarint(uint64(o.BlockSize))
+}
+
+func (d *BinaryDecoder) attr() *fuse.Attr {
+	o := &fuse.Attr{}
+	o.Valid = time.Duration(d.varint())
+	o.Inode = d.uvarint()
+	o.Size = d.uvarint()
+	o.Blocks = d.uvarint()
+	o.Atime = d.time()
+	o.Mtime = d.time()
+	o.Ctime = d.time()
+	o.Crtime = d.time()
+	o.Mode = os.FileMode(d.uvarint())
+	o.Nlink = uint32(d.uvarint())
+	o.Uid = uint32(d.uvarint())
+	o.Gid = uint32(d.uvarint())
+	o.Rdev = uint32(d.uvarint())
+	o.Flags = uint32(d.uvarint())
+	o.BlockSize = uint32(d.uvarint())
+	return o
+}
@@ -0,0 +1,206 @@
+package trace
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// testTime is the start of the operations of the tests. Time stamps are
+// built with time.Unix, as the decoders do, so that they compare equal.
+var testTime = time.Unix(1427103948, 615390733)
+
+// testHeader returns a header for an operation of type t, with its names
+// resolved so that no lookup is made
+func testHeader(t FSOperType, path string) Header {
+	return Header{
+		ProcessInfo: ProcessInfo{Uid: 9986, Gid: 1021, Pid: 22902},
+		OperType:    t,
+		Start:       testTime,
+		End:         testTime.Add(32024),
+		Path:        path,
+		names:       knownNames("fabio", "lsst", "/usr/bin/bash"),
+	}
+}
+
+// testOps returns an operation of each type, with non zero values in all
+// its fields
+func testOps() []FsOperTracer {
+	prev := &fuse.Attr{
+		Valid:     time.Second,
+		Inode:     1234,
+		Size:      4096,
+		Blocks:    8,
+		Atime:     time.Unix(1427100000, 1),
+		Mtime:     time.Unix(1427100001, 2),
+		Ctime:     time.Unix(1427100002, 3),
+		Crtime:    time.Unix(1427100003, 4),
+		Mode:      0640,
+		Nlink:     2,
+		Uid:       9986,
+		Gid:       1021,
+		Rdev:      5,
+		Flags:     6,
+		BlockSize: 4096,
+	}
+	failed := testHeader(FsOpen, "/data/denied")
+	failed.Errno = syscall.EACCES
+	failed.Injected = true
+	failed.Delay = 20 * time.Millisecond
+	return []FsOperTracer{
+		&OpenOp{Header: testHeader(FsOpen, "/data/file"), Flags: fuse.OpenReadWrite | fuse.OpenAppend, Perm: 0644, FileSize: 4096, BlockSize: 512, OpenID: 7},
+		&OpenOp{Header: failed, Flags: fuse.OpenReadOnly},
+		&ReadOp{Header: testHeader(FsRead, "/data/file"), FileSize: 4096, Offset: 1024, Size: 2048, BytesRead: -1, OpenID: 7},
+		&WriteOp{Header: testHeader(FsWrite, "/data/file"), Offset: 4096, Size: 100, BytesWritten: 50, OpenID: 7},
+		&FlushOp{Header: testHeader(FsFlush, "/data/file"), Flags: fuse.OpenWriteOnly, FileSize: 4146, OpenID: 7},
+		&ReleaseOp{Header: testHeader(FsRelease, "/data/file"), OpenID: 7},
+		&MkdirOp{Header: testHeader(FsMkdir, "/data/dir"), Mode: os.ModeDir | 0755},
+		&RemoveOp{Header: testHeader(FsRemove, "/data/old")},
+		&CreateOp{Header: testHeader(FsCreate, "/data/new"), Flags: fuse.OpenWriteOnly | fuse.OpenCreate | fuse.OpenExclusive, Mode: 0600, OpenID: 8},
+		&SymlinkOp{Header: testHeader(FsSymlink, "/data/link"), Target: "file"},
+		&LookupOp{Header: testHeader(FsStat, "/data/file")},
+		&ReadDirOp{Header: testHeader(FsReadDir, "/data"), OpenID: 9},
+		&StatFsOp{Header: testHeader(FsStatfs, "/data")},
+		&RenameOp{Header: testHeader(FsRename, "/data/new"), NewPath: "/data/renamed"},
+		&ReadlinkOp{Header: testHeader(FsReadLink, "/data/link")},
+		&AccessOp{Header: testHeader(FsAccess, "/data/file"), Mask: 6},
+		&SetattrOp{
+			Header:    testHeader(FsSetAttr, "/data/file"),
+			AttrValid: fuse.SetattrSize | fuse.SetattrMode | fuse.SetattrUid | fuse.SetattrGid | fuse.SetattrAtime | fuse.SetattrMtime | fuse.SetattrHandle,
+			Size:      10,
+			Mode:      0600,
+			Uid:       1,
+			Gid:       2,
+			Atime:     time.Unix(1427103000, 5),
+			Mtime:     time.Unix(1427103001, 6),
+			Handle:    7,
+			Previous:  prev,
+			Applied:   fuse.SetattrSize | fuse.SetattrMode | fuse.SetattrAtime | fuse.SetattrMtime | fuse.SetattrHandle,
+			Failed:    fuse.SetattrUid | fuse.SetattrGid,
+		},
+		&SetattrOp{Header: testHeader(FsSetAttr, "/data/other"), AttrValid: fuse.SetattrMode, Mode: 0644, Applied: fuse.SetattrMode},
+		&ListxattrOp{Header: testHeader(FsListXattr, "/data/file"), Size: 256},
+		&GetxattrOp{Header: testHeader(FsGetXattr, "/data/file"), AttrName: "user.comment"},
+		&RemovexattrOp{Header: testHeader(FsRemoveXattr, "/data/file"), AttrName: "user.comment"},
+		&SetxattrOp{Header: testHeader(FsSetXattr, "/data/file"), AttrName: "user.comment"},
+		&LostOp{Header: testHeader(FsLost, ""), Count: 42},
+		&LinkOp{Header: testHeader(FsLink, "/data/file"), NewPath: "/data/hardlink"},
+		&MknodOp{Header: testHeader(FsMknod, "/data/fifo"), Mode: os.ModeNamedPipe | 0644, Rdev: 3},
+		&FsyncOp{Header: testHeader(FsFsync, "/data/file"), DataSync: true},
+	}
+}
+
+func TestTestOpsCoverAllTypes(t *testing.T) {
+	seen := make(map[FSOperType]bool)
+	for _, op := range testOps() {
+		seen[op.GetHeader().OperType] = true
+	}
+	for typ := range opFactories {
+		if !seen[typ] {
+			t.Errorf("no test operation of type %s", typ)
+		}
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	info := &StreamInfo{
+		Schema:    SchemaVersion,
+		Version:   "v0.5",
+		MountDir:  "/tmp/trace",
+		ShadowDir: "/data",
+		Host:      "lsst01",
+		Start:     testTime,
+	}
+	for _, op := range testOps() {
+		var buf bytes.Buffer
+		e := newBinaryEncoder()
+		if err := e.encodeInfo(&buf, info); err != nil {
+			t.Fatalf("encodeInfo: %s", err)
+		}
+		// Encode the event twice so that its strings are also decoded
+		// from the string table
+		for i := 0; i < 2; i++ {
+			if err := e.encodeEvent(&buf, op); err != nil {
+				t.Fatalf("encodeEvent(%s): %s", op.GetHeader().OperType, err)
+			}
+		}
+		d := NewBinaryDecoder(&buf)
+		rec, err := d.Next()
+		if err != nil {
+			t.Fatalf("decoding header: %s", err)
+		}
+		if !reflect.DeepEqual(rec, info) {
+			t.Errorf("header: got %+v, want %+v", rec, info)
+		}
+		for i := 0; i < 2; i++ {
+			rec, err = d.Next()
+			if err != nil {
+				t.Fatalf("decoding %s: %s", op.GetHeader().OperType, err)
+			}
+			if !reflect.DeepEqual(rec, op) {
+				t.Errorf("%s: got %+v, want %+v", op.GetHeader().OperType, rec, op)
+			}
+		}
+		if _, err = d.Next(); err != io.EOF {
+			t.Errorf("%s: got %v at end of stream, want EOF", op.GetHeader().OperType, err)
+		}
+	}
+}
+
+// zeroTime is the encoding of the zero time.Time: -62135596800 seconds as
+// a signed varint followed by 0 nanoseconds
+var zeroTime = []byte{0xff, 0xdb, 0x8f, 0xf9, 0xce, 0x03, 0}
+
+// TestBinaryLayout checks the encoding of the events against records
+// encoded by hand, so that the traces already written remain readable
+func TestBinaryLayout(t *testing.T) {
+	tests := []struct {
+		op      FsOperTracer
+		payload []byte
+	}{
+		{
+			&ReleaseOp{Header: testHeader(FsRelease, "/f"), OpenID: 7},
+			[]byte{7},
+		},
+		{
+			&WriteOp{Header: testHeader(FsWrite, "/f"), Offset: 1, Size: 2, BytesWritten: -1, OpenID: 300},
+			[]byte{2, 4, 1, 0xac, 0x02},
+		},
+		{
+			&FsyncOp{Header: testHeader(FsFsync, "/f"), DataSync: true},
+			[]byte{1},
+		},
+		{
+			&SetattrOp{Header: testHeader(FsSetAttr, "/f"), AttrValid: fuse.SetattrSize, Size: 3, Applied: fuse.SetattrSize},
+			join([]byte{8, 3, 0, 0, 0}, zeroTime, zeroTime, []byte{0, 0, 8, 0}),
+		},
+	}
+	for _, test := range tests {
+		// The record of the same event without specific values gives the
+		// expected encoding of the header
+		h := *test.op.GetHeader()
+		h.OperType = FsStat
+		var hdr, got bytes.Buffer
+		newBinaryEncoder().encodeEvent(&hdr, &LookupOp{Header: h})
+		if err := newBinaryEncoder().encodeEvent(&got, test.op); err != nil {
+			t.Fatalf("encodeEvent(%s): %s", test.op.GetHeader().OperType, err)
+		}
+		want := append([]byte(nil), hdr.Bytes()...)
+		want[0] += byte(len(test.payload))
+		want[2] = byte(test.op.GetHeader().OperType)
+		want = append(want, test.payload...)
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s: got % x, want % x", test.op.GetHeader().OperType, got.Bytes(), want)
+		}
+	}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
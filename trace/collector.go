@@ -0,0 +1,339 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy specifies what a tracer does with a new event when its
+// queue of events waiting to be written is full
+type OverflowPolicy uint32
+
+const (
+	// PolicyBlock makes the file system operation wait until there is
+	// room in the queue
+	PolicyBlock OverflowPolicy = iota
+
+	// PolicyDropNewest discards the new event
+	PolicyDropNewest
+
+	// PolicyDropOldest discards the oldest event in the queue to make room
+	// for the new one
+	PolicyDropOldest
+
+	// PolicySample queues only one out of every QueueOptions.SampleRate
+	// events when the queue is more than half full, and discards the new
+	// event when the queue is full
+	PolicySample
+)
+
+var policyNames = map[OverflowPolicy]string{
+	PolicyBlock:      "block",
+	PolicyDropNewest: "drop-newest",
+	PolicyDropOldest: "drop-oldest",
+	PolicySample:     "sample",
+}
+
+func (p OverflowPolicy) String() string {
+	if n, ok := policyNames[p]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// ParseOverflowPolicy parses a policy name such as "drop-newest". The name
+// "sample" may be followed by ':' and the sampling rate, e.g. "sample:10",
+// which is returned as the second value or zero if not specified.
+func ParseOverflowPolicy(s string) (OverflowPolicy, int, error) {
+	name, rate := s, 0
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name = s[:i]
+		n, err := strconv.ParseUint(s[i+1:], 10, 31)
+		if name != policyNames[PolicySample] || err != nil || n == 0 {
+			return 0, 0, fmt.Errorf("invalid overflow policy '%s'", s)
+		}
+		rate = int(n)
+	}
+	for p, n := range policyNames {
+		if n == name {
+			return p, rate, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unknown overflow policy '%s'", s)
+}
+
+// QueueOptions holds the settings of the queue of events a tracer keeps
+// before writing them. The zero value selects the defaults.
+type QueueOptions struct {
+	// Size is the maximum number of events in the queue. Default: 1024
+	Size int
+
+	// Policy is what to do with new events when the queue is full.
+	// Default: PolicyBlock
+	Policy OverflowPolicy
+
+	// SampleRate is the sampling rate used by PolicySample. Default: 10
+	SampleRate int
+
+	// LostInterval is the period at which a 'lost' record with the number
+	// of events dropped since the previous one is written. Default: 10s
+	LostInterval time.Duration
+}
+
+func (o *QueueOptions) setDefaults() {
+	if o.Size <= 0 {
+		o.Size = 1024
+	}
+	if o.SampleRate <= 0 {
+		o.SampleRate = 10
+	}
+	if o.LostInterval <= 0 {
+		o.LostInterval = 10 * time.Second
+	}
+}
+
+// collector buffers the events received by a tracer and hands them over,
+// in order, to a single goroutine which formats and writes them
+type collector struct {
+	opts QueueOptions
+
+	// mutex protects closed and the send operations on the events channel
+	mutex  sync.RWMutex
+	closed bool
+	events chan FsOperTracer
+
+	// done is closed when all the queued events have been written
+	done chan struct{}
+
+	// dropped counts the events discarded because the queue was full and
+	// sampled counts the events seen under PolicySample while the queue
+	// was more than half full
+	dropped uint64
+	sampled uint64
+
+	// reported is the number of dropped events already written in a 'lost'
+	// record and lastReport is when that record was written
+	reported   uint64
+	lastReport time.Time
+
+	// late counts the events received after the collector was closed
+	late uint64
+
+	// failed counts the records which could not be written and err is
+	// the first error found when writing them
+	failed uint64
+	err    error
+
+	// rot, if not nil, splits the destination into several files, each one
+	// starting with info. segmentEvents counts the events written to the
+	// current file.
+	rot           rotator
+	info          *StreamInfo
+	segmentEvents uint64
+}
+
+// QueueReporter is implemented by the tracers which queue the events before
+// writing them
+type QueueReporter interface {
+	QueueLength() int
+	Dropped() uint64
+}
+
+// recordWriter formats and writes the records of a tracer. Records may be
+// buffered until flush is called, which the collector does each time its
+// queue is empty, unless the writer is also a batchWriter.
+type recordWriter interface {
+	writeInfo(info *StreamInfo) error
+	write(op FsOperTracer) error
+	flush() error
+}
+
+// batchWriter is implemented by the record writers which export records in
+// batches, at a cost for each one. The collector flushes them periodically,
+// every batchDelay, instead of each time its queue is empty.
+type batchWriter interface {
+	batchDelay() time.Duration
+}
+
+// newCollector starts the goroutine which writes the events. If info is not
+// nil, it is written before any event. If dest, the destination w writes
+// to, is split into several files, info is also written at the beginning
+// of each one of them.
+func newCollector(opts QueueOptions, info *StreamInfo, w recordWriter, dest io.Writer) *collector {
+	opts.setDefaults()
+	c := &collector{
+		opts:       opts,
+		events:     make(chan FsOperTracer, opts.Size),
+		done:       make(chan struct{}),
+		lastReport: time.Now(),
+		info:       info,
+	}
+	c.rot, _ = dest.(rotator)
+	go func() {
+		defer close(c.done)
+		if info != nil {
+			c.record(w.writeInfo(info))
+			c.record(w.flush())
+		}
+		ticker := time.NewTicker(opts.LostInterval)
+		defer ticker.Stop()
+		var batchTick <-chan time.Time
+		if bw, ok := w.(batchWriter); ok {
+			batchTicker := time.NewTicker(bw.batchDelay())
+			defer batchTicker.Stop()
+			batchTick = batchTicker.C
+		}
+		for {
+			select {
+			case op, ok := <-c.events:
+				if !ok {
+					c.reportLost(w)
+					c.record(w.flush())
+					return
+				}
+				c.rotate(w)
+				c.record(w.write(op))
+				c.segmentEvents++
+				if len(c.events) == 0 && batchTick == nil {
+					c.record(w.flush())
+				}
+			case <-batchTick:
+				c.record(w.flush())
+			case <-ticker.C:
+				rotated := c.rotate(w)
+				if c.reportLost(w) || rotated {
+					c.record(w.flush())
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// record accounts for the result of writing a record
+func (c *collector) record(err error) {
+	if err != nil {
+		if c.failed == 0 {
+			c.err = err
+		}
+		c.failed++
+	}
+}
+
+// rotate starts a new file, if the destination is split into several ones
+// and the current one is due for rotation. Files are only rotated between
+// records, once all the records written so far are flushed, and only if
+// they hold at least one event. It returns true if a new file was started.
+func (c *collector) rotate(w recordWriter) bool {
+	if c.rot == nil || c.segmentEvents == 0 || !c.rot.due(time.Now()) {
+		return false
+	}
+	c.record(w.flush())
+	if err := c.rot.rotate(); err != nil {
+		// Try again before writing the next record
+		c.record(err)
+		return false
+	}
+	c.segmentEvents = 0
+	if c.info != nil {
+		c.record(w.writeInfo(c.info))
+	}
+	return true
+}
+
+// reportLost writes a 'lost' record if events were dropped since the
+// previous one. It returns true if it wrote a record.
+func (c *collector) reportLost(w recordWriter) bool {
+	dropped := atomic.LoadUint64(&c.dropped)
+	if dropped == c.reported {
+		return false
+	}
+	c.record(w.write(NewLostOp(dropped-c.reported, c.lastReport)))
+	c.reported, c.lastReport = dropped, time.Now()
+	return true
+}
+
+// put queues an event for writing according to the overflow policy.
+// Events received once the collector is closed are discarded.
+func (c *collector) put(op FsOperTracer) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		atomic.AddUint64(&c.late, 1)
+		return
+	}
+	switch c.opts.Policy {
+	case PolicyBlock:
+		c.events <- op
+		return
+	case PolicyDropOldest:
+		for {
+			select {
+			case c.events <- op:
+				return
+			default:
+			}
+			// Make room by discarding the oldest event, unless the
+			// writer goroutine got it first
+			select {
+			case <-c.events:
+				atomic.AddUint64(&c.dropped, 1)
+			default:
+			}
+		}
+	case PolicySample:
+		if len(c.events) > cap(c.events)/2 {
+			if atomic.AddUint64(&c.sampled, 1)%uint64(c.opts.SampleRate) != 0 {
+				atomic.AddUint64(&c.dropped, 1)
+				return
+			}
+		}
+	}
+	select {
+	case c.events <- op:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events discarded so far because the
+// queue was full
+func (c *collector) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// QueueLength returns the number of events waiting to be written
+func (c *collector) QueueLength() int {
+	return len(c.events)
+}
+
+// close stops accepting new events and waits until all the queued ones
+// are written. It returns an error if some events were not written.
+func (c *collector) close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.events)
+	}
+	c.mutex.Unlock()
+	<-c.done
+	problems := make([]string, 0, 3)
+	if dropped := atomic.LoadUint64(&c.dropped); dropped > 0 {
+		problems = append(problems, fmt.Sprintf("%d events were dropped because the queue was full", dropped))
+	}
+	if c.failed > 0 {
+		problems = append(problems, fmt.Sprintf("could not write %d records [%s]", c.failed, c.err))
+	}
+	if late := atomic.LoadUint64(&c.late); late > 0 {
+		problems = append(problems, fmt.Sprintf("%d events received after closing the tracer were discarded", late))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FilterField identifies the event attribute a filter rule applies to
+type FilterField uint32
+
+const (
+	// FilterOp selects events by operation type, e.g. "open", "read"
+	FilterOp FilterField = iota
+
+	// FilterPath selects events by the path of the file or directory
+	// they refer to
+	FilterPath
+
+	// FilterUid, FilterGid and FilterPid select events by the user id,
+	// group id and process id of the requesting process
+	FilterUid
+	FilterGid
+	FilterPid
+
+	// FilterProc selects events by the path of the executable file of the
+	// requesting process
+	FilterProc
+
+	numFilterFields
+)
+
+var filterFieldNames = map[FilterField]string{
+	FilterOp:   "operation",
+	FilterPath: "path",
+	FilterUid:  "uid",
+	FilterGid:  "gid",
+	FilterPid:  "pid",
+	FilterProc: "process",
+}
+
+func (f FilterField) String() string {
+	if n, ok := filterFieldNames[f]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// matcher reports whether an attribute value satisfies a filter rule
+type matcher func(value string) bool
+
+type filterRules struct {
+	include []matcher
+	exclude []matcher
+}
+
+// Filter decides which events are traced. For each event attribute, an
+// event is accepted if it matches at least one of the include rules, if
+// any, and none of the exclude rules. An event must be accepted for all
+// the attributes to be traced.
+type Filter struct {
+	rules [numFilterFields]filterRules
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// Include adds rules for selecting the events which attribute field has
+// one of the given values. Values for FilterPath and FilterProc are
+// patterns: a shell glob where '**' matches any number of directories, or
+// a regular expression if prefixed by "re:". A glob without '/' is
+// matched against the last element of the path.
+func (f *Filter) Include(field FilterField, values ...string) error {
+	m, err := newMatchers(field, values)
+	if err != nil {
+		return err
+	}
+	f.rules[field].include = append(f.rules[field].include, m...)
+	return nil
+}
+
+// Exclude adds rules for discarding the events which attribute field
+// has one of the given values. See Include for the format of the values.
+func (f *Filter) Exclude(field FilterField, values ...string) error {
+	m, err := newMatchers(field, values)
+	if err != nil {
+		return err
+	}
+	f.rules[field].exclude = append(f.rules[field].exclude, m...)
+	return nil
+}
+
+// IsEmpty returns true if this filter accepts all the events
+func (f *Filter) IsEmpty() bool {
+	for i := range f.rules {
+		if len(f.rules[i].include) > 0 || len(f.rules[i].exclude) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Accept returns true if the event described by h must be traced
+func (f *Filter) Accept(h *Header) bool {
+	for i := range f.rules {
+		r := &f.rules[i]
+		if len(r.include) == 0 && len(r.exclude) == 0 {
+			continue
+		}
+		// The value is only computed for the attributes with rules, since
+		// retrieving the process path is costly
+		v := filterValue(h, FilterField(i))
+		if len(r.include) > 0 && !matchAny(r.include, v) {
+			return false
+		}
+		if matchAny(r.exclude, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func filterValue(h *Header, field FilterField) string {
+	switch field {
+	case FilterOp:
+		return h.OperType.String()
+	case FilterPath:
+		return h.Path
+	case FilterUid:
+		return strconv.FormatUint(uint64(h.Uid), 10)
+	case FilterGid:
+		return strconv.FormatUint(uint64(h.Gid), 10)
+	case FilterPid:
+		return strconv.FormatUint(uint64(h.Pid), 10)
+	case FilterProc:
+		return processPath(h.Pid)
+	}
+	return ""
+}
+
+func matchAny(matchers []matcher, value string) bool {
+	for _, m := range matchers {
+		if m(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func newMatchers(field FilterField, values []string) ([]matcher, error) {
+	res := make([]matcher, 0, len(values))
+	for _, v := range values {
+		m, err := newMatcher(field, v)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func newMatcher(field FilterField, value string) (matcher, error) {
+	switch field {
+	case FilterOp:
+		if _, ok := OperTypeFromString(value); !ok {
+			return nil, fmt.Errorf("unknown operation type '%s'", value)
+		}
+	case FilterUid, FilterGid, FilterPid:
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s'", field, value)
+		}
+		value = strconv.FormatUint(n, 10)
+	case FilterPath, FilterProc:
+		return newPatternMatcher(value)
+	default:
+		return nil, fmt.Errorf("unknown filter field %d", field)
+	}
+	return func(v string) bool {
+		return v == value
+	}, nil
+}
+
+// newPatternMatcher returns a matcher for a path pattern, which is either
+// a glob or a regular expression prefixed by "re:"
+func newPatternMatcher(pattern string) (matcher, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(pattern[3:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s' [%s]", pattern[3:], err)
+		}
+		return re.MatchString, nil
+	}
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(pattern, "/") {
+		return func(v string) bool {
+			return re.MatchString(filepath.Base(v))
+		}, nil
+	}
+	return re.MatchString, nil
+}
+
+// globToRegexp converts a shell glob into a regular expression. In
+// addition to '*', '?' and '[...]' which do not match '/', the glob may
+// contain '**' which matches any sequence of characters including '/'.
+// A leading '**/' matches zero or more directories and a trailing '/**'
+// also matches the directory itself.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if !strings.HasPrefix(glob[i:], "**") {
+				buf.WriteString("[^/]*")
+				break
+			}
+			i++
+			if strings.HasPrefix(glob[i+1:], "/") {
+				i++
+				buf.WriteString("(.*/)?")
+			} else {
+				buf.WriteString(".*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid pattern '%s': missing ']'", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '/':
+			if glob[i:] == "/**" {
+				buf.WriteString("(/.*)?")
+				i += 2
+				break
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	re, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s' [%s]", glob, err)
+	}
+	return re, nil
+}
+
+// FilterTracer is a tracer which forwards to another tracer only the
+// events accepted by a filter
+type FilterTracer struct {
+	filter *Filter
+	tracer Tracer
+}
+
+func NewFilterTracer(filter *Filter, tracer Tracer) *FilterTracer {
+	return &FilterTracer{filter: filter, tracer: tracer}
+}
+
+func (t *FilterTracer) Trace(op FsOperTracer) {
+	if t.filter.Accept(op.GetHeader()) {
+		t.tracer.Trace(op)
+	}
+}
+
+func (t *FilterTracer) Close() error {
+	return t.tracer.Close()
+}
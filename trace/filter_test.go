@@ -0,0 +1,132 @@
+package trace
+
+import "testing"
+
+func TestPatternMatcher(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		// Globs without '/' apply to the last element of the path
+		{"*.fits", "/data/image.fits", true},
+		{"*.fits", "/data/image.fits.gz", false},
+		{"*.fits", "/data/fits/image", false},
+		{"image?.fits", "/data/image1.fits", true},
+		{"image?.fits", "/data/image10.fits", false},
+		{"[ab]*", "/data/b.txt", true},
+		{"[!ab]*", "/data/b.txt", false},
+		{"[!ab]*", "/data/c.txt", true},
+		{"a.b", "/data/axb", false},
+
+		// Globs with '/' apply to the whole path
+		{"/data/*", "/data/file", true},
+		{"/data/*", "/data/dir/file", false},
+		{"/data/*.txt", "/data/dir.txt/file", false},
+		{"/data/**", "/data", true},
+		{"/data/**", "/data/dir/file", true},
+		{"/data/**", "/database", false},
+		{"/data/**/*.txt", "/data/a.txt", true},
+		{"/data/**/*.txt", "/data/dir/sub/a.txt", true},
+		{"/data/**/*.txt", "/data/dir/sub/a.fits", false},
+		{"**/tmp/*", "/tmp/file", true},
+		{"**/tmp/*", "/data/tmp/file", true},
+		{"**/tmp/*", "/data/tmp/dir/file", false},
+		{"/data/**.txt", "/data/dir/a.txt", true},
+
+		// Regular expressions apply to the whole path, unanchored
+		{"re:\\.fits$", "/data/image.fits", true},
+		{"re:^/data/[0-9]+$", "/data/42", true},
+		{"re:^/data/[0-9]+$", "/data/42/file", false},
+	}
+	for _, test := range tests {
+		m, err := newPatternMatcher(test.pattern)
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err)
+			continue
+		}
+		if got := m(test.path); got != test.match {
+			t.Errorf("%s: matching '%s' gives %v, want %v", test.pattern, test.path, got, test.match)
+		}
+	}
+}
+
+func TestPatternMatcherErrors(t *testing.T) {
+	for _, pattern := range []string{"[abc", "/data/[", "re:(", "re:a**"} {
+		if _, err := newPatternMatcher(pattern); err == nil {
+			t.Errorf("%s: no error", pattern)
+		}
+	}
+}
+
+func TestFilterAccept(t *testing.T) {
+	type rule struct {
+		exclude bool
+		field   FilterField
+		values  []string
+	}
+	tests := []struct {
+		name   string
+		rules  []rule
+		accept []bool // for each of the headers below
+	}{
+		{"empty", nil, []bool{true, true, true, true}},
+		{"include op", []rule{{false, FilterOp, []string{"read", "write"}}}, []bool{true, true, false, false}},
+		{"exclude op", []rule{{true, FilterOp, []string{"read"}}}, []bool{false, true, true, true}},
+		{"include path", []rule{{false, FilterPath, []string{"/data/**"}}}, []bool{true, true, true, false}},
+		{"include and exclude path", []rule{
+			{false, FilterPath, []string{"/data/**"}},
+			{true, FilterPath, []string{"*.log"}},
+		}, []bool{true, false, true, false}},
+		{"all fields", []rule{
+			{false, FilterPath, []string{"/data/**"}},
+			{false, FilterUid, []string{"9986"}},
+			{true, FilterPid, []string{"00042"}},
+		}, []bool{true, false, true, false}},
+	}
+	headers := []Header{
+		{OperType: FsRead, Path: "/data/image.fits", ProcessInfo: ProcessInfo{Uid: 9986, Pid: 1}},
+		{OperType: FsWrite, Path: "/data/run.log", ProcessInfo: ProcessInfo{Uid: 9986, Pid: 42}},
+		{OperType: FsOpen, Path: "/data", ProcessInfo: ProcessInfo{Uid: 9986, Pid: 2}},
+		{OperType: FsStat, Path: "/tmp/run.log", ProcessInfo: ProcessInfo{Uid: 0, Pid: 3}},
+	}
+	for _, test := range tests {
+		f := NewFilter()
+		for _, r := range test.rules {
+			add := f.Include
+			if r.exclude {
+				add = f.Exclude
+			}
+			if err := add(r.field, r.values...); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		if f.IsEmpty() != (len(test.rules) == 0) {
+			t.Errorf("%s: IsEmpty returns %v", test.name, f.IsEmpty())
+		}
+		for i := range headers {
+			if got := f.Accept(&headers[i]); got != test.accept[i] {
+				t.Errorf("%s: accepting %s %s gives %v, want %v", test.name, headers[i].OperType, headers[i].Path, got, test.accept[i])
+			}
+		}
+	}
+}
+
+func TestFilterInvalidValues(t *testing.T) {
+	tests := []struct {
+		field FilterField
+		value string
+	}{
+		{FilterOp, "nosuchop"},
+		{FilterUid, "root"},
+		{FilterGid, "-1"},
+		{FilterPid, "4294967296"},
+		{FilterPath, "[a"},
+		{FilterProc, "re:*"},
+	}
+	for _, test := range tests {
+		if err := NewFilter().Include(test.field, test.value); err == nil {
+			t.Errorf("%s '%s': no error", test.field, test.value)
+		}
+	}
+}
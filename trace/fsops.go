@@ -1,10 +1,12 @@
-package main
+package trace
 
 import (
 	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -35,6 +37,38 @@ type Header struct {
 	End      time.Time
 	Path     string
 	IsDir    bool
+	Errno    syscall.Errno
+
+	// Injected is true if the result of the operation is a fault injected
+	// by the file system instead of the outcome of the actual operation
+	Injected bool
+
+	// Delay is how long the operation was made to wait by the file system
+	// before being performed. It is part of the duration of the operation.
+	Delay time.Duration
+
+	// names holds the names of the user, the group and the executable of
+	// the requesting process. They are looked up when the event is first
+	// formatted, by the goroutine writing it, not when it is emitted.
+	names *procNames
+}
+
+// procNames holds the names of the user, the group and the executable of
+// a process. They are resolved once, even if the event is formatted
+// concurrently by several tracers.
+type procNames struct {
+	once sync.Once
+	usr  string
+	grp  string
+	proc string
+}
+
+// knownNames returns names which need not be resolved, e.g. read from a
+// trace
+func knownNames(usr, grp, proc string) *procNames {
+	n := &procNames{usr: usr, grp: grp, proc: proc}
+	n.once.Do(func() {})
+	return n
 }
 
 func NewHeader(h fuse.Header, path string, isDir bool, op FSOperType) Header {
@@ -58,6 +92,7 @@ func NewHeaderProcessInfo(proc ProcessInfo, path string, isDir bool, op FSOperTy
 		End:         now,
 		Path:        path,
 		IsDir:       isDir,
+		names:       new(procNames),
 	}
 }
 
@@ -68,17 +103,41 @@ func (h *Header) String() string {
 		h.OperType)
 }
 
+// procNames returns the names of the user, the group and the executable
+// of the requesting process, looking them up the first time
+func (h *Header) procNames() *procNames {
+	n := h.names
+	if n == nil {
+		n = new(procNames)
+	}
+	n.once.Do(func() {
+		n.usr = userName(h.Uid)
+		n.grp = groupName(h.Gid)
+		n.proc = processPath(h.Pid)
+	})
+	return n
+}
+
 func (h *Header) MarshalJSON() ([]byte, error) {
+	names := h.procNames()
 	var jhdr = map[string]interface{}{
 		"uid":     h.Uid,
-		"usr":     userName(h.Uid),
+		"usr":     names.usr,
 		"gid":     h.Gid,
-		"grp":     groupName(h.Gid),
+		"grp":     names.grp,
 		"pid":     h.Pid,
-		"proc":    processPath(h.Pid),
+		"proc":    names.proc,
 		"start":   h.Start.UTC().Format(time.RFC3339Nano),
 		"end":     h.End.UTC().Format(time.RFC3339Nano),
 		"nselaps": h.Duration().Nanoseconds(),
+		"result":  errnoString(h.Errno),
+		"errno":   int(h.Errno),
+	}
+	if h.Injected {
+		jhdr["injected"] = true
+	}
+	if h.Delay > 0 {
+		jhdr["nsdelay"] = h.Delay.Nanoseconds()
 	}
 	return json.Marshal(jhdr)
 }
@@ -87,23 +146,44 @@ func (h *Header) MarshalCSV() []string {
 	// Pre-allocate so that operation-specific marshallers don't need
 	// to re-allocate to extend the serialized version of each operation
 	res := make([]string, 0, 32)
+	names := h.procNames()
 	return append(
 		res,
 		h.Start.UTC().Format(time.RFC3339Nano),
 		h.End.UTC().Format(time.RFC3339Nano),
 		fmt.Sprintf("%d", h.Duration().Nanoseconds()),
-		userName(h.Uid),
+		names.usr,
 		fmt.Sprintf("%d", h.Uid),
-		groupName(h.Gid),
+		names.grp,
 		fmt.Sprintf("%d", h.Gid),
-		processPath(h.Pid),
+		names.proc,
 		fmt.Sprintf("%d", h.Pid),
 		h.Path,
 		isDirMap[h.IsDir],
 		h.OperType.String(),
+		errnoString(h.Errno),
+		fmt.Sprintf("%d", h.Errno),
+		injectedMap[h.Injected],
+		fmt.Sprintf("%d", h.Delay.Nanoseconds()),
 	)
 }
 
+var injectedMap = map[bool]string{
+	true:  "injected",
+	false: "",
+}
+
+// RewritePaths replaces each path in the operation by the value returned
+// by rewrite for that path
+func (h *Header) RewritePaths(rewrite func(path string) string) {
+	h.Path = rewrite(h.Path)
+}
+
+// GetHeader returns the information common to all the operations
+func (h *Header) GetHeader() *Header {
+	return h
+}
+
 func (h *Header) Duration() time.Duration {
 	return h.End.Sub(h.Start)
 }
@@ -120,6 +200,96 @@ func (h *Header) SetIsDir(isDir bool) {
 	h.IsDir = isDir
 }
 
+// SetResult records the outcome of the operation, as returned by the
+// handler to the FUSE layer. A nil error means success.
+func (h *Header) SetResult(err error) {
+	h.Errno = errorToErrno(err)
+}
+
+// errorToErrno returns the error number the FUSE layer sends back to the
+// kernel for the given error, as returned by a file system handler.
+func errorToErrno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e
+	case fuse.ErrorNumber:
+		return syscall.Errno(e.Errno())
+	}
+	return syscall.Errno(fuse.DefaultErrno)
+}
+
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:        "EPERM",
+	syscall.ENOENT:       "ENOENT",
+	syscall.ESRCH:        "ESRCH",
+	syscall.EINTR:        "EINTR",
+	syscall.EIO:          "EIO",
+	syscall.ENXIO:        "ENXIO",
+	syscall.E2BIG:        "E2BIG",
+	syscall.ENOEXEC:      "ENOEXEC",
+	syscall.EBADF:        "EBADF",
+	syscall.ECHILD:       "ECHILD",
+	syscall.EAGAIN:       "EAGAIN",
+	syscall.ENOMEM:       "ENOMEM",
+	syscall.EACCES:       "EACCES",
+	syscall.EFAULT:       "EFAULT",
+	syscall.EBUSY:        "EBUSY",
+	syscall.EEXIST:       "EEXIST",
+	syscall.EXDEV:        "EXDEV",
+	syscall.ENODEV:       "ENODEV",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.EISDIR:       "EISDIR",
+	syscall.EINVAL:       "EINVAL",
+	syscall.ENFILE:       "ENFILE",
+	syscall.EMFILE:       "EMFILE",
+	syscall.ENOTTY:       "ENOTTY",
+	syscall.ETXTBSY:      "ETXTBSY",
+	syscall.EFBIG:        "EFBIG",
+	syscall.ENOSPC:       "ENOSPC",
+	syscall.ESPIPE:       "ESPIPE",
+	syscall.EROFS:        "EROFS",
+	syscall.EMLINK:       "EMLINK",
+	syscall.EPIPE:        "EPIPE",
+	syscall.ERANGE:       "ERANGE",
+	syscall.EDEADLK:      "EDEADLK",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+	syscall.ENOLCK:       "ENOLCK",
+	syscall.ENOSYS:       "ENOSYS",
+	syscall.ENOTEMPTY:    "ENOTEMPTY",
+	syscall.ELOOP:        "ELOOP",
+	syscall.ENOTSUP:      "ENOTSUP",
+	syscall.ESTALE:       "ESTALE",
+	syscall.EDQUOT:       "EDQUOT",
+	// ENODATA on Linux, ENOATTR on MacOS X
+	syscall.Errno(fuse.ErrNoXattr): fuse.ErrNoXattr.ErrnoName(),
+}
+
+// ParseErrno returns the error number which symbolic name is name, e.g.
+// "ENOENT", as written in the trace events
+func ParseErrno(name string) (syscall.Errno, bool) {
+	for errno, n := range errnoNames {
+		if n == name {
+			return errno, true
+		}
+	}
+	return 0, false
+}
+
+// errnoString returns the symbolic name of an error number, e.g. "ENOENT",
+// or "OK" for a successful operation
+func errnoString(errno syscall.Errno) string {
+	if errno == 0 {
+		return "OK"
+	}
+	if s, ok := errnoNames[errno]; ok {
+		return s
+	}
+	return fmt.Sprintf("errno %d", int(errno))
+}
+
 type FSOperType uint32
 
 const (
@@ -143,6 +313,10 @@ const (
 	FsGetXattr
 	FsRemoveXattr
 	FsSetXattr
+	FsLost
+	FsLink
+	FsMknod
+	FsFsync
 )
 
 var opNames = map[FSOperType]string{
@@ -166,6 +340,10 @@ var opNames = map[FSOperType]string{
 	FsGetXattr:    "getxattr",
 	FsRemoveXattr: "removexattr",
 	FsSetXattr:    "setxattr",
+	FsLost:        "lost",
+	FsLink:        "link",
+	FsMknod:       "mknod",
+	FsFsync:       "fsync",
 }
 
 func (t FSOperType) String() string {
@@ -175,10 +353,39 @@ func (t FSOperType) String() string {
 	return "unknown"
 }
 
+// OperTypeFromString returns the operation type which name is s, e.g. "open"
+func OperTypeFromString(s string) (FSOperType, bool) {
+	for t, n := range opNames {
+		if n == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
 func permString(mode os.FileMode) string {
 	return fmt.Sprintf("%0#4o", mode&os.ModePerm)
 }
 
+// fileTypeString returns the name of the type of file described by mode
+func fileTypeString(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDir != 0:
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "chardev"
+	case mode&os.ModeDevice != 0:
+		return "blockdev"
+	}
+	return "file"
+}
+
 var openModeMap = map[fuse.OpenFlags]string{
 	fuse.OpenReadOnly:  "O_RDONLY",
 	fuse.OpenWriteOnly: "O_WRONLY",
@@ -318,9 +525,9 @@ func NewReadOp(req *fuse.ReadRequest, path string, openID uint64) *ReadOp {
 func (op *ReadOp) String() string {
 	return fmt.Sprintf("%s '%s' %s %d %d %d %d %d",
 		&op.Header,
-		op.FileSize,
 		op.Path,
 		isDirMap[op.IsDir],
+		op.FileSize,
 		op.Offset,
 		op.Size,
 		op.BytesRead,
@@ -461,6 +668,57 @@ func (op *FlushOp) MarshalCSV() []string {
 	)
 }
 
+// ------------------------------------------------------------------
+// Fsync
+
+// fsyncDataSync is the bit of the flags of a FUSE fsync request which is set
+// when the application called fdatasync(2) instead of fsync(2)
+const fsyncDataSync = 1
+
+var dataSyncMap = map[bool]string{
+	true:  "fdatasync",
+	false: "fsync",
+}
+
+type FsyncOp struct {
+	Header
+	DataSync bool
+}
+
+func NewFsyncOp(req *fuse.FsyncRequest, path string) *FsyncOp {
+	return &FsyncOp{
+		Header:   NewHeader(req.Header, path, req.Dir, FsFsync),
+		DataSync: req.Flags&fsyncDataSync != 0,
+	}
+}
+
+func (op *FsyncOp) String() string {
+	return fmt.Sprintf("%s '%s' %s %s",
+		&op.Header,
+		op.Path,
+		isDirMap[op.IsDir],
+		dataSyncMap[op.DataSync])
+}
+
+func (op *FsyncOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"hdr": &op.Header,
+		"op": map[string]interface{}{
+			"type":     op.OperType.String(),
+			"path":     op.Path,
+			"isdir":    op.IsDir,
+			"datasync": op.DataSync,
+		},
+	})
+}
+
+func (op *FsyncOp) MarshalCSV() []string {
+	return append(
+		op.Header.MarshalCSV(),
+		dataSyncMap[op.DataSync],
+	)
+}
+
 // ------------------------------------------------------------------
 // Release
 
@@ -545,6 +803,56 @@ func (op *MkdirOp) MarshalCSV() []string {
 	)
 }
 
+// ------------------------------------------------------------------
+// Mknod
+
+type MknodOp struct {
+	Header
+	Mode os.FileMode
+	Rdev uint32
+}
+
+func NewMknodOp(req *fuse.MknodRequest, path string) *MknodOp {
+	return &MknodOp{
+		Header: NewHeaderFile(req.Header, path, FsMknod),
+		Mode:   req.Mode,
+		Rdev:   req.Rdev,
+	}
+}
+
+func (op *MknodOp) String() string {
+	return fmt.Sprintf("%s '%s' %s %s %s %d",
+		&op.Header,
+		op.Path,
+		isDirMap[op.IsDir],
+		fileTypeString(op.Mode),
+		permString(op.Mode),
+		op.Rdev)
+}
+
+func (op *MknodOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"hdr": &op.Header,
+		"op": map[string]interface{}{
+			"type":     op.OperType.String(),
+			"path":     op.Path,
+			"isdir":    op.IsDir,
+			"filetype": fileTypeString(op.Mode),
+			"mode":     permString(op.Mode),
+			"rdev":     op.Rdev,
+		},
+	})
+}
+
+func (op *MknodOp) MarshalCSV() []string {
+	return append(
+		op.Header.MarshalCSV(),
+		fileTypeString(op.Mode),
+		permString(op.Mode),
+		fmt.Sprintf("%d", op.Rdev),
+	)
+}
+
 // ------------------------------------------------------------------
 // Remove
 
@@ -643,6 +951,11 @@ func NewSymlinkOp(req *fuse.SymlinkRequest, path, target string, isDir bool) *Sy
 	}
 }
 
+func (op *SymlinkOp) RewritePaths(rewrite func(path string) string) {
+	op.Header.RewritePaths(rewrite)
+	op.Target = rewrite(op.Target)
+}
+
 func (op *SymlinkOp) String() string {
 	return fmt.Sprintf("%s '%s' %s %s",
 		&op.Header,
@@ -791,6 +1104,11 @@ func NewRenameOp(req *fuse.RenameRequest, oldpath, newpath string) *RenameOp {
 	}
 }
 
+func (op *RenameOp) RewritePaths(rewrite func(path string) string) {
+	op.Header.RewritePaths(rewrite)
+	op.NewPath = rewrite(op.NewPath)
+}
+
 func (op *RenameOp) String() string {
 	return fmt.Sprintf("%s '%s' %s '%s'",
 		&op.Header,
@@ -818,6 +1136,53 @@ func (op *RenameOp) MarshalCSV() []string {
 	)
 }
 
+// ------------------------------------------------------------------
+// Link
+
+type LinkOp struct {
+	Header
+	NewPath string
+}
+
+func NewLinkOp(req *fuse.LinkRequest, oldpath, newpath string, isDir bool) *LinkOp {
+	return &LinkOp{
+		Header:  NewHeader(req.Header, oldpath, isDir, FsLink),
+		NewPath: newpath,
+	}
+}
+
+func (op *LinkOp) RewritePaths(rewrite func(path string) string) {
+	op.Header.RewritePaths(rewrite)
+	op.NewPath = rewrite(op.NewPath)
+}
+
+func (op *LinkOp) String() string {
+	return fmt.Sprintf("%s '%s' %s '%s'",
+		&op.Header,
+		op.Path,
+		isDirMap[op.IsDir],
+		op.NewPath)
+}
+
+func (op *LinkOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"hdr": &op.Header,
+		"op": map[string]interface{}{
+			"type":  op.OperType.String(),
+			"isdir": op.IsDir,
+			"old":   op.Path,
+			"new":   op.NewPath,
+		},
+	})
+}
+
+func (op *LinkOp) MarshalCSV() []string {
+	return append(
+		op.Header.MarshalCSV(),
+		op.NewPath,
+	)
+}
+
 // ------------------------------------------------------------------
 // Readlink
 
@@ -898,44 +1263,215 @@ func (op *AccessOp) MarshalCSV() []string {
 type SetattrOp struct {
 	Header
 	AttrValid fuse.SetattrValid
+
+	// Requested values of the attributes present in AttrValid
+	Size   uint64
+	Mode   os.FileMode
+	Uid    uint32
+	Gid    uint32
+	Atime  time.Time
+	Mtime  time.Time
+	Handle uint64
+
+	// Previous holds the attributes of the file before the change, if
+	// they could be retrieved
+	Previous *fuse.Attr
+
+	// Applied and Failed are the attributes which were respectively
+	// successfully changed and could not be changed
+	Applied fuse.SetattrValid
+	Failed  fuse.SetattrValid
 }
 
 func NewSetattrOp(req *fuse.SetattrRequest, path string) *SetattrOp {
-	return &SetattrOp{
+	op := &SetattrOp{
 		Header:    NewHeaderFile(req.Header, path, FsSetAttr),
 		AttrValid: req.Valid,
+		Size:      req.Size,
+		Mode:      req.Mode,
+		Uid:       req.Uid,
+		Gid:       req.Gid,
+		Atime:     req.Atime,
+		Mtime:     req.Mtime,
+		Handle:    uint64(req.Handle),
+	}
+	// The kernel does not send a time when it must be set to the current time
+	if req.Valid.AtimeNow() {
+		op.Atime = op.Start
+	}
+	if req.Valid.MtimeNow() {
+		op.Mtime = op.Start
 	}
+	return op
+}
+
+// SetPrevious records the attributes of the file before the change
+func (op *SetattrOp) SetPrevious(attr fuse.Attr) {
+	op.Previous = &attr
+	op.IsDir = attr.Mode.IsDir()
 }
 
 func (op *SetattrOp) String() string {
-	// TODO: improve printing of attribute to decouple from fuse
-	return fmt.Sprintf("%s '%s' %s %s",
+	return fmt.Sprintf("%s '%s' %s %s %s %s",
 		&op.Header,
 		op.Path,
 		isDirMap[op.IsDir],
-		op.AttrValid)
+		strings.Join(op.requestedCSV(), " "),
+		setattrString(op.Applied),
+		setattrString(op.Failed))
 }
 
 func (op *SetattrOp) MarshalJSON() ([]byte, error) {
+	jop := map[string]interface{}{
+		"type":    op.OperType.String(),
+		"path":    op.Path,
+		"isdir":   op.IsDir,
+		"applied": setattrNames(op.Applied),
+		"failed":  setattrNames(op.Failed),
+		"new":     op.requestedJSON(),
+	}
+	if op.Previous != nil {
+		jop["old"] = map[string]interface{}{
+			"size":  op.Previous.Size,
+			"mode":  permString(op.Previous.Mode),
+			"uid":   op.Previous.Uid,
+			"gid":   op.Previous.Gid,
+			"atime": timeString(op.Previous.Atime),
+			"mtime": timeString(op.Previous.Mtime),
+		}
+	}
 	return json.Marshal(map[string]interface{}{
 		"hdr": &op.Header,
-		"op": map[string]interface{}{
-			"type":  op.OperType.String(),
-			"path":  op.Path,
-			"isdir": op.IsDir,
-			// TODO: marshal attribute
-		},
+		"op":  jop,
 	})
 }
 
+// requestedJSON returns the requested values of the attributes to be changed
+func (op *SetattrOp) requestedJSON() map[string]interface{} {
+	res := make(map[string]interface{})
+	v := op.AttrValid
+	if v.Size() {
+		res["size"] = op.Size
+	}
+	if v.Mode() {
+		res["mode"] = permString(op.Mode)
+	}
+	if v.Uid() {
+		res["uid"] = op.Uid
+	}
+	if v.Gid() {
+		res["gid"] = op.Gid
+	}
+	if v.Atime() || v.AtimeNow() {
+		res["atime"] = timeString(op.Atime)
+	}
+	if v.Mtime() || v.MtimeNow() {
+		res["mtime"] = timeString(op.Mtime)
+	}
+	if v.Handle() {
+		res["handle"] = op.Handle
+	}
+	return res
+}
+
+// requestedCSV returns the requested values of the attributes to be
+// changed, as a fixed set of columns which are empty for the attributes
+// not to be changed
+func (op *SetattrOp) requestedCSV() []string {
+	res := make([]string, 7)
+	v := op.AttrValid
+	if v.Size() {
+		res[0] = fmt.Sprintf("%d", op.Size)
+	}
+	if v.Mode() {
+		res[1] = permString(op.Mode)
+	}
+	if v.Uid() {
+		res[2] = fmt.Sprintf("%d", op.Uid)
+	}
+	if v.Gid() {
+		res[3] = fmt.Sprintf("%d", op.Gid)
+	}
+	if v.Atime() || v.AtimeNow() {
+		res[4] = timeString(op.Atime)
+	}
+	if v.Mtime() || v.MtimeNow() {
+		res[5] = timeString(op.Mtime)
+	}
+	if v.Handle() {
+		res[6] = fmt.Sprintf("%d", op.Handle)
+	}
+	return res
+}
+
 func (op *SetattrOp) MarshalCSV() []string {
+	res := append(op.Header.MarshalCSV(), setattrString(op.Applied), setattrString(op.Failed))
+	res = append(res, op.requestedCSV()...)
+	if op.Previous == nil {
+		return append(res, "", "", "", "", "", "")
+	}
 	return append(
-		op.Header.MarshalCSV(),
-		// TODO: marshal attribute
-		// op.AttrValid,
+		res,
+		fmt.Sprintf("%d", op.Previous.Size),
+		permString(op.Previous.Mode),
+		fmt.Sprintf("%d", op.Previous.Uid),
+		fmt.Sprintf("%d", op.Previous.Gid),
+		timeString(op.Previous.Atime),
+		timeString(op.Previous.Mtime),
 	)
 }
 
+func timeString(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// setattrFields lists the attributes a setattr request may change, in the
+// order they are reported
+var setattrFields = []fuse.SetattrValid{
+	fuse.SetattrSize,
+	fuse.SetattrMode,
+	fuse.SetattrUid,
+	fuse.SetattrGid,
+	fuse.SetattrAtime,
+	fuse.SetattrAtimeNow,
+	fuse.SetattrMtime,
+	fuse.SetattrMtimeNow,
+	fuse.SetattrCrtime,
+	fuse.SetattrChgtime,
+	fuse.SetattrBkuptime,
+	fuse.SetattrFlags,
+}
+
+var setattrFieldNames = map[fuse.SetattrValid]string{
+	fuse.SetattrSize:     "size",
+	fuse.SetattrMode:     "mode",
+	fuse.SetattrUid:      "uid",
+	fuse.SetattrGid:      "gid",
+	fuse.SetattrAtime:    "atime",
+	fuse.SetattrAtimeNow: "atime_now",
+	fuse.SetattrMtime:    "mtime",
+	fuse.SetattrMtimeNow: "mtime_now",
+	fuse.SetattrCrtime:   "crtime",
+	fuse.SetattrChgtime:  "chgtime",
+	fuse.SetattrBkuptime: "bkuptime",
+	fuse.SetattrFlags:    "flags",
+}
+
+// setattrNames returns the names of the attributes present in valid
+func setattrNames(valid fuse.SetattrValid) []string {
+	res := make([]string, 0, len(setattrFields))
+	for _, f := range setattrFields {
+		if valid&f != 0 {
+			res = append(res, setattrFieldNames[f])
+		}
+	}
+	return res
+}
+
+func setattrString(valid fuse.SetattrValid) string {
+	return strings.Join(setattrNames(valid), "|")
+}
+
 // ------------------------------------------------------------------
 // Getxattr
 
@@ -1104,3 +1640,44 @@ func (op *RemovexattrOp) MarshalCSV() []string {
 		op.AttrName,
 	)
 }
+
+// ------------------------------------------------------------------
+// Lost
+
+// LostOp is not a file system operation but a record emitted by a tracer
+// to report the number of events it dropped since the time stamp in its
+// header
+type LostOp struct {
+	Header
+	Count uint64
+}
+
+func NewLostOp(count uint64, since time.Time) *LostOp {
+	op := &LostOp{
+		Header: NewHeaderProcessInfo(ProcessInfo{}, "", false, FsLost),
+		Count:  count,
+	}
+	op.Start = since
+	return op
+}
+
+func (op *LostOp) String() string {
+	return fmt.Sprintf("%s %d", &op.Header, op.Count)
+}
+
+func (op *LostOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"hdr": &op.Header,
+		"op": map[string]interface{}{
+			"type":  op.OperType.String(),
+			"count": op.Count,
+		},
+	})
+}
+
+func (op *LostOp) MarshalCSV() []string {
+	return append(
+		op.Header.MarshalCSV(),
+		fmt.Sprintf("%d", op.Count),
+	)
+}
@@ -0,0 +1,421 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The OTLP tracer exports each event as a span of the OpenTelemetry protocol
+// (OTLP), encoded in JSON as an ExportTraceServiceRequest message. The
+// operations on a file or directory handle, from its opening to its release,
+// are the children of a span named 'handle' which covers the whole period.
+// Other operations are exported as spans on their own.
+
+const (
+	// otlpMaxBatch is the maximum number of spans exported at once
+	otlpMaxBatch = 512
+
+	// otlpBatchDelay is the period at which the spans of an incomplete
+	// batch are exported
+	otlpBatchDelay = 5 * time.Second
+
+	// otlpMaxHandles is the maximum number of open handles which spans are
+	// kept until the handle is released. The operations on other handles
+	// are exported as spans on their own.
+	otlpMaxHandles = 100000
+
+	// otlpTimeout is how long exporting a batch of spans to a collector
+	// may take
+	otlpTimeout = 10 * time.Second
+
+	// otlpTracesPath is the path of the URL of the collector to which spans
+	// are exported, when not specified
+	otlpTracesPath = "/v1/traces"
+
+	otlpScopeName = "github.com/airnandez/cluefs"
+)
+
+// Kinds and status codes of the spans, as defined by OTLP
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+// IsURLDestination returns true if the trace destination dest, as given to
+// NewTracer, is the URL of an OTLP collector
+func IsURLDestination(dest string) bool {
+	return strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://")
+}
+
+// handleSpan is the span covering the use of an open file or directory
+type handleSpan struct {
+	traceID string
+	spanID  string
+	first   FsOperTracer
+	start   time.Time
+	end     time.Time
+	read    uint64
+	written uint64
+	ops     int64
+}
+
+type OTLPTracer struct {
+	*collector
+	export func(body []byte) error
+	closer io.Closer
+
+	// The fields below are only used by the goroutine of the collector
+	info    *StreamInfo
+	spans   []interface{}
+	handles map[uint64]*handleSpan
+	rand    *rand.Rand
+}
+
+func newOTLPTracer(info *StreamInfo, export func(body []byte) error) *OTLPTracer {
+	return &OTLPTracer{
+		export:  export,
+		info:    info,
+		spans:   make([]interface{}, 0, otlpMaxBatch),
+		handles: make(map[uint64]*handleSpan),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// NewOTLPTracer creates a tracer which writes each batch of spans to w as a
+// JSON object in a single line, as does the file exporter of the
+// OpenTelemetry collector. The attributes of the exported resource are
+// taken from info, if not nil.
+func NewOTLPTracer(w io.Writer, info *StreamInfo, opts QueueOptions) *OTLPTracer {
+	writer := bufio.NewWriter(w)
+	tracer := newOTLPTracer(info, func(body []byte) error {
+		if _, err := writer.Write(append(body, '\n')); err != nil {
+			return err
+		}
+		return writer.Flush()
+	})
+	// Start the event collector
+	tracer.collector = newCollector(opts, info, tracer, w)
+	return tracer
+}
+
+// NewOTLPHTTPTracer creates a tracer which exports the spans to the
+// OpenTelemetry collector at rawurl, using OTLP over HTTP with JSON
+// encoding. If rawurl has no path, the spans are sent to '/v1/traces'.
+// Batches of spans which the collector does not accept are lost. The queue
+// of events is set by opts, except that events are dropped instead of
+// blocking when it is full, so that a slow or unreachable collector does
+// not stall the file system.
+func NewOTLPHTTPTracer(rawurl string, info *StreamInfo, opts QueueOptions) (*OTLPTracer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid collector URL '%s'", rawurl)
+	}
+	if len(u.Path) == 0 || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	endpoint := u.String()
+	if opts.Policy == PolicyBlock {
+		opts.Policy = PolicyDropNewest
+	}
+	client := &http.Client{Timeout: otlpTimeout}
+	tracer := newOTLPTracer(info, func(body []byte) error {
+		resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("could not export spans [%s]", err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("could not export spans [collector responded '%s']", resp.Status)
+		}
+		return nil
+	})
+	// Start the event collector
+	tracer.collector = newCollector(opts, info, tracer, nil)
+	return tracer, nil
+}
+
+func (t *OTLPTracer) writeInfo(info *StreamInfo) error {
+	// The stream is described by the resource of every batch of spans
+	t.info = info
+	return nil
+}
+
+func (t *OTLPTracer) write(op FsOperTracer) error {
+	h := op.GetHeader()
+	id, ok := handleID(op)
+	if !ok {
+		t.addSpan(op, t.newTraceID(), "")
+		return t.flushFull()
+	}
+	hs, found := t.handles[id]
+	if !found {
+		if len(t.handles) >= otlpMaxHandles {
+			t.addSpan(op, t.newTraceID(), "")
+			return t.flushFull()
+		}
+		// The handle is usually opened by this operation, unless the
+		// event of its opening was dropped
+		hs = &handleSpan{traceID: t.newTraceID(), spanID: t.newSpanID(), first: op, start: h.Start}
+		t.handles[id] = hs
+	}
+	hs.end = h.End
+	hs.ops++
+	switch op := op.(type) {
+	case *ReadOp:
+		if op.BytesRead > 0 {
+			hs.read += uint64(op.BytesRead)
+		}
+	case *WriteOp:
+		if op.BytesWritten > 0 {
+			hs.written += uint64(op.BytesWritten)
+		}
+	}
+	t.addSpan(op, hs.traceID, hs.spanID)
+	if h.OperType == FsRelease {
+		t.addHandleSpan(id, hs, true)
+		delete(t.handles, id)
+	}
+	return t.flushFull()
+}
+
+// handleID returns the identifier of the handle op operates on, if any
+func handleID(op FsOperTracer) (uint64, bool) {
+	var id uint64
+	switch op := op.(type) {
+	case *OpenOp:
+		id = op.OpenID
+	case *CreateOp:
+		id = op.OpenID
+	case *ReadOp:
+		id = op.OpenID
+	case *WriteOp:
+		id = op.OpenID
+	case *FlushOp:
+		id = op.OpenID
+	case *ReadDirOp:
+		id = op.OpenID
+	case *ReleaseOp:
+		id = op.OpenID
+	}
+	return id, id != 0
+}
+
+func (t *OTLPTracer) batchDelay() time.Duration {
+	return otlpBatchDelay
+}
+
+// flushFull exports the spans if the batch is full
+func (t *OTLPTracer) flushFull() error {
+	if len(t.spans) < otlpMaxBatch {
+		return nil
+	}
+	return t.flush()
+}
+
+func (t *OTLPTracer) flush() error {
+	if len(t.spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": t.resourceAttributes(),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{
+							"name":    otlpScopeName,
+							"version": t.version(),
+						},
+						"spans": t.spans,
+					},
+				},
+			},
+		},
+	})
+	t.spans = t.spans[:0]
+	if err != nil {
+		return err
+	}
+	return t.export(body)
+}
+
+func (t *OTLPTracer) version() string {
+	if t.info == nil {
+		return ""
+	}
+	return t.info.Version
+}
+
+func (t *OTLPTracer) resourceAttributes() []interface{} {
+	attrs := otlpAttributes{}
+	attrs.str("service.name", "cluefs")
+	if t.info != nil {
+		attrs.str("service.version", t.info.Version)
+		attrs.str("host.name", t.info.Host)
+		attrs.str("cluefs.mount_dir", t.info.MountDir)
+		attrs.str("cluefs.shadow_dir", t.info.ShadowDir)
+		attrs.int("cluefs.schema", int64(t.info.Schema))
+	}
+	return attrs
+}
+
+// addSpan adds the span of op to the batch, as a child of the span parentID
+// if not empty
+func (t *OTLPTracer) addSpan(op FsOperTracer, traceID, parentID string) {
+	h := op.GetHeader()
+	if lost, ok := op.(*LostOp); ok {
+		// The dropped events are not related to any process
+		attrs := otlpAttributes{}
+		attrs.str("cluefs.op", h.OperType.String())
+		attrs.int("cluefs.lost", int64(lost.Count))
+		t.spans = append(t.spans, newSpan(h.OperType.String(), traceID, t.newSpanID(), "", h.Start, h.End, 0, attrs))
+		return
+	}
+	attrs := headerAttributes(h)
+	switch op := op.(type) {
+	case *ReadOp:
+		attrs.int("cluefs.offset", op.Offset)
+		attrs.int("cluefs.size", int64(op.Size))
+		attrs.int("cluefs.bytes", int64(op.BytesRead))
+	case *WriteOp:
+		attrs.int("cluefs.offset", op.Offset)
+		attrs.int("cluefs.size", int64(op.Size))
+		attrs.int("cluefs.bytes", int64(op.BytesWritten))
+	}
+	if id, ok := handleID(op); ok {
+		attrs.int("cluefs.open_id", int64(id))
+	}
+	t.spans = append(t.spans, newSpan(h.OperType.String(), traceID, t.newSpanID(), parentID, h.Start, h.End, h.Errno, attrs))
+}
+
+// addHandleSpan adds to the batch the span of the handle id, which covers
+// all the operations on that handle. The span is marked as released if the
+// handle was released before the tracer was closed.
+func (t *OTLPTracer) addHandleSpan(id uint64, hs *handleSpan, released bool) {
+	h := hs.first.GetHeader()
+	attrs := headerAttributes(h)
+	attrs.int("cluefs.open_id", int64(id))
+	attrs.int("cluefs.operations", hs.ops)
+	attrs.int("cluefs.bytes_read", int64(hs.read))
+	attrs.int("cluefs.bytes_written", int64(hs.written))
+	attrs.bool("cluefs.released", released)
+	t.spans = append(t.spans, newSpan("handle", hs.traceID, hs.spanID, "", hs.start, hs.end, h.Errno, attrs))
+}
+
+// headerAttributes returns the attributes of the span of an operation
+// which are common to all the operations
+func headerAttributes(h *Header) otlpAttributes {
+	names := h.procNames()
+	attrs := make(otlpAttributes, 0, 16)
+	attrs.str("cluefs.op", h.OperType.String())
+	attrs.str("file.path", h.Path)
+	attrs.bool("cluefs.is_dir", h.IsDir)
+	attrs.int("process.pid", int64(h.Pid))
+	attrs.str("process.executable.path", names.proc)
+	attrs.int("cluefs.uid", int64(h.Uid))
+	attrs.str("cluefs.usr", names.usr)
+	attrs.int("cluefs.gid", int64(h.Gid))
+	attrs.str("cluefs.grp", names.grp)
+	attrs.int("cluefs.errno", int64(h.Errno))
+	attrs.str("cluefs.result", errnoString(h.Errno))
+	attrs.bool("cluefs.injected", h.Injected)
+	attrs.int("cluefs.delay_ns", h.Delay.Nanoseconds())
+	return attrs
+}
+
+func newSpan(name, traceID, spanID, parentID string, start, end time.Time, errno syscall.Errno, attrs otlpAttributes) map[string]interface{} {
+	span := map[string]interface{}{
+		"traceId":           traceID,
+		"spanId":            spanID,
+		"name":              name,
+		"kind":              otlpSpanKindInternal,
+		"startTimeUnixNano": strconv.FormatInt(start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attrs,
+	}
+	if len(parentID) > 0 {
+		span["parentSpanId"] = parentID
+	}
+	if errno != 0 {
+		span["status"] = map[string]interface{}{
+			"code":    otlpStatusError,
+			"message": errnoString(errno),
+		}
+	}
+	return span
+}
+
+func (t *OTLPTracer) newTraceID() string {
+	var id [16]byte
+	t.rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func (t *OTLPTracer) newSpanID() string {
+	var id [8]byte
+	t.rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// otlpAttributes are the attributes of a span or of a resource, in the JSON
+// encoding of OTLP, where 64-bit integers are strings
+type otlpAttributes []interface{}
+
+func (a *otlpAttributes) add(key string, value map[string]interface{}) {
+	*a = append(*a, map[string]interface{}{"key": key, "value": value})
+}
+
+func (a *otlpAttributes) str(key, v string) {
+	a.add(key, map[string]interface{}{"stringValue": v})
+}
+
+func (a *otlpAttributes) int(key string, v int64) {
+	a.add(key, map[string]interface{}{"intValue": strconv.FormatInt(v, 10)})
+}
+
+func (a *otlpAttributes) bool(key string, v bool) {
+	a.add(key, map[string]interface{}{"boolValue": v})
+}
+
+func (t *OTLPTracer) Trace(op FsOperTracer) {
+	t.put(op)
+}
+
+// Close exports the pending spans, including the spans of the handles which
+// are still open, and closes the destination
+func (t *OTLPTracer) Close() error {
+	err := t.close()
+	// The goroutine of the collector is done: the spans can be written here
+	end := time.Now()
+	var ferr error
+	for id, hs := range t.handles {
+		hs.end = end
+		t.addHandleSpan(id, hs, false)
+		if e := t.flushFull(); ferr == nil {
+			ferr = e
+		}
+	}
+	t.handles = make(map[uint64]*handleSpan)
+	if e := t.flush(); ferr == nil {
+		ferr = e
+	}
+	if err == nil && ferr != nil {
+		err = fmt.Errorf("could not write the spans of the open handles [%s]", ferr)
+	}
+	return closeDestination(err, t.closer)
+}
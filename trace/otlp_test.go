@@ -0,0 +1,179 @@
+package trace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// otlpSpan is a span as exported in JSON
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+// attr returns the value of the attribute key of the span, whatever its
+// type
+func (s *otlpSpan) attr(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// otlpCollector is a stub of an OpenTelemetry collector which keeps the
+// spans it receives
+type otlpCollector struct {
+	mutex    sync.Mutex
+	requests int
+	spans    []otlpSpan
+	errors   []string
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.requests++
+	if r.Method != "POST" || r.URL.Path != otlpTracesPath || r.Header.Get("Content-Type") != "application/json" {
+		c.errors = append(c.errors, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.errors = append(c.errors, err.Error())
+	}
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	collector := &otlpCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	info := &StreamInfo{Schema: SchemaVersion, Version: "v0.5", Start: testTime}
+	tracer, err := NewOTLPHTTPTracer(server.URL, info, QueueOptions{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	missing := testHeader(FsStat, "/data/missing")
+	missing.Errno = syscall.ENOENT
+	ops := []FsOperTracer{
+		&OpenOp{Header: testHeader(FsOpen, "/data/file"), OpenID: 7},
+		&ReadOp{Header: testHeader(FsRead, "/data/file"), Size: 4096, BytesRead: 100, OpenID: 7},
+		&LookupOp{Header: missing},
+		&ReleaseOp{Header: testHeader(FsRelease, "/data/file"), OpenID: 7},
+	}
+	for _, op := range ops {
+		tracer.Trace(op)
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(collector.errors) > 0 {
+		t.Errorf("invalid requests: %q", collector.errors)
+	}
+	// The spans are exported in a single batch
+	if collector.requests != 1 {
+		t.Errorf("got %d requests, want 1", collector.requests)
+	}
+	spans := make(map[string]*otlpSpan)
+	for i := range collector.spans {
+		s := &collector.spans[i]
+		spans[s.Name] = s
+	}
+	if len(spans) != len(ops)+1 {
+		t.Fatalf("got %d spans, want %d", len(collector.spans), len(ops)+1)
+	}
+	for _, op := range ops {
+		h := op.GetHeader()
+		s := spans[h.OperType.String()]
+		attrs := map[string]interface{}{
+			"file.path":     h.Path,
+			"cluefs.op":     h.OperType.String(),
+			"process.pid":   "22902",
+			"cluefs.uid":    "9986",
+			"cluefs.errno":  "0",
+			"cluefs.result": "OK",
+		}
+		if h.Errno != 0 {
+			attrs["cluefs.errno"], attrs["cluefs.result"] = "2", "ENOENT"
+		}
+		for key, want := range attrs {
+			if got := s.attr(key); got != want {
+				t.Errorf("%s span: got %s %v, want %v", s.Name, key, got, want)
+			}
+		}
+	}
+	if s := spans["read"]; s.attr("cluefs.bytes") != "100" || s.attr("cluefs.size") != "4096" {
+		t.Errorf("read span: got bytes %v, size %v", s.attr("cluefs.bytes"), s.attr("cluefs.size"))
+	}
+	if s := spans["stat"]; s.Status == nil || s.Status.Code != otlpStatusError || s.Status.Message != "ENOENT" {
+		t.Errorf("stat span: got status %+v", s.Status)
+	}
+
+	// The operations on the handle, from its opening to its release, are
+	// the children of the span of the handle. The others have no parent.
+	handle := spans["handle"]
+	if handle.ParentSpanID != "" || handle.attr("cluefs.bytes_read") != "100" || handle.attr("cluefs.released") != true {
+		t.Errorf("handle span: got %+v", handle)
+	}
+	for _, name := range []string{"open", "read", "release"} {
+		if s := spans[name]; s.ParentSpanID != handle.SpanID || s.TraceID != handle.TraceID {
+			t.Errorf("%s span is not a child of the handle span", name)
+		}
+	}
+	if s := spans["stat"]; s.ParentSpanID != "" || s.TraceID == handle.TraceID {
+		t.Errorf("stat span is related to the handle span")
+	}
+}
+
+func TestOTLPSlowCollector(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	tracer, err := NewOTLPHTTPTracer(server.URL, nil, QueueOptions{Size: 4})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	// Once a full batch is being exported, the new events are dropped
+	// instead of blocking the file system
+	h := testHeader(FsStat, "/data/file")
+	for i := 0; i < 2*otlpMaxBatch; i++ {
+		tracer.Trace(&LookupOp{Header: h})
+	}
+	if tracer.Dropped() == 0 {
+		t.Errorf("no events dropped")
+	}
+	close(release)
+	tracer.Close()
+}
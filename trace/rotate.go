@@ -0,0 +1,279 @@
+package trace
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions holds the settings of the rotation of a trace file. When
+// rotation is enabled, the trace file is closed and renamed once it is too
+// large or too old and a new one is started, each one beginning with the
+// stream header. The zero value disables rotation.
+type RotateOptions struct {
+	// MaxSize is the size in bytes after which the trace file is rotated.
+	// Since records are written in batches, a rotated file may be slightly
+	// larger. Default: no limit
+	MaxSize int64
+
+	// MaxAge is the age after which the trace file is rotated, provided it
+	// holds at least one event. Default: no limit
+	MaxAge time.Duration
+
+	// Keep is the number of rotated files kept, the oldest ones being
+	// removed. Default: keep all of them
+	Keep int
+
+	// Compress is the compression applied to the rotated files, either
+	// "gzip" or "none". Default: "none"
+	Compress string
+}
+
+// IsEnabled returns true if the trace file is to be rotated
+func (o RotateOptions) IsEnabled() bool {
+	return o.MaxSize > 0 || o.MaxAge > 0
+}
+
+// compressors are the supported compressions of the rotated files, with the
+// extension appended to the name of the compressed files. Only those of the
+// standard library are offered, e.g. not zstd.
+var compressors = map[string]struct {
+	ext       string
+	newWriter func(w io.Writer) io.WriteCloser
+}{
+	"gzip": {".gz", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+// ValidCompression returns true if name is a supported compression of the
+// rotated trace files
+func ValidCompression(name string) bool {
+	_, ok := compressors[name]
+	return ok || name == "none" || name == ""
+}
+
+// segmentTimeFormat is the format of the suffix added to the name of the
+// trace file when it is rotated
+const segmentTimeFormat = "20060102T150405.000000000Z"
+
+// rotator is implemented by the trace destinations which are split into
+// several files
+type rotator interface {
+	// due returns true if a new file should be started before writing
+	// more records
+	due(now time.Time) bool
+
+	// rotate closes the current file and starts a new one
+	rotate() error
+}
+
+// rotatingFile is a trace file which is rotated according to its options.
+// Rotated files are named after the trace file followed by the time of
+// their rotation, e.g. 'trace.csv.20170301T101010.000000000Z'. They are
+// compressed and the oldest ones removed in the background.
+type rotatingFile struct {
+	path   string
+	opts   RotateOptions
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// rotated holds the rotated files waiting to be processed in the
+	// background, in the order of their rotation, and err is the first error
+	// found when processing them. Both are protected by lock. mutex
+	// serializes the processing, which pending tracks.
+	lock    sync.Mutex
+	rotated []string
+	err     error
+	mutex   sync.Mutex
+	pending sync.WaitGroup
+}
+
+func openRotatingFile(filePath string, opts RotateOptions) (*rotatingFile, error) {
+	abspath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve absolute path for '%s' [%s]", filePath, err)
+	}
+	f := &rotatingFile{path: abspath, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the trace file in append mode
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("could not open file '%s' for writing [%s]", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not retrieve size of file '%s' [%s]", f.path, err)
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		return 0, fmt.Errorf("file '%s' is not open", f.path)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) due(now time.Time) bool {
+	switch {
+	case f.file == nil:
+		// Opening a new file failed: try again
+		return true
+	case f.opts.MaxSize > 0 && f.size >= f.opts.MaxSize:
+		return true
+	case f.opts.MaxAge > 0 && now.Sub(f.opened) >= f.opts.MaxAge:
+		return true
+	}
+	return false
+}
+
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		err := f.file.Close()
+		f.file = nil
+		if err != nil {
+			return fmt.Errorf("could not close file '%s' [%s]", f.path, err)
+		}
+		segment := f.path + "." + time.Now().UTC().Format(segmentTimeFormat)
+		if err := os.Rename(f.path, segment); err != nil {
+			// Keep on appending to the same file
+			f.open()
+			return fmt.Errorf("could not rename file '%s' [%s]", f.path, err)
+		}
+		f.lock.Lock()
+		f.rotated = append(f.rotated, segment)
+		f.lock.Unlock()
+		f.pending.Add(1)
+		go f.archive()
+	}
+	return f.open()
+}
+
+// archive compresses the rotated files, if requested, and removes the
+// oldest ones
+func (f *rotatingFile) archive() {
+	defer f.pending.Done()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lock.Lock()
+	segments := f.rotated
+	f.rotated = nil
+	f.lock.Unlock()
+	if c, ok := compressors[f.opts.Compress]; ok {
+		for _, s := range segments {
+			f.fail(compressFile(s, s+c.ext, c.newWriter))
+		}
+	}
+	if f.opts.Keep > 0 {
+		f.fail(f.removeOldest())
+	}
+}
+
+func (f *rotatingFile) fail(err error) {
+	if err == nil {
+		return
+	}
+	f.lock.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.lock.Unlock()
+}
+
+// removeOldest removes the rotated files but the most recent opts.Keep ones
+func (f *rotatingFile) removeOldest() error {
+	// The name of the trace file is not a pattern: it may hold any of the
+	// characters which filepath.Match interprets
+	dir, prefix := filepath.Dir(f.path), filepath.Base(f.path)+"."
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not list rotated trace files [%s]", err)
+	}
+	segments := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(e.Name(), prefix)
+		if c, ok := compressors[f.opts.Compress]; ok {
+			suffix = strings.TrimSuffix(suffix, c.ext)
+		}
+		if _, err := time.Parse(segmentTimeFormat, suffix); err == nil {
+			segments = append(segments, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(segments) <= f.opts.Keep {
+		return nil
+	}
+	// The names of the segments sort in the order of their rotation
+	sort.Strings(segments)
+	for _, s := range segments[:len(segments)-f.opts.Keep] {
+		if err := os.Remove(s); err != nil {
+			return fmt.Errorf("could not remove rotated trace file [%s]", err)
+		}
+	}
+	return nil
+}
+
+// compressFile writes the compressed contents of the file at src to the
+// file at dst and removes src
+func compressFile(src, dst string, newc func(w io.Writer) io.WriteCloser) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("could not open rotated trace file [%s]", err)
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("could not create compressed trace file [%s]", err)
+	}
+	w := newc(out)
+	_, err = io.Copy(w, in)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not compress rotated trace file '%s' [%s]", src, err)
+	}
+	return os.Remove(src)
+}
+
+// Close closes the current trace file and waits until the rotated ones are
+// processed
+func (f *rotatingFile) Close() error {
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.pending.Wait()
+	if err == nil {
+		err = f.err
+	}
+	return err
+}
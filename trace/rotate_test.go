@@ -0,0 +1,115 @@
+package trace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSegment returns the records of a trace file in CSV format, which is
+// compressed if its name ends with '.gz'
+func readSegment(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if strings.HasSuffix(path, ".gz") {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	// The name of the trace file holds characters which are special in
+	// file name patterns. The file which such a pattern would match must
+	// not be removed.
+	path := filepath.Join(dir, "trace[1].csv")
+	other := filepath.Join(dir, "trace1.csv."+testTime.Format(segmentTimeFormat))
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	info := &StreamInfo{Schema: SchemaVersion, Version: "v0.5", Start: testTime}
+	rotate := RotateOptions{MaxSize: 1, Keep: 2, Compress: "gzip"}
+	tracer, err := NewTracer("csv", path, info, QueueOptions{}, rotate)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ops := testOps()[:5]
+	for _, op := range ops {
+		tracer.Trace(op)
+		// Let the segments be named after distinct times
+		time.Sleep(time.Millisecond)
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file removed: %s", err)
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "trace?1?.csv.*.gz"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	// Each event but the last one was written to a segment of its own,
+	// of which only the last two are kept
+	if len(segments) != rotate.Keep {
+		t.Fatalf("got segments %q, want %d", segments, rotate.Keep)
+	}
+	sort.Strings(segments)
+	files := append(segments, path)
+	header := strings.Join(info.MarshalCSV(), ",")
+	for i, f := range files {
+		records := readSegment(t, f)
+		if len(records) != 2 || records[0] != header {
+			t.Errorf("%s: got records %q, want the header and an event", f, records)
+			continue
+		}
+		typ := ops[len(ops)-len(files)+i].GetHeader().OperType.String()
+		if !strings.Contains(records[1], ","+typ+",") {
+			t.Errorf("%s: got event %q, want a '%s' event", f, records[1], typ)
+		}
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.csv")
+	f, err := openRotatingFile(path, RotateOptions{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("event\n")); err != nil {
+		t.Fatalf("%s", err)
+	}
+	now := time.Now()
+	if f.due(now) {
+		t.Errorf("new file due for rotation")
+	}
+	if !f.due(now.Add(2 * time.Hour)) {
+		t.Errorf("old file not due for rotation")
+	}
+	if err := f.rotate(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if f.due(now.Add(time.Minute)) {
+		t.Errorf("file just rotated due for rotation")
+	}
+	segments, _ := filepath.Glob(path + ".*")
+	if len(segments) != 1 || len(readSegment(t, segments[0])) != 1 {
+		t.Errorf("got segments %q, want one with the event", segments)
+	}
+}
@@ -0,0 +1,393 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// opFactories creates an operation with zero values for each operation type
+var opFactories = map[FSOperType]func() FsOperTracer{
+	FsOpen:        func() FsOperTracer { return &OpenOp{} },
+	FsRead:        func() FsOperTracer { return &ReadOp{} },
+	FsWrite:       func() FsOperTracer { return &WriteOp{} },
+	FsFlush:       func() FsOperTracer { return &FlushOp{} },
+	FsRelease:     func() FsOperTracer { return &ReleaseOp{} },
+	FsMkdir:       func() FsOperTracer { return &MkdirOp{} },
+	FsRemove:      func() FsOperTracer { return &RemoveOp{} },
+	FsCreate:      func() FsOperTracer { return &CreateOp{} },
+	FsSymlink:     func() FsOperTracer { return &SymlinkOp{} },
+	FsStat:        func() FsOperTracer { return &LookupOp{} },
+	FsReadDir:     func() FsOperTracer { return &ReadDirOp{} },
+	FsStatfs:      func() FsOperTracer { return &StatFsOp{} },
+	FsRename:      func() FsOperTracer { return &RenameOp{} },
+	FsReadLink:    func() FsOperTracer { return &ReadlinkOp{} },
+	FsAccess:      func() FsOperTracer { return &AccessOp{} },
+	FsSetAttr:     func() FsOperTracer { return &SetattrOp{} },
+	FsListXattr:   func() FsOperTracer { return &ListxattrOp{} },
+	FsGetXattr:    func() FsOperTracer { return &GetxattrOp{} },
+	FsRemoveXattr: func() FsOperTracer { return &RemovexattrOp{} },
+	FsSetXattr:    func() FsOperTracer { return &SetxattrOp{} },
+	FsLost:        func() FsOperTracer { return &LostOp{} },
+	FsLink:        func() FsOperTracer { return &LinkOp{} },
+	FsMknod:       func() FsOperTracer { return &MknodOp{} },
+	FsFsync:       func() FsOperTracer { return &FsyncOp{} },
+}
+
+// newOp returns an operation of type t with zero values
+func newOp(t FSOperType) FsOperTracer {
+	op := opFactories[t]()
+	op.GetHeader().OperType = t
+	return op
+}
+
+// opSamples returns the operations whose JSON encoding describes the records
+// of type t. The fields present in all of them are required; the others are
+// optional.
+func opSamples(t FSOperType) []FsOperTracer {
+	samples := []FsOperTracer{newOp(t)}
+	// The header tells whether the result is an injected fault and how
+	// long the operation was delayed only when relevant
+	injected := newOp(t)
+	injected.GetHeader().Injected = true
+	injected.GetHeader().Delay = 1
+	samples = append(samples, injected)
+	if t == FsSetAttr {
+		// Only the attributes being changed are present, as well as the
+		// previous ones if they could be retrieved
+		full := newOp(t).(*SetattrOp)
+		full.AttrValid = ^fuse.SetattrValid(0)
+		full.Applied = full.AttrValid
+		full.Failed = full.AttrValid
+		full.Previous = &fuse.Attr{}
+		samples = append(samples, full)
+	}
+	return samples
+}
+
+// JSONSchema returns a JSON Schema describing each record of a trace
+// stream in JSON format. It is derived from the encoding of the operations,
+// so that it always matches the records cluefs emits.
+func JSONSchema() ([]byte, error) {
+	info, err := sampleSchema(&StreamInfo{})
+	if err != nil {
+		return nil, err
+	}
+	defs := map[string]interface{}{
+		"stream": info,
+	}
+	refs := []interface{}{
+		map[string]string{"$ref": "#/definitions/stream"},
+	}
+	names := make([]string, 0, len(opNames))
+	types := make(map[string]FSOperType, len(opNames))
+	for t, n := range opNames {
+		names = append(names, n)
+		types[n] = t
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		samples := opSamples(types[n])
+		values := make([]interface{}, len(samples))
+		for i := range samples {
+			values[i] = samples[i]
+		}
+		s, err := sampleSchema(values...)
+		if err != nil {
+			return nil, fmt.Errorf("could not build schema for operation '%s' [%s]", n, err)
+		}
+		// Tell records apart by their operation type and define the common
+		// header only once
+		props := s["properties"].(map[string]interface{})
+		op := props["op"].(map[string]interface{})
+		op["properties"].(map[string]interface{})["type"] = map[string]interface{}{"const": n}
+		defs["hdr"] = props["hdr"]
+		props["hdr"] = map[string]string{"$ref": "#/definitions/hdr"}
+		defs[n] = s
+		refs = append(refs, map[string]string{"$ref": "#/definitions/" + n})
+	}
+	schema := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"$id":         fmt.Sprintf("https://github.com/airnandez/cluefs/schema/v%d.json", SchemaVersion),
+		"title":       "cluefs trace record",
+		"description": fmt.Sprintf("A record of a cluefs trace stream in JSON format, schema version %d", SchemaVersion),
+		"version":     SchemaVersion,
+		"oneOf":       refs,
+		"definitions": defs,
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// sampleSchema builds the schema of the JSON objects which encodings are
+// those of values. The properties present in the encoding of all the
+// values are required.
+func sampleSchema(values ...interface{}) (map[string]interface{}, error) {
+	var res map[string]interface{}
+	for _, v := range values {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var decoded interface{}
+		if err := dec.Decode(&decoded); err != nil {
+			return nil, err
+		}
+		s := valueSchema(decoded)
+		if res == nil {
+			res = s
+		} else {
+			mergeSchema(res, s)
+		}
+	}
+	return res, nil
+}
+
+// valueSchema returns the schema of a decoded JSON value
+func valueSchema(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props := make(map[string]interface{}, len(v))
+		required := make([]string, 0, len(v))
+		for k, e := range v {
+			props[k] = valueSchema(e)
+			required = append(required, k)
+		}
+		sort.Strings(required)
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	case []interface{}:
+		items := map[string]interface{}{"type": "string"}
+		if len(v) > 0 {
+			items = valueSchema(v[0])
+		}
+		return map[string]interface{}{"type": "array", "items": items}
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return map[string]interface{}{"type": "number"}
+		}
+		return map[string]interface{}{"type": "integer"}
+	case string:
+		return map[string]interface{}{"type": "string"}
+	case bool:
+		return map[string]interface{}{"type": "boolean"}
+	}
+	return map[string]interface{}{"type": "null"}
+}
+
+// mergeSchema adds to the object schema dst the properties of the object
+// schema src and keeps required only the properties required by both
+func mergeSchema(dst, src map[string]interface{}) {
+	dprops, ok := dst["properties"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	sprops := src["properties"].(map[string]interface{})
+	for k, s := range sprops {
+		d, ok := dprops[k]
+		if !ok {
+			dprops[k] = s
+			continue
+		}
+		dm, dok := d.(map[string]interface{})
+		sm, sok := s.(map[string]interface{})
+		if dok && sok && dm["type"] == "object" && sm["type"] == "object" {
+			mergeSchema(dm, sm)
+		}
+	}
+	inSrc := make(map[string]bool, len(sprops))
+	for k := range sprops {
+		inSrc[k] = true
+	}
+	required := make([]string, 0, len(dprops))
+	for _, k := range dst["required"].([]string) {
+		if inSrc[k] {
+			required = append(required, k)
+		}
+	}
+	dst["required"] = required
+}
+
+// Types of the values of the records in CSV format
+const (
+	csvTime    = "time"    // RFC 3339 time stamp with nanoseconds
+	csvInteger = "integer" // decimal integer
+	csvOctal   = "octal"   // permission bits, as an octal integer
+	csvString  = "string"
+	csvNames   = "names" // names separated by '|', possibly none
+)
+
+// csvColumn describes a value of the records in CSV format. Its name is the
+// key of the same value in JSON format, the keys of the nested objects being
+// joined with a dot, e.g. "new.size".
+type csvColumn struct {
+	name string
+	typ  string
+}
+
+// csvStreamColumns are the values of the stream header record
+var csvStreamColumns = []csvColumn{
+	{"tag", csvString},
+	{"schema", csvInteger},
+	{"version", csvString},
+	{"mount", csvString},
+	{"shadow", csvString},
+	{"host", csvString},
+	{"start", csvTime},
+}
+
+// csvHeaderColumns are the values common to all the event records, which
+// the values specific to each type of operation follow. Values are only
+// added at the end, in a new schema version.
+var csvHeaderColumns = []csvColumn{
+	{"start", csvTime},
+	{"end", csvTime},
+	{"nselaps", csvInteger},
+	{"usr", csvString},
+	{"uid", csvInteger},
+	{"grp", csvString},
+	{"gid", csvInteger},
+	{"proc", csvString},
+	{"pid", csvInteger},
+	{"path", csvString},
+	{"isdir", csvString},
+	{"type", csvString},
+	{"result", csvString},
+	{"errno", csvInteger},
+	{"injected", csvString},
+	{"nsdelay", csvInteger},
+}
+
+// csvColumns lists the values specific to each type of operation, in the
+// order they appear in the records in CSV format. The operations without
+// specific values are not present.
+var csvColumns = map[FSOperType][]csvColumn{
+	FsOpen: {
+		{"flags", csvNames},
+		{"perm", csvOctal},
+		{"size", csvInteger},
+		{"blksize", csvInteger},
+		{"openid", csvInteger},
+	},
+	FsRead: {
+		{"filesize", csvInteger},
+		{"position", csvInteger},
+		{"bytesreq", csvInteger},
+		{"bytesread", csvInteger},
+		{"openid", csvInteger},
+	},
+	FsWrite: {
+		{"position", csvInteger},
+		{"bytesreq", csvInteger},
+		{"byteswritten", csvInteger},
+		{"openid", csvInteger},
+	},
+	FsFlush: {
+		{"flags", csvNames},
+		{"size", csvInteger},
+		{"openid", csvInteger},
+	},
+	FsFsync: {
+		{"datasync", csvString},
+	},
+	FsRelease: {
+		{"openid", csvInteger},
+	},
+	FsMkdir: {
+		{"mode", csvOctal},
+	},
+	FsMknod: {
+		{"filetype", csvString},
+		{"mode", csvOctal},
+		{"rdev", csvInteger},
+	},
+	FsCreate: {
+		{"flags", csvNames},
+		{"perm", csvOctal},
+		{"openid", csvInteger},
+	},
+	FsSymlink: {
+		{"target", csvString},
+	},
+	FsReadDir: {
+		{"openid", csvInteger},
+	},
+	FsRename: {
+		{"new", csvString},
+	},
+	FsLink: {
+		{"new", csvString},
+	},
+	FsAccess: {
+		{"mode", csvString},
+	},
+	FsSetAttr: {
+		{"applied", csvNames},
+		{"failed", csvNames},
+		{"new.size", csvInteger},
+		{"new.mode", csvOctal},
+		{"new.uid", csvInteger},
+		{"new.gid", csvInteger},
+		{"new.atime", csvTime},
+		{"new.mtime", csvTime},
+		{"new.handle", csvInteger},
+		{"old.size", csvInteger},
+		{"old.mode", csvOctal},
+		{"old.uid", csvInteger},
+		{"old.gid", csvInteger},
+		{"old.atime", csvTime},
+		{"old.mtime", csvTime},
+	},
+	FsGetXattr: {
+		{"name", csvString},
+	},
+	FsListXattr: {
+		{"size", csvInteger},
+	},
+	FsSetXattr: {
+		{"name", csvString},
+	},
+	FsRemoveXattr: {
+		{"name", csvString},
+	},
+	FsLost: {
+		{"count", csvInteger},
+	},
+}
+
+// CSVSchema describes the values of each record of a trace stream in CSV
+// format, as records made of the kind of record, the position of the value
+// in the record, starting at 1, its name and its type. The kind of record is
+// "stream" for the stream header, "event" for the values common to all the
+// events and the type of operation for the values specific to it, which
+// follow the common ones. The name of a value is its key in JSON format.
+func CSVSchema() [][]string {
+	res := [][]string{{"record", "position", "name", "type"}}
+	add := func(kind string, first int, columns []csvColumn) {
+		for i, c := range columns {
+			res = append(res, []string{kind, fmt.Sprintf("%d", first+i), c.name, c.typ})
+		}
+	}
+	add("stream", 1, csvStreamColumns)
+	add("event", 1, csvHeaderColumns)
+	names := make([]string, 0, len(opNames))
+	types := make(map[string]FSOperType, len(opNames))
+	for t, n := range opNames {
+		names = append(names, n)
+		types[n] = t
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		add(n, len(csvHeaderColumns)+1, csvColumns[types[n]])
+	}
+	return res
+}
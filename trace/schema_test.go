@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// jsonKeys returns the keys of the JSON encoding of op, in the "hdr" and
+// the "op" objects, flattened as the JSON decoder does
+func jsonKeys(t *testing.T, op FsOperTracer) map[string]bool {
+	b, err := json.Marshal(op)
+	if err != nil {
+		t.Fatalf("%s: %s", op.GetHeader().OperType, err)
+	}
+	var record struct {
+		Hdr jsonFields `json:"hdr"`
+		Op  jsonFields `json:"op"`
+	}
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatalf("%s: %s", op.GetHeader().OperType, err)
+	}
+	record.Op.flatten()
+	keys := make(map[string]bool)
+	for _, f := range []jsonFields{record.Hdr, record.Op} {
+		for k := range f {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+func TestCSVColumns(t *testing.T) {
+	// Some values are optional in JSON format: the columns must be keys of
+	// the encoding of at least one of the operations of each type
+	keys := make(map[FSOperType]map[string]bool)
+	for _, op := range testOps() {
+		typ := op.GetHeader().OperType
+		if n, want := len(op.MarshalCSV()), len(csvHeaderColumns)+len(csvColumns[typ]); n != want {
+			t.Errorf("%s: %d values in CSV format, %d columns", typ, n, want)
+		}
+		if keys[typ] == nil {
+			keys[typ] = make(map[string]bool)
+		}
+		for k := range jsonKeys(t, op) {
+			keys[typ][k] = true
+		}
+	}
+	for typ, columns := range csvColumns {
+		for _, c := range columns {
+			if !keys[typ][c.name] {
+				t.Errorf("%s: column '%s' is not a key in JSON format", typ, c.name)
+			}
+		}
+	}
+}
+
+func TestCSVHeaderColumns(t *testing.T) {
+	// The header of the operation tells whether the result is injected and
+	// the delay only when relevant
+	op := newOp(FsStat)
+	op.GetHeader().Injected = true
+	op.GetHeader().Delay = 1
+	keys := jsonKeys(t, op)
+	for _, c := range csvHeaderColumns {
+		if !keys[c.name] {
+			t.Errorf("header column '%s' is not a key in JSON format", c.name)
+		}
+	}
+}
+
+func TestCSVSchema(t *testing.T) {
+	want := 1 + len(csvStreamColumns) + len(csvHeaderColumns)
+	for _, columns := range csvColumns {
+		want += len(columns)
+	}
+	records := CSVSchema()
+	if len(records) != want {
+		t.Errorf("%d records, want %d", len(records), want)
+	}
+	for _, r := range records {
+		if len(r) != 4 {
+			t.Errorf("record %v has %d values", r, len(r))
+		}
+	}
+	if _, err := JSONSchema(); err != nil {
+		t.Errorf("JSONSchema: %s", err)
+	}
+}
@@ -0,0 +1,247 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// socketWriteTimeout is how long writing to a client may take before the
+// client is disconnected
+const socketWriteTimeout = 10 * time.Second
+
+// socketNetworks are the prefixes of the trace destinations which are
+// sockets, e.g. 'unix:/run/cluefs.sock' or 'tcp:127.0.0.1:7000'
+var socketNetworks = map[string]string{
+	"unix:": "unix",
+	"tcp:":  "tcp",
+}
+
+// parseSocketAddress returns the network and the address of the socket
+// specified by dest. It returns false if dest is not a socket.
+func parseSocketAddress(dest string) (string, string, bool) {
+	for prefix, network := range socketNetworks {
+		if strings.HasPrefix(dest, prefix) {
+			return network, dest[len(prefix):], true
+		}
+	}
+	return "", "", false
+}
+
+// SocketTracer sends the events to the clients connected to a Unix domain
+// socket or to a TCP socket on the loopback interface. Each client receives
+// the stream header followed by the events traced from the moment it
+// connects until it disconnects. The events are queued separately for each
+// client, so that a slow client loses events instead of slowing down the
+// file system or the other clients.
+type SocketTracer struct {
+	kind     string
+	info     *StreamInfo
+	opts     QueueOptions
+	listener net.Listener
+
+	// mutex protects clients, closed and dropped, which counts the events
+	// dropped for the clients already disconnected
+	mutex   sync.RWMutex
+	clients map[*socketClient]bool
+	closed  bool
+	dropped uint64
+
+	// done is closed when no more clients are accepted
+	done chan struct{}
+}
+
+type socketClient struct {
+	conn   net.Conn
+	tracer Tracer
+}
+
+// NewSocketTracer creates a tracer which listens on the socket at address
+// on network, either "unix" or "tcp", and sends the events to each connected
+// client in the format kind ("csv", "json" or "bin"). TCP sockets must be
+// bound to a loopback address. The queue of events of each client is set by
+// opts, except that events are dropped instead of blocking when it is full.
+func NewSocketTracer(kind, network, address string, info *StreamInfo, opts QueueOptions) (*SocketTracer, error) {
+	switch network {
+	case "unix":
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	case "tcp":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address '%s' [%s]", address, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("'%s' is not a loopback address", host)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network '%s'", network)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on '%s' [%s]", address, err)
+	}
+	if network == "unix" {
+		// Events reveal the names of the files being accessed
+		if err := os.Chmod(address, 0600); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("could not set permissions of '%s' [%s]", address, err)
+		}
+	}
+	if opts.Policy == PolicyBlock {
+		opts.Policy = PolicyDropNewest
+	}
+	tracer := &SocketTracer{
+		kind:     kind,
+		info:     info,
+		opts:     opts,
+		listener: listener,
+		clients:  make(map[*socketClient]bool),
+		done:     make(chan struct{}),
+	}
+	go tracer.serve()
+	return tracer, nil
+}
+
+// removeStaleSocket removes the Unix domain socket at path if no process
+// is listening on it any more
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// Let Listen report whatever prevents using path
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket '%s' is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// serve accepts the clients until the tracer is closed
+func (t *SocketTracer) serve() {
+	defer close(t.done)
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.mutex.RLock()
+			closed := t.closed
+			t.mutex.RUnlock()
+			if closed {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		t.add(conn)
+	}
+}
+
+func (t *SocketTracer) add(conn net.Conn) {
+	c := &socketClient{
+		conn:   conn,
+		tracer: newWriterTracer(t.kind, socketConn{conn}, conn, t.info, t.opts),
+	}
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		c.tracer.Close()
+		return
+	}
+	t.clients[c] = true
+	t.mutex.Unlock()
+
+	// Clients are not expected to send anything: they are disconnected
+	// once their side of the connection is closed
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		t.remove(c)
+	}()
+}
+
+// remove disconnects a client after writing its pending events
+func (t *SocketTracer) remove(c *socketClient) {
+	t.mutex.Lock()
+	found := t.clients[c]
+	if found {
+		// No more events are queued for this client
+		delete(t.clients, c)
+		t.dropped += c.tracer.(QueueReporter).Dropped()
+	}
+	t.mutex.Unlock()
+	if found {
+		c.tracer.Close()
+	}
+}
+
+// QueueLength returns the number of events waiting to be sent to all the
+// connected clients
+func (t *SocketTracer) QueueLength() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	n := 0
+	for c := range t.clients {
+		n += c.tracer.(QueueReporter).QueueLength()
+	}
+	return n
+}
+
+// Dropped returns the number of events dropped so far because the queue of
+// a client was full
+func (t *SocketTracer) Dropped() uint64 {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	n := t.dropped
+	for c := range t.clients {
+		n += c.tracer.(QueueReporter).Dropped()
+	}
+	return n
+}
+
+func (t *SocketTracer) Trace(op FsOperTracer) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for c := range t.clients {
+		c.tracer.Trace(op)
+	}
+}
+
+// Close stops accepting clients and disconnects the connected ones once
+// their pending events are written
+func (t *SocketTracer) Close() error {
+	t.mutex.Lock()
+	t.closed = true
+	clients := t.clients
+	t.clients = make(map[*socketClient]bool)
+	t.mutex.Unlock()
+	err := t.listener.Close()
+	<-t.done
+	for c := range clients {
+		c.tracer.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("could not close socket [%s]", err)
+	}
+	return nil
+}
+
+// socketConn is the connection to a client. The client is disconnected when
+// writing to it fails or takes too long.
+type socketConn struct {
+	net.Conn
+}
+
+func (c socketConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.Conn.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,116 @@
+package trace
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialClients connects n clients to t and waits until t accepted them
+func dialClients(tt *testing.T, t *SocketTracer, n int) []net.Conn {
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		conn, err := net.Dial("tcp", t.listener.Addr().String())
+		if err != nil {
+			tt.Fatalf("%s", err)
+		}
+		conns[i] = conn
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		t.mutex.RLock()
+		accepted := len(t.clients)
+		t.mutex.RUnlock()
+		if accepted == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			tt.Fatalf("%d clients accepted, want %d", accepted, n)
+		}
+	}
+}
+
+// readLines reads n lines sent to a client
+func readLines(t *testing.T, r *bufio.Reader, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("line %d: %s", i, err)
+		}
+		lines[i] = strings.TrimSuffix(line, "\n")
+	}
+	return lines
+}
+
+func TestSocketClients(t *testing.T) {
+	info := &StreamInfo{Schema: SchemaVersion, Version: "v0.5", Start: testTime}
+	tracer, err := NewSocketTracer("csv", "tcp", "127.0.0.1:0", info, QueueOptions{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	conns := dialClients(t, tracer, 2)
+	ops := testOps()
+	for _, op := range ops {
+		tracer.Trace(op)
+	}
+	csvStream, _ := encodeText(t, info, ops)
+	want := strings.Split(strings.TrimSuffix(string(csvStream), "\n"), "\n")
+	readers := make([]*bufio.Reader, len(conns))
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		readers[i] = bufio.NewReader(conn)
+		got := readLines(t, readers[i], len(want))
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("client %d: got record %q, want %q", i, got[j], want[j])
+			}
+		}
+	}
+
+	// Closing the tracer disconnects the clients
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for i, r := range readers {
+		if line, err := r.ReadString('\n'); err != io.EOF {
+			t.Errorf("client %d: got %q, %v after closing, want EOF", i, line, err)
+		}
+		conns[i].Close()
+	}
+}
+
+func TestSocketSlowClient(t *testing.T) {
+	info := &StreamInfo{Schema: SchemaVersion, Version: "v0.5", Start: testTime}
+	const batch = 100
+	tracer, err := NewSocketTracer("csv", "tcp", "127.0.0.1:0", info, QueueOptions{Size: 2 * batch})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer tracer.Close()
+	conns := dialClients(t, tracer, 2)
+	fast, slow := conns[0], conns[1]
+	fast.SetReadDeadline(time.Now().Add(time.Minute))
+	r := bufio.NewReader(fast)
+	readLines(t, r, 1)
+
+	// The slow client reads nothing: once the buffers of its connection
+	// are full, its events are dropped while the fast client gets all of
+	// them
+	op := newOp(FsStat)
+	op.GetHeader().names = knownNames("fabio", "lsst", "/usr/bin/bash")
+	op.GetHeader().Path = "/" + strings.Repeat("x", 4096)
+	for n := 0; tracer.Dropped() == 0; n++ {
+		if n == 1000 {
+			t.Fatalf("no events dropped for the slow client")
+		}
+		for i := 0; i < batch; i++ {
+			tracer.Trace(op)
+		}
+		readLines(t, r, batch)
+	}
+	slow.Close()
+	fast.Close()
+}
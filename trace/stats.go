@@ -0,0 +1,430 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// LatencyBuckets is the number of buckets of the latency histograms. Bucket
+// 0 counts the operations which took less than 1µs and bucket i the ones
+// which took less than 2^i µs but at least 2^(i-1) µs. The last bucket
+// counts all the operations which took longer.
+const LatencyBuckets = 24
+
+// LatencyBound returns the upper bound of bucket i of the latency
+// histograms, which is infinite for the last bucket
+func LatencyBound(i int) time.Duration {
+	return time.Duration(1<<uint(i)) * time.Microsecond
+}
+
+// maxStatsEntries is the maximum number of paths and of processes for which
+// statistics are kept. Operations on other paths or by other processes are
+// accounted for under the key otherStats.
+const (
+	maxStatsEntries = 100000
+	otherStats      = "(other)"
+)
+
+// Stats are the running totals of a set of operations
+type Stats struct {
+	Count        uint64
+	Errors       uint64
+	BytesRead    uint64
+	BytesWritten uint64
+	Elapsed      time.Duration
+	Latency      [LatencyBuckets]uint64
+}
+
+func (s *Stats) add(op FsOperTracer) {
+	h := op.GetHeader()
+	s.Count++
+	if h.Errno != 0 {
+		s.Errors++
+	}
+	d := h.Duration()
+	s.Elapsed += d
+	i := 0
+	if d > 0 {
+		i = bits.Len64(uint64(d / time.Microsecond))
+	}
+	if i >= LatencyBuckets {
+		i = LatencyBuckets - 1
+	}
+	s.Latency[i]++
+	// The number of bytes is -1 if the operation failed before reading or
+	// writing anything
+	switch op := op.(type) {
+	case *ReadOp:
+		if op.BytesRead > 0 {
+			s.BytesRead += uint64(op.BytesRead)
+		}
+	case *WriteOp:
+		if op.BytesWritten > 0 {
+			s.BytesWritten += uint64(op.BytesWritten)
+		}
+	}
+}
+
+// Mean returns the mean duration of the operations
+func (s *Stats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Elapsed / time.Duration(s.Count)
+}
+
+// Percentile returns an upper bound of the duration of the fraction p of
+// the fastest operations, e.g. 0.99. It is infinite, that is the maximum
+// time.Duration, if it is larger than the bound of the last bucket.
+func (s *Stats) Percentile(p float64) time.Duration {
+	seen, want := uint64(0), uint64(p*float64(s.Count)+0.5)
+	for i, n := range s.Latency {
+		seen += n
+		if seen >= want && seen > 0 {
+			if i == LatencyBuckets-1 {
+				break
+			}
+			return LatencyBound(i)
+		}
+	}
+	if s.Count == 0 {
+		return 0
+	}
+	return time.Duration(1<<63 - 1)
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"count":         s.Count,
+		"errors":        s.Errors,
+		"bytes_read":    s.BytesRead,
+		"bytes_written": s.BytesWritten,
+		"nselaps":       s.Elapsed.Nanoseconds(),
+		"latency":       s.Latency,
+	})
+}
+
+// ProcStats are the running totals of the operations requested by a process
+type ProcStats struct {
+	Stats
+	Pid  uint32
+	Proc string
+}
+
+// StatsTracer is a tracer which keeps running totals of the operations per
+// type of operation, per path and per process, instead of recording each
+// one of them. It also counts the errors of each type of operation per
+// error number. As the other tracers, it queues the events and accounts for
+// them in the goroutine of its collector, so that reading the totals never
+// delays the file system operations.
+type StatsTracer struct {
+	*collector
+
+	// mutex protects the fields below, which are updated by the goroutine
+	// of the collector
+	mutex   sync.Mutex
+	start   time.Time
+	details bool
+	total   Stats
+	ops     map[FSOperType]*Stats
+	errnos  map[FSOperType]map[syscall.Errno]uint64
+	paths   map[string]*Stats
+	procs   map[uint32]*ProcStats
+}
+
+// NewStatsTracer creates a tracer which keeps running totals of the
+// operations. If details is false, no totals are kept per path and per
+// process.
+func NewStatsTracer(details bool, opts QueueOptions) *StatsTracer {
+	tracer := &StatsTracer{
+		start:   time.Now(),
+		details: details,
+		ops:     make(map[FSOperType]*Stats),
+		errnos:  make(map[FSOperType]map[syscall.Errno]uint64),
+		paths:   make(map[string]*Stats),
+		procs:   make(map[uint32]*ProcStats),
+	}
+	// Start the event collector
+	tracer.collector = newCollector(opts, nil, tracer, nil)
+	return tracer
+}
+
+func (t *StatsTracer) writeInfo(info *StreamInfo) error {
+	return nil
+}
+
+// write accounts for the event op in the running totals
+func (t *StatsTracer) write(op FsOperTracer) error {
+	h := op.GetHeader()
+	if h.OperType == FsLost {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.total.add(op)
+	s, ok := t.ops[h.OperType]
+	if !ok {
+		s = &Stats{}
+		t.ops[h.OperType] = s
+	}
+	s.add(op)
+	if h.Errno != 0 {
+		e, ok := t.errnos[h.OperType]
+		if !ok {
+			e = make(map[syscall.Errno]uint64)
+			t.errnos[h.OperType] = e
+		}
+		e[h.Errno]++
+	}
+	if !t.details {
+		return nil
+	}
+	if len(h.Path) > 0 {
+		s, ok = t.paths[h.Path]
+		if !ok {
+			key := h.Path
+			if len(t.paths) >= maxStatsEntries {
+				key = otherStats
+			}
+			if s, ok = t.paths[key]; !ok {
+				s = &Stats{}
+				t.paths[key] = s
+			}
+		}
+		s.add(op)
+	}
+	p, ok := t.procs[h.Pid]
+	if !ok {
+		pid := h.Pid
+		if len(t.procs) >= maxStatsEntries {
+			pid = 0
+		}
+		if p, ok = t.procs[pid]; !ok {
+			// The executable is looked up only once for each process
+			p = &ProcStats{Pid: pid, Proc: otherStats}
+			if pid != 0 {
+				p.Proc = h.procNames().proc
+			}
+			t.procs[pid] = p
+		}
+	}
+	p.add(op)
+	return nil
+}
+
+func (t *StatsTracer) flush() error {
+	return nil
+}
+
+func (t *StatsTracer) Trace(op FsOperTracer) {
+	t.put(op)
+}
+
+// Close waits until all the queued events are accounted for
+func (t *StatsTracer) Close() error {
+	return t.close()
+}
+
+// StatsSnapshot is a copy of the running totals of a StatsTracer. Errnos
+// holds the number of errors of each type of operation per error name,
+// e.g. "ENOENT".
+type StatsSnapshot struct {
+	Start  time.Time
+	Time   time.Time
+	Total  Stats
+	Ops    map[FSOperType]Stats
+	Errnos map[FSOperType]map[string]uint64
+	Paths  map[string]Stats
+	Procs  []ProcStats
+}
+
+// Snapshot returns a copy of the running totals
+func (t *StatsTracer) Snapshot() *StatsSnapshot {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := &StatsSnapshot{
+		Start:  t.start,
+		Time:   time.Now(),
+		Total:  t.total,
+		Ops:    make(map[FSOperType]Stats, len(t.ops)),
+		Errnos: make(map[FSOperType]map[string]uint64, len(t.errnos)),
+		Paths:  make(map[string]Stats, len(t.paths)),
+		Procs:  make([]ProcStats, 0, len(t.procs)),
+	}
+	for k, v := range t.ops {
+		s.Ops[k] = *v
+	}
+	for k, v := range t.errnos {
+		e := make(map[string]uint64, len(v))
+		for errno, n := range v {
+			e[errnoString(errno)] += n
+		}
+		s.Errnos[k] = e
+	}
+	for k, v := range t.paths {
+		s.Paths[k] = *v
+	}
+	for _, v := range t.procs {
+		s.Procs = append(s.Procs, *v)
+	}
+	sort.Slice(s.Procs, func(i, j int) bool { return s.Procs[i].Pid < s.Procs[j].Pid })
+	return s
+}
+
+func (s *StatsSnapshot) MarshalJSON() ([]byte, error) {
+	bounds := make([]int64, LatencyBuckets-1)
+	for i := range bounds {
+		bounds[i] = int64(LatencyBound(i) / time.Microsecond)
+	}
+	ops := make(map[string]*Stats, len(s.Ops))
+	for k, v := range s.Ops {
+		v := v
+		ops[k.String()] = &v
+	}
+	errnos := make(map[string]map[string]uint64, len(s.Errnos))
+	for k, v := range s.Errnos {
+		errnos[k.String()] = v
+	}
+	paths := make(map[string]*Stats, len(s.Paths))
+	for k, v := range s.Paths {
+		v := v
+		paths[k] = &v
+	}
+	procs := make([]interface{}, len(s.Procs))
+	for i := range s.Procs {
+		p := &s.Procs[i]
+		procs[i] = map[string]interface{}{
+			"pid":   p.Pid,
+			"proc":  p.Proc,
+			"stats": &p.Stats,
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"stats": map[string]interface{}{
+			"start":             s.Start.UTC().Format(time.RFC3339Nano),
+			"time":              s.Time.UTC().Format(time.RFC3339Nano),
+			"latency_bounds_us": bounds,
+			"total":             &s.Total,
+			"ops":               ops,
+			"errnos":            errnos,
+			"paths":             paths,
+			"procs":             procs,
+		},
+	})
+}
+
+// statsRow is a line of the table of statistics
+type statsRow struct {
+	name  string
+	stats Stats
+}
+
+// hottest returns the n rows with the most operations
+func hottest(rows []statsRow, n int) []statsRow {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].stats.Count != rows[j].stats.Count {
+			return rows[i].stats.Count > rows[j].stats.Count
+		}
+		return rows[i].name < rows[j].name
+	})
+	if len(rows) > n {
+		rows = rows[:n]
+	}
+	return rows
+}
+
+// WriteTable writes the statistics as a table, with one line per type of
+// operation and the top n paths and processes by number of operations. If
+// prev is not nil, the rates are computed since that snapshot.
+func (s *StatsSnapshot) WriteTable(w io.Writer, prev *StatsSnapshot, n int) error {
+	since, count := s.Start, uint64(0)
+	if prev != nil {
+		since, count = prev.Time, prev.Total.Count
+	}
+	rate := 0.0
+	if secs := s.Time.Sub(since).Seconds(); secs > 0 {
+		rate = float64(s.Total.Count-count) / secs
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "cluefs - up %s, %d operations, %.1f ops/s, %s read, %s written, %d errors\n\n",
+		s.Time.Sub(s.Start).Truncate(time.Second),
+		s.Total.Count,
+		rate,
+		sizeString(s.Total.BytesRead),
+		sizeString(s.Total.BytesWritten),
+		s.Total.Errors)
+	tw.Flush()
+
+	ops := make([]statsRow, 0, len(s.Ops))
+	for k, v := range s.Ops {
+		ops = append(ops, statsRow{k.String(), v})
+	}
+	paths := make([]statsRow, 0, len(s.Paths))
+	for k, v := range s.Paths {
+		paths = append(paths, statsRow{k, v})
+	}
+	procs := make([]statsRow, 0, len(s.Procs))
+	for _, p := range s.Procs {
+		procs = append(procs, statsRow{fmt.Sprintf("%d %s", p.Pid, p.Proc), p.Stats})
+	}
+	for _, table := range []struct {
+		title string
+		rows  []statsRow
+	}{
+		{"OPERATION", hottest(ops, len(ops))},
+		{"PATH", hottest(paths, n)},
+		{"PROCESS", hottest(procs, n)},
+	} {
+		fmt.Fprintf(tw, "COUNT\tERRORS\tREAD\tWRITTEN\tMEAN\tP99\t  %s\n", table.title)
+		for _, r := range table.rows {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t  %s\n",
+				r.stats.Count,
+				r.stats.Errors,
+				sizeString(r.stats.BytesRead),
+				sizeString(r.stats.BytesWritten),
+				durationString(r.stats.Mean()),
+				durationString(r.stats.Percentile(0.99)),
+				r.name)
+		}
+		fmt.Fprintf(tw, "\n")
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sizeString returns a human readable size, e.g. '12.3M'
+func sizeString(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d", n)
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v, i = v/1024, i+1
+	}
+	return fmt.Sprintf("%.1f%c", v, units[i])
+}
+
+// durationString returns a human readable duration with 3 significant digits
+func durationString(d time.Duration) string {
+	switch {
+	case d == time.Duration(1<<63-1):
+		return "inf"
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	case d >= time.Microsecond:
+		return d.Round(10 * time.Nanosecond).String()
+	}
+	return d.String()
+}
@@ -0,0 +1,57 @@
+package trace
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsPercentile(t *testing.T) {
+	var s Stats
+	if p := s.Percentile(0.5); p != 0 {
+		t.Errorf("got median %s of no operations, want 0", p)
+	}
+	durations := []time.Duration{
+		500 * time.Nanosecond,  // bucket 0, below 1µs
+		1500 * time.Nanosecond, // bucket 1, below 2µs
+		3 * time.Microsecond,   // bucket 2, below 4µs
+		3 * time.Microsecond,
+		100 * time.Microsecond, // bucket 7, below 128µs
+		10 * time.Second,       // last bucket
+	}
+	for _, d := range durations {
+		op := newOp(FsRead)
+		h := op.GetHeader()
+		h.Start = testTime
+		h.End = testTime.Add(d)
+		s.add(op)
+	}
+	buckets := map[int]uint64{0: 1, 1: 1, 2: 2, 7: 1, LatencyBuckets - 1: 1}
+	for i, n := range s.Latency {
+		if n != buckets[i] {
+			t.Errorf("bucket %d: got %d operations, want %d", i, n, buckets[i])
+		}
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{0.3, 2 * time.Microsecond},
+		{0.5, 4 * time.Microsecond},
+		{0.8, 128 * time.Microsecond},
+		{0.99, time.Duration(1<<63 - 1)},
+		{1, time.Duration(1<<63 - 1)},
+	}
+	for _, test := range tests {
+		if got := s.Percentile(test.p); got != test.want {
+			t.Errorf("percentile %g: got %s, want %s", test.p, got, test.want)
+		}
+	}
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+	if m := s.Mean(); m != sum/time.Duration(len(durations)) {
+		t.Errorf("got mean %s, want %s", m, sum/time.Duration(len(durations)))
+	}
+}
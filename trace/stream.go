@@ -0,0 +1,79 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// SchemaVersion is the version of the format of the trace records. It is
+// incremented each time the records of an existing operation change.
+const SchemaVersion = 1
+
+// streamTag is the first value of the CSV header record of a stream. It
+// starts with '#', so that CSV readers may ignore that record as a comment.
+const streamTag = "#cluefs"
+
+// StreamInfo describes a trace stream. It is written as the first record
+// of every stream, before any event.
+type StreamInfo struct {
+	Schema    int
+	Version   string
+	MountDir  string
+	ShadowDir string
+	Host      string
+	Start     time.Time
+}
+
+// NewStreamInfo returns the description of a stream of events emitted by
+// version of cluefs for the file system mounted at mountDir
+func NewStreamInfo(version, mountDir, shadowDir string) *StreamInfo {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &StreamInfo{
+		Schema:    SchemaVersion,
+		Version:   version,
+		MountDir:  mountDir,
+		ShadowDir: shadowDir,
+		Host:      host,
+		Start:     time.Now(),
+	}
+}
+
+func (s *StreamInfo) String() string {
+	return fmt.Sprintf("cluefs %s schema %d %s:%s -> %s %s",
+		s.Version,
+		s.Schema,
+		s.Host,
+		s.ShadowDir,
+		s.MountDir,
+		s.Start.UTC().Format(time.RFC3339Nano))
+}
+
+func (s *StreamInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"stream": map[string]interface{}{
+			"schema":  s.Schema,
+			"version": s.Version,
+			"mount":   s.MountDir,
+			"shadow":  s.ShadowDir,
+			"host":    s.Host,
+			"start":   s.Start.UTC().Format(time.RFC3339Nano),
+		},
+	})
+}
+
+func (s *StreamInfo) MarshalCSV() []string {
+	return []string{
+		streamTag,
+		fmt.Sprintf("%d", s.Schema),
+		s.Version,
+		s.MountDir,
+		s.ShadowDir,
+		s.Host,
+		s.Start.UTC().Format(time.RFC3339Nano),
+	}
+}
@@ -0,0 +1,517 @@
+package trace
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// The decoders below read back the records written in CSV and JSON format.
+// The values of these formats are meant to be read by humans, so some of
+// the information of the events is lost: the access mode of an access(2)
+// made of several bits is recorded as "unknown" and decoded as F_OK, and
+// the previous mode of a file changed by setattr is decoded without its
+// type bits.
+
+// fields gives access to the values of a record by their key in JSON
+// format. It returns the empty string for the values which are not present.
+type fields interface {
+	get(key string) string
+}
+
+// csvFields holds the values of a CSV record, described by columns
+type csvFields struct {
+	values  []string
+	columns []csvColumn
+}
+
+func (f csvFields) get(key string) string {
+	for i, c := range f.columns {
+		if c.name == key && i < len(f.values) {
+			return f.values[i]
+		}
+	}
+	return ""
+}
+
+// jsonFields holds the properties of a JSON object. The properties of the
+// nested objects are present with their key prefixed by that of the object
+// and a dot, e.g. "new.size".
+type jsonFields map[string]interface{}
+
+func (f jsonFields) get(key string) string {
+	switch v := f[key].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, e := range v {
+			res = append(res, fmt.Sprintf("%v", e))
+		}
+		return strings.Join(res, "|")
+	}
+	return ""
+}
+
+// flatten adds the properties of the nested objects of f to f
+func (f jsonFields) flatten() {
+	for k, v := range f {
+		if m, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range m {
+				f[k+"."+nk] = nv
+			}
+		}
+	}
+}
+
+// fieldParser converts the values of a record. It keeps the first error
+// found, after which the conversions yield zero values.
+type fieldParser struct {
+	err error
+}
+
+func (p *fieldParser) fail(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (p *fieldParser) uint(s string, bits int) uint64 {
+	v, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		p.fail("invalid unsigned integer '%s'", s)
+	}
+	return v
+}
+
+func (p *fieldParser) int(s string, bits int) int64 {
+	v, err := strconv.ParseInt(s, 10, bits)
+	if err != nil {
+		p.fail("invalid integer '%s'", s)
+	}
+	return v
+}
+
+func (p *fieldParser) time(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		p.fail("invalid time stamp '%s'", s)
+	}
+	return t
+}
+
+// perm parses a permission written by permString
+func (p *fieldParser) perm(s string) os.FileMode {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		p.fail("invalid permission '%s'", s)
+	}
+	return os.FileMode(v) & os.ModePerm
+}
+
+// flags parses the flags written by flagsString
+func (p *fieldParser) flags(s string) fuse.OpenFlags {
+	var flags fuse.OpenFlags
+	names := strings.Split(s, "|")
+names:
+	for i, n := range names {
+		if i == 0 {
+			for mode, name := range openModeMap {
+				if name == n {
+					flags |= mode
+					continue names
+				}
+			}
+		}
+		for _, f := range openFlagNames {
+			if f.name == n {
+				flags |= fuse.OpenFlags(f.bit)
+				continue names
+			}
+		}
+		p.fail("invalid open flags '%s'", s)
+		break
+	}
+	return flags
+}
+
+// accessMode parses an access mode written by accessModeString
+func (p *fieldParser) accessMode(s string) uint32 {
+	for mode, name := range accessModeMap {
+		if name == s {
+			return mode
+		}
+	}
+	return 0
+}
+
+var fileTypeModes = map[string]os.FileMode{
+	"dir":      os.ModeDir,
+	"symlink":  os.ModeSymlink,
+	"fifo":     os.ModeNamedPipe,
+	"socket":   os.ModeSocket,
+	"chardev":  os.ModeDevice | os.ModeCharDevice,
+	"blockdev": os.ModeDevice,
+	"file":     0,
+}
+
+// fileType parses a file type written by fileTypeString
+func (p *fieldParser) fileType(s string) os.FileMode {
+	mode, ok := fileTypeModes[s]
+	if !ok {
+		p.fail("invalid file type '%s'", s)
+	}
+	return mode
+}
+
+// setattrValid parses the attributes written by setattrString
+func (p *fieldParser) setattrValid(s string) fuse.SetattrValid {
+	var valid fuse.SetattrValid
+	if s == "" {
+		return valid
+	}
+names:
+	for _, n := range strings.Split(s, "|") {
+		for f, name := range setattrFieldNames {
+			if name == n {
+				valid |= f
+				continue names
+			}
+		}
+		p.fail("invalid attributes '%s'", s)
+		break
+	}
+	return valid
+}
+
+// opDecoders sets the fields specific to each type of operation from their
+// values. The operations without specific fields are not present.
+var opDecoders = map[FSOperType]func(op FsOperTracer, f fields, p *fieldParser){
+	FsOpen: func(op FsOperTracer, f fields, p *fieldParser) {
+		o := op.(*OpenOp)
+		o.Flags = p.flags(f.get("flags"))
+		o.Perm = p.perm(f.get("perm"))
+		o.FileSize = p.uint(f.get("size"), 64)
+		o.BlockSize = uint32(p.uint(f.get("blksize"), 32))
+		o.OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsRead: func(op FsOperTracer, f fields, p *fieldParser) {
+		o := op.(*ReadOp)
+		o.FileSize = p.uint(f.get("filesize"), 64)
+		o.Offset = p.int(f.get("position"), 64)
+		o.Size = int(p.int(f.get("bytesreq"), 0))
+		o.BytesRead = int(p.int(f.get("bytesread"), 0))
+		o.OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsWrite: func(op FsOperTracer, f fields, p *fieldParser) {
+		o := op.(*WriteOp)
+		o.Offset = p.int(f.get("position"), 64)
+		o.Size = int(p.int(f.get("bytesreq"), 0))
+		o.BytesWritten = int(p.int(f.get("byteswritten"), 0))
+		o.OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsFlush: func(op FsOperTracer, f fields, p *fieldParser) {
+		o := op.(*FlushOp)
+		o.Flags = p.flags(f.get("flags"))
+		o.FileSize = p.uint(f.get("size"), 64)
+		o.OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsFsync: func(op FsOperTracer, f fields, p *fieldParser) {
+		s := f.get("datasync")
+		op.(*FsyncOp).DataSync = s == dataSyncMap[true] || s == "true"
+	},
+	FsRelease: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*ReleaseOp).OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsMkdir: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*MkdirOp).Mode = p.perm(f.get("mode"))
+	},
+	FsMknod: func(op FsOperTracer, f fields, p *fieldParser) {
+		o := op.(*MknodOp)
+		o.Mode = p.fileType(f.get("filetype")) | p.perm(f.get("mode"))
+		o.Rdev = uint32(p.uint(f.get("rdev"), 32))
+	},
+	FsCreate: func(op FsOperTracer, f fields, p *fieldParser) {
+		o := op.(*CreateOp)
+		o.Flags = p.flags(f.get("flags"))
+		o.Mode = p.perm(f.get("perm"))
+		o.OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsSymlink: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*SymlinkOp).Target = f.get("target")
+	},
+	FsReadDir: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*ReadDirOp).OpenID = p.uint(f.get("openid"), 64)
+	},
+	FsRename: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*RenameOp).NewPath = f.get("new")
+	},
+	FsLink: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*LinkOp).NewPath = f.get("new")
+	},
+	FsAccess: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*AccessOp).Mask = p.accessMode(f.get("mode"))
+	},
+	FsSetAttr: decodeSetattr,
+	FsGetXattr: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*GetxattrOp).AttrName = f.get("name")
+	},
+	FsListXattr: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*ListxattrOp).Size = uint32(p.uint(f.get("size"), 32))
+	},
+	FsSetXattr: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*SetxattrOp).AttrName = f.get("name")
+	},
+	FsRemoveXattr: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*RemovexattrOp).AttrName = f.get("name")
+	},
+	FsLost: func(op FsOperTracer, f fields, p *fieldParser) {
+		op.(*LostOp).Count = p.uint(f.get("count"), 64)
+	},
+}
+
+// decodeSetattr sets the fields of a setattr operation. The attributes to
+// be changed are those which requested value is present.
+func decodeSetattr(op FsOperTracer, f fields, p *fieldParser) {
+	o := op.(*SetattrOp)
+	o.Applied = p.setattrValid(f.get("applied"))
+	o.Failed = p.setattrValid(f.get("failed"))
+	now := (o.Applied | o.Failed) & (fuse.SetattrAtimeNow | fuse.SetattrMtimeNow)
+	if s := f.get("new.size"); s != "" {
+		o.AttrValid |= fuse.SetattrSize
+		o.Size = p.uint(s, 64)
+	}
+	if s := f.get("new.mode"); s != "" {
+		o.AttrValid |= fuse.SetattrMode
+		o.Mode = p.perm(s)
+	}
+	if s := f.get("new.uid"); s != "" {
+		o.AttrValid |= fuse.SetattrUid
+		o.Uid = uint32(p.uint(s, 32))
+	}
+	if s := f.get("new.gid"); s != "" {
+		o.AttrValid |= fuse.SetattrGid
+		o.Gid = uint32(p.uint(s, 32))
+	}
+	if s := f.get("new.atime"); s != "" {
+		if now&fuse.SetattrAtimeNow != 0 {
+			o.AttrValid |= fuse.SetattrAtimeNow
+		} else {
+			o.AttrValid |= fuse.SetattrAtime
+		}
+		o.Atime = p.time(s)
+	}
+	if s := f.get("new.mtime"); s != "" {
+		if now&fuse.SetattrMtimeNow != 0 {
+			o.AttrValid |= fuse.SetattrMtimeNow
+		} else {
+			o.AttrValid |= fuse.SetattrMtime
+		}
+		o.Mtime = p.time(s)
+	}
+	if s := f.get("new.handle"); s != "" {
+		o.AttrValid |= fuse.SetattrHandle
+		o.Handle = p.uint(s, 64)
+	}
+	if s := f.get("old.size"); s != "" {
+		o.Previous = &fuse.Attr{
+			Size:  p.uint(s, 64),
+			Mode:  p.perm(f.get("old.mode")),
+			Uid:   uint32(p.uint(f.get("old.uid"), 32)),
+			Gid:   uint32(p.uint(f.get("old.gid"), 32)),
+			Atime: p.time(f.get("old.atime")),
+			Mtime: p.time(f.get("old.mtime")),
+		}
+	}
+}
+
+// decodeInfo returns the description of a stream from its values
+func decodeInfo(schema, version, mountDir, shadowDir, host, start string) (*StreamInfo, error) {
+	var p fieldParser
+	info := &StreamInfo{
+		Schema:    int(p.uint(schema, 16)),
+		Version:   version,
+		MountDir:  mountDir,
+		ShadowDir: shadowDir,
+		Host:      host,
+		Start:     p.time(start),
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("invalid stream header [%s]", p.err)
+	}
+	if info.Schema > SchemaVersion {
+		return nil, fmt.Errorf("trace has schema version %d, only versions up to %d are supported", info.Schema, SchemaVersion)
+	}
+	return info, nil
+}
+
+// CSVDecoder reads records in CSV format
+type CSVDecoder struct {
+	reader  *csv.Reader
+	records int
+}
+
+func NewCSVDecoder(r io.Reader) *CSVDecoder {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return &CSVDecoder{reader: reader}
+}
+
+// Next returns the next record of the stream, which is either a *StreamInfo
+// or an FsOperTracer. It returns io.EOF at the end of the stream.
+func (d *CSVDecoder) Next() (interface{}, error) {
+	values, err := d.reader.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV record [%s]", err)
+	}
+	d.records++
+	if values[0] == streamTag {
+		if len(values) < len(csvStreamColumns) {
+			return nil, fmt.Errorf("record %d: invalid stream header", d.records)
+		}
+		s := csvFields{values, csvStreamColumns}
+		info, err := decodeInfo(s.get("schema"), s.get("version"), s.get("mount"),
+			s.get("shadow"), s.get("host"), s.get("start"))
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %s", d.records, err)
+		}
+		return info, nil
+	}
+	op, err := d.decodeEvent(values)
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %s", d.records, err)
+	}
+	return op, nil
+}
+
+func (d *CSVDecoder) decodeEvent(values []string) (FsOperTracer, error) {
+	columns := csvHeaderColumns
+	n := len(columns)
+	if len(values) < n {
+		return nil, fmt.Errorf("%d values, expecting at least %d", len(values), n)
+	}
+	hdr := csvFields{values[:n], columns}
+	t, ok := OperTypeFromString(hdr.get("type"))
+	if !ok {
+		return nil, fmt.Errorf("unknown operation type '%s'", hdr.get("type"))
+	}
+	op := newOp(t)
+	h := op.GetHeader()
+	var p fieldParser
+	h.Start = p.time(hdr.get("start"))
+	h.End = p.time(hdr.get("end"))
+	h.names = knownNames(hdr.get("usr"), hdr.get("grp"), hdr.get("proc"))
+	h.Uid = uint32(p.uint(hdr.get("uid"), 32))
+	h.Gid = uint32(p.uint(hdr.get("gid"), 32))
+	h.Pid = uint32(p.uint(hdr.get("pid"), 32))
+	h.Path = hdr.get("path")
+	h.IsDir = hdr.get("isdir") == isDirMap[true]
+	h.Errno = syscall.Errno(p.uint(hdr.get("errno"), 32))
+	h.Injected = hdr.get("injected") == injectedMap[true]
+	if s := hdr.get("nsdelay"); s != "" {
+		h.Delay = time.Duration(p.int(s, 64))
+	}
+	if decode, ok := opDecoders[t]; ok {
+		decode(op, csvFields{values[n:], csvColumns[t]}, &p)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return op, nil
+}
+
+// JSONDecoder reads records in JSON format
+type JSONDecoder struct {
+	decoder *json.Decoder
+	records int
+}
+
+func NewJSONDecoder(r io.Reader) *JSONDecoder {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	return &JSONDecoder{decoder: decoder}
+}
+
+// Next returns the next record of the stream, which is either a *StreamInfo
+// or an FsOperTracer. It returns io.EOF at the end of the stream.
+func (d *JSONDecoder) Next() (interface{}, error) {
+	var record struct {
+		Stream jsonFields `json:"stream"`
+		Hdr    jsonFields `json:"hdr"`
+		Op     jsonFields `json:"op"`
+	}
+	if err := d.decoder.Decode(&record); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("invalid JSON record [%s]", err)
+	}
+	d.records++
+	if record.Stream != nil {
+		s := record.Stream
+		info, err := decodeInfo(s.get("schema"), s.get("version"), s.get("mount"),
+			s.get("shadow"), s.get("host"), s.get("start"))
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %s", d.records, err)
+		}
+		return info, nil
+	}
+	if record.Hdr == nil || record.Op == nil {
+		return nil, fmt.Errorf("record %d: not a trace record", d.records)
+	}
+	op, err := d.decodeEvent(record.Hdr, record.Op)
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %s", d.records, err)
+	}
+	return op, nil
+}
+
+func (d *JSONDecoder) decodeEvent(hdr, f jsonFields) (FsOperTracer, error) {
+	t, ok := OperTypeFromString(f.get("type"))
+	if !ok {
+		return nil, fmt.Errorf("unknown operation type '%s'", f.get("type"))
+	}
+	op := newOp(t)
+	h := op.GetHeader()
+	var p fieldParser
+	h.Start = p.time(hdr.get("start"))
+	h.End = p.time(hdr.get("end"))
+	h.names = knownNames(hdr.get("usr"), hdr.get("grp"), hdr.get("proc"))
+	h.Uid = uint32(p.uint(hdr.get("uid"), 32))
+	h.Gid = uint32(p.uint(hdr.get("gid"), 32))
+	h.Pid = uint32(p.uint(hdr.get("pid"), 32))
+	h.Errno = syscall.Errno(p.uint(hdr.get("errno"), 32))
+	h.Injected = hdr.get("injected") == "true"
+	if s := hdr.get("nsdelay"); s != "" {
+		h.Delay = time.Duration(p.int(s, 64))
+	}
+	// The operations involving two paths name the first one "old"
+	h.Path = f.get("path")
+	if _, ok := f["path"]; !ok {
+		h.Path = f.get("old")
+	}
+	h.IsDir = f.get("isdir") == "true"
+	if decode, ok := opDecoders[t]; ok {
+		f.flatten()
+		decode(op, f, &p)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return op, nil
+}
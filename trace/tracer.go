@@ -0,0 +1,234 @@
+// Package trace defines the events emitted by a cluefs file system for
+// each operation it serves and the tracers which collect and format them.
+package trace
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FsOperTracer interface {
+	String() string
+	SetTimeEnd()
+	SetResult(err error)
+	GetHeader() *Header
+	RewritePaths(rewrite func(path string) string)
+	MarshalCSV() []string
+}
+
+// Tracer is the interface implemented by the collectors of the events
+// emitted by the file system. Trace may be called concurrently and should
+// not block for long, since the file system operation waits for it. Close
+// writes all the pending events and releases the resources used by the
+// tracer; it returns an error if the trace is not complete.
+type Tracer interface {
+	Trace(op FsOperTracer)
+	Close() error
+}
+
+type CSVTracer struct {
+	*collector
+	writer *csv.Writer
+	closer io.Closer
+}
+
+// NewCSVTracer creates a tracer which writes each event to w as a line of
+// comma-separated values. If info is not nil, it is written first.
+func NewCSVTracer(w io.Writer, info *StreamInfo, opts QueueOptions) *CSVTracer {
+	tracer := &CSVTracer{writer: csv.NewWriter(w)}
+	// Start the event collector
+	tracer.collector = newCollector(opts, info, tracer, w)
+	return tracer
+}
+
+func (t *CSVTracer) writeInfo(info *StreamInfo) error {
+	return t.writer.Write(info.MarshalCSV())
+}
+
+func (t *CSVTracer) write(op FsOperTracer) error {
+	return t.writer.Write(op.MarshalCSV())
+}
+
+func (t *CSVTracer) flush() error {
+	t.writer.Flush()
+	return t.writer.Error()
+}
+
+func (t *CSVTracer) Trace(op FsOperTracer) {
+	t.put(op)
+}
+
+func (t *CSVTracer) Close() error {
+	return closeDestination(t.close(), t.closer)
+}
+
+type JSONTracer struct {
+	*collector
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+// NewJSONTracer creates a tracer which writes each event to w as a
+// JSON object in a single line. If info is not nil, it is written first.
+func NewJSONTracer(w io.Writer, info *StreamInfo, opts QueueOptions) *JSONTracer {
+	tracer := &JSONTracer{writer: bufio.NewWriter(w)}
+	// Start the event collector
+	tracer.collector = newCollector(opts, info, tracer, w)
+	return tracer
+}
+
+func (t *JSONTracer) writeInfo(info *StreamInfo) error {
+	return t.writeObject(info)
+}
+
+func (t *JSONTracer) write(op FsOperTracer) error {
+	return t.writeObject(op)
+}
+
+func (t *JSONTracer) writeObject(v interface{}) error {
+	m, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = t.writer.Write(append(m, '\n'))
+	return err
+}
+
+func (t *JSONTracer) flush() error {
+	return t.writer.Flush()
+}
+
+func (t *JSONTracer) Trace(op FsOperTracer) {
+	t.put(op)
+}
+
+func (t *JSONTracer) Close() error {
+	return closeDestination(t.close(), t.closer)
+}
+
+// NewTracer creates a tracer of the given kind ("csv", "json", "bin" or
+// "otlp") which writes to dest. If dest is "-" or empty, the events are
+// written to the standard output. If it starts with "unix:" or "tcp:", they
+// are sent to the clients connected to the socket at the address which
+// follows (see SocketTracer). If it is an HTTP URL, the events are exported
+// as spans to the OpenTelemetry collector at that URL, which requires the
+// kind "otlp". Otherwise dest is the path of a file, which is rotated
+// according to rotate and closed when the tracer is closed.
+func NewTracer(kind, dest string, info *StreamInfo, opts QueueOptions, rotate RotateOptions) (Tracer, error) {
+	if IsURLDestination(dest) {
+		if kind != "otlp" {
+			return nil, fmt.Errorf("events in format '%s' cannot be sent to '%s'", kind, dest)
+		}
+		return NewOTLPHTTPTracer(dest, info, opts)
+	}
+	if network, address, ok := parseSocketAddress(dest); ok {
+		return NewSocketTracer(kind, network, address, info, opts)
+	}
+	w, closer, err := openTraceDestination(dest, rotate)
+	if err != nil {
+		return nil, err
+	}
+	return newWriterTracer(kind, w, closer, info, opts), nil
+}
+
+// newWriterTracer creates a tracer of the given kind which writes to w and
+// closes closer, if not nil, when it is closed
+func newWriterTracer(kind string, w io.Writer, closer io.Closer, info *StreamInfo, opts QueueOptions) Tracer {
+	switch kind {
+	case "json":
+		tracer := NewJSONTracer(w, info, opts)
+		tracer.closer = closer
+		return tracer
+	case "bin":
+		tracer := NewBinaryTracer(w, info, opts)
+		tracer.closer = closer
+		return tracer
+	case "otlp":
+		tracer := NewOTLPTracer(w, info, opts)
+		tracer.closer = closer
+		return tracer
+	}
+	tracer := NewCSVTracer(w, info, opts)
+	tracer.closer = closer
+	return tracer
+}
+
+// IsFileDestination returns true if the trace destination dest, as given to
+// NewTracer, is a file
+func IsFileDestination(dest string) bool {
+	_, _, socket := parseSocketAddress(dest)
+	return !socket && !IsURLDestination(dest) && len(dest) > 0 && dest != "-"
+}
+
+// MultiTracer is a tracer which forwards every event to several tracers.
+// Each one of them has its own queue of events and overflow policy.
+type MultiTracer struct {
+	tracers []Tracer
+}
+
+func NewMultiTracer(tracers ...Tracer) *MultiTracer {
+	return &MultiTracer{tracers: tracers}
+}
+
+func (t *MultiTracer) Trace(op FsOperTracer) {
+	for _, tracer := range t.tracers {
+		tracer.Trace(op)
+	}
+}
+
+// Close closes all the tracers and returns the errors they report, if any
+func (t *MultiTracer) Close() error {
+	problems := make([]string, 0, len(t.tracers))
+	for _, tracer := range t.tracers {
+		if err := tracer.Close(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// closeDestination closes the trace destination, if any, and returns the
+// first error among err and the one found when closing
+func closeDestination(err error, closer io.Closer) error {
+	if closer == nil {
+		return err
+	}
+	if cerr := closer.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("could not close trace destination [%s]", cerr)
+	}
+	return err
+}
+
+// openTraceDestination opens the file at filePath for appending trace
+// records, or the standard output if filePath is "-" or empty. The returned
+// closer is nil for the standard output.
+func openTraceDestination(filePath string, rotate RotateOptions) (io.Writer, io.Closer, error) {
+	if !IsFileDestination(filePath) {
+		return os.Stdout, nil, nil
+	}
+	if rotate.IsEnabled() {
+		f, err := openRotatingFile(filePath, rotate)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f, nil
+	}
+	abspath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not retrieve absolute path for '%s' [%s]", filePath, err)
+	}
+	destFile, err := os.OpenFile(abspath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open file '%s' for writing [%s]", filePath, err)
+	}
+	return destFile, destFile, nil
+}